@@ -0,0 +1,219 @@
+package btgo
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/mopsled/btgo/peer"
+)
+
+const defaultBanThreshold = 2
+
+type PieceResult int
+
+const (
+	PieceIncomplete PieceResult = iota
+	PieceVerified
+	PieceFailed
+)
+
+// Haver is a connection that can be told we have a piece; *peer.PeerConn
+// implements it.
+type Haver interface {
+	Have(index int) error
+}
+
+// PieceAssembler writes blocks to storage as they arrive and, once a piece is
+// whole, checks it against its hash. A verified piece is marked complete and
+// announced with a have message on every connection; a failed piece is
+// discarded and counts against every peer that sent part of it, which is
+// banned once it has contributed to BanThreshold failed pieces.
+type PieceAssembler struct {
+	BanThreshold int
+
+	tfile   *Torfile
+	storage Storage
+
+	mu       sync.Mutex
+	verified peer.Bitfield
+	pending  map[int]*pieceAssembly
+	offenses map[string]int
+	conns    map[string]Haver
+}
+
+type pieceAssembly struct {
+	blocks   []assembledBlock
+	received int64
+}
+
+type assembledBlock struct {
+	from          string
+	begin, length uint32
+}
+
+func NewPieceAssembler(tfile *Torfile, storage Storage) *PieceAssembler {
+	return &PieceAssembler{
+		BanThreshold: defaultBanThreshold,
+		tfile:        tfile,
+		storage:      storage,
+		verified:     peer.NewBitfield(tfile.numPieces()),
+		pending:      make(map[int]*pieceAssembly),
+		offenses:     make(map[string]int),
+		conns:        make(map[string]Haver),
+	}
+}
+
+func (a *PieceAssembler) AddConn(key string, conn Haver) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.conns[key] = conn
+}
+
+func (a *PieceAssembler) RemoveConn(key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.conns, key)
+}
+
+// SetVerified records a piece found complete by other means, such as a
+// check of existing data, so that blocks for it are ignored.
+func (a *PieceAssembler) SetVerified(piece int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.verified.Set(piece)
+	delete(a.pending, piece)
+}
+
+// Verified returns a copy of the pieces verified so far.
+func (a *PieceAssembler) Verified() peer.Bitfield {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append(peer.Bitfield(nil), a.verified...)
+}
+
+// Banned reports whether the peer has sent parts of too many bad pieces.
+func (a *PieceAssembler) Banned(key string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.BanThreshold > 0 && a.offenses[key] >= a.BanThreshold
+}
+
+// Offenses returns how many failed pieces the peer contributed to.
+func (a *PieceAssembler) Offenses(key string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.offenses[key]
+}
+
+// Block stores a block received from a peer and, if it completes its piece,
+// verifies the piece. Blocks for verified pieces or that overlap one already
+// received are dropped.
+func (a *PieceAssembler) Block(from string, index, begin uint32, data []byte) (result PieceResult, err error) {
+	piece := int(index)
+	if err = checkPieceRange(a.tfile, piece, int64(begin), len(data)); err != nil {
+		return
+	}
+	if len(data) == 0 {
+		return
+	}
+
+	a.mu.Lock()
+	if a.verified.Has(piece) {
+		a.mu.Unlock()
+		return
+	}
+	assembly := a.pending[piece]
+	if assembly == nil {
+		assembly = new(pieceAssembly)
+		a.pending[piece] = assembly
+	}
+	if assembly.overlaps(begin, len(data)) {
+		a.mu.Unlock()
+		return
+	}
+	if _, err = a.storage.WriteAt(data, piece, int64(begin)); err != nil {
+		a.mu.Unlock()
+		return
+	}
+	assembly.blocks = append(assembly.blocks, assembledBlock{from, begin, uint32(len(data))})
+	assembly.received += int64(len(data))
+	if assembly.received < a.tfile.pieceSize(piece) {
+		a.mu.Unlock()
+		return
+	}
+	delete(a.pending, piece)
+	a.mu.Unlock()
+
+	ok, err := a.VerifyPiece(piece)
+	if err != nil {
+		return
+	}
+	if !ok {
+		a.recordFailure(assembly)
+		return PieceFailed, nil
+	}
+	if err = a.storage.MarkComplete(piece); err != nil {
+		return
+	}
+	a.SetVerified(piece)
+	a.broadcastHave(piece)
+	return PieceVerified, nil
+}
+
+// overlaps reports whether n bytes at begin overlap a block already received.
+func (p *pieceAssembly) overlaps(begin uint32, n int) bool {
+	end := int64(begin) + int64(n)
+	for _, b := range p.blocks {
+		if int64(b.begin) < end && int64(b.begin)+int64(b.length) > int64(begin) {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyPiece reads a piece back from storage and checks it against the
+// torfile's piece hash.
+func (a *PieceAssembler) VerifyPiece(piece int) (ok bool, err error) {
+	if piece < 0 || piece >= len(a.tfile.pieces) {
+		return false, errors.New("No piece hash to verify against")
+	}
+	data := make([]byte, a.tfile.pieceSize(piece))
+	if _, err = a.storage.ReadAt(data, piece, 0); err != nil {
+		return
+	}
+	sum := sha1.Sum(data)
+	return bytes.Equal(sum[:], a.tfile.pieces[piece]), nil
+}
+
+func (a *PieceAssembler) recordFailure(assembly *pieceAssembly) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	contributors := make(map[string]bool)
+	for _, b := range assembly.blocks {
+		contributors[b.from] = true
+	}
+	for from := range contributors {
+		a.offenses[from]++
+	}
+}
+
+func (a *PieceAssembler) broadcastHave(piece int) {
+	a.mu.Lock()
+	keys := make([]string, 0, len(a.conns))
+	for key := range a.conns {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	conns := make([]Haver, len(keys))
+	for i, key := range keys {
+		conns[i] = a.conns[key]
+	}
+	a.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Have(piece)
+	}
+}
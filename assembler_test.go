@@ -0,0 +1,101 @@
+package btgo
+
+import (
+	"crypto/sha1"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+type fakeHaver struct {
+	mu    sync.Mutex
+	haves []int
+}
+
+func (f *fakeHaver) Have(index int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.haves = append(f.haves, index)
+	return nil
+}
+
+// hashedTorfile returns a torfile of pieces of two blocks over random data,
+// with a short last piece.
+func hashedTorfile(length int) (*Torfile, []byte) {
+	data := make([]byte, length)
+	rand.New(rand.NewSource(1)).Read(data)
+	tfile := &Torfile{files: []File{{"data", int64(length)}}, pieceLength: 2 * blockLength}
+	for offset := 0; offset < length; offset += 2 * blockLength {
+		end := offset + 2*blockLength
+		if end > length {
+			end = length
+		}
+		sum := sha1.Sum(data[offset:end])
+		tfile.pieces = append(tfile.pieces, sum[:])
+	}
+	return tfile, data
+}
+
+func TestPieceAssemblerVerifiesPieces(t *testing.T) {
+	tfile, data := hashedTorfile(3*blockLength + 100)
+	storage := NewMemoryStorage(tfile)
+	a := NewPieceAssembler(tfile, storage)
+	haver1, haver2 := new(fakeHaver), new(fakeHaver)
+	a.AddConn("a", haver1)
+	a.AddConn("b", haver2)
+
+	if result, err := a.Block("a", 1, blockLength, data[3*blockLength:]); err != nil || result != PieceIncomplete {
+		t.Fatalf("Expected incomplete piece, got %v (%v)", result, err)
+	}
+	if result, _ := a.Block("b", 1, blockLength, data[3*blockLength:]); result != PieceIncomplete {
+		t.Errorf("Expected duplicate block to be dropped, got %v", result)
+	}
+	if result, err := a.Block("b", 1, 0, data[2*blockLength:3*blockLength]); err != nil || result != PieceVerified {
+		t.Fatalf("Expected verified piece, got %v (%v)", result, err)
+	}
+	if !sameSlice(haver1.haves, []int{1}) || !sameSlice(haver2.haves, []int{1}) {
+		t.Errorf("Expected have broadcast to all connections, got %v and %v", haver1.haves, haver2.haves)
+	}
+	if !storage.Completed().Has(1) {
+		t.Error("Expected piece to be marked complete in storage")
+	}
+	if result, _ := a.Block("a", 1, 0, data[2*blockLength:3*blockLength]); result != PieceIncomplete {
+		t.Errorf("Expected block for verified piece to be ignored, got %v", result)
+	}
+	if _, err := a.Block("a", 1, blockLength, data[:blockLength]); err == nil {
+		t.Error("Expected error for block past the end of the piece")
+	}
+	if ok, err := a.VerifyPiece(0); ok || err != nil {
+		t.Errorf("Expected unwritten piece to fail verification, got %v (%v)", ok, err)
+	}
+}
+
+func TestPieceAssemblerBansRepeatOffenders(t *testing.T) {
+	tfile, data := hashedTorfile(4 * blockLength)
+	a := NewPieceAssembler(tfile, NewMemoryStorage(tfile))
+	haver := new(fakeHaver)
+	a.RemoveConn("none")
+	a.AddConn("a", haver)
+	bad := make([]byte, blockLength)
+
+	a.Block("good", 0, 0, data[:blockLength])
+	if result, _ := a.Block("evil", 0, blockLength, bad); result != PieceFailed {
+		t.Fatalf("Expected failed piece, got %v", result)
+	}
+	if a.Offenses("good") != 1 || a.Offenses("evil") != 1 || a.Banned("evil") {
+		t.Errorf("Unexpected offenses %d and %d", a.Offenses("good"), a.Offenses("evil"))
+	}
+	if len(haver.haves) != 0 {
+		t.Errorf("Unexpected have for failed piece: %v", haver.haves)
+	}
+
+	a.Block("evil", 0, 0, bad)
+	a.Block("evil", 0, blockLength, bad)
+	if !a.Banned("evil") || a.Banned("good") {
+		t.Errorf("Expected only evil to be banned, got %d and %d", a.Offenses("good"), a.Offenses("evil"))
+	}
+
+	if result, _ := a.Block("good", 0, 0, data[:2*blockLength]); result != PieceVerified {
+		t.Errorf("Expected failed piece to be downloaded again, got %v", result)
+	}
+}
@@ -16,10 +16,10 @@ func Bencode(t interface{}) (bencoded string) {
 		if st, ok := t.(string); ok {
 			bencoded = bencodeString(st)
 		}
-	case reflect.Int:
-		if st, ok := t.(int); ok {
-			bencoded = bencodeInt(st)
-		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		bencoded = bencodeInt(reflect.ValueOf(t).Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		bencoded = bencodeUint(reflect.ValueOf(t).Uint())
 	case reflect.Slice:
 		if stringBytes, ok := t.([]byte); ok {
 			bencoded = bencodeString(string(stringBytes))
@@ -54,7 +54,11 @@ func bencodeString(s string) string {
 	return fmt.Sprintf("%d:%s", len(s), s)
 }
 
-func bencodeInt(i int) string {
+func bencodeInt(i int64) string {
+	return fmt.Sprintf("i%de", i)
+}
+
+func bencodeUint(i uint64) string {
 	return fmt.Sprintf("i%de", i)
 }
 
@@ -29,6 +29,18 @@ func TestBencode(t *testing.T) {
 	if s := Bencode(100); s != "i100e" {
 		t.Error("Doesn't encode 100 correctly:", s)
 	}
+	if s := Bencode(int64(-8589934592)); s != "i-8589934592e" {
+		t.Error("Doesn't encode int64 correctly:", s)
+	}
+	if s := Bencode(int8(-7)); s != "i-7e" {
+		t.Error("Doesn't encode int8 correctly:", s)
+	}
+	if s := Bencode(uint32(4000000000)); s != "i4000000000e" {
+		t.Error("Doesn't encode uint32 correctly:", s)
+	}
+	if s := Bencode(uint64(18446744073709551615)); s != "i18446744073709551615e" {
+		t.Error("Doesn't encode uint64 correctly:", s)
+	}
 
 	// Big Integers
 	expected := new(big.Int)
@@ -1,6 +1,8 @@
 package btgo
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"math/big"
 	"reflect"
@@ -12,6 +14,18 @@ func Buncode(s []byte) (buncoded interface{}) {
 	return
 }
 
+// tryBuncode is Buncode for untrusted input: malformed data is reported as an
+// error instead of a panic.
+func tryBuncode(s []byte) (buncoded interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Buncoding error: %v", r)
+		}
+	}()
+	buncoded = Buncode(s)
+	return
+}
+
 func buncode(st []byte, begin int) (buncoded interface{}, consumed int, unlistified bool) {
 	elements := make([]interface{}, 0)
 
@@ -97,3 +111,42 @@ func parseString(st []byte, begin int) (s []byte, consumed int) {
 	consumed = end - begin
 	return
 }
+
+// bencodedLength returns the length of the bencoded value at the start of b,
+// for messages that carry raw data after a bencoded dictionary.
+func bencodedLength(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return 0, errors.New("Bencoded value is empty")
+	}
+	switch c := b[0]; {
+	case c == 'i':
+		end := bytes.IndexByte(b, 'e')
+		if end < 0 {
+			return 0, errors.New("Unterminated bencoded integer")
+		}
+		return end + 1, nil
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(b, ':')
+		if colon < 0 {
+			return 0, errors.New("Unterminated bencoded string length")
+		}
+		length, err := strconv.Atoi(string(b[:colon]))
+		if err != nil || length < 0 || length > len(b)-colon-1 {
+			return 0, errors.New("Invalid bencoded string length")
+		}
+		return colon + 1 + length, nil
+	case c == 'l' || c == 'd':
+		for n = 1; n < len(b) && b[n] != 'e'; {
+			inner, err := bencodedLength(b[n:])
+			if err != nil {
+				return 0, err
+			}
+			n += inner
+		}
+		if n >= len(b) {
+			return 0, errors.New("Unterminated bencoded list or dictionary")
+		}
+		return n + 1, nil
+	}
+	return 0, fmt.Errorf("Unexpected character '%c' in bencoded value", b[0])
+}
@@ -79,3 +79,21 @@ func TestBuncode(t *testing.T) {
 func sameSlice(a interface{}, b interface{}) bool {
 	return (fmt.Sprintf("%v", a) == fmt.Sprintf("%v", b))
 }
+
+func TestBencodedLength(t *testing.T) {
+	for s, expected := range map[string]int{
+		"i42e":                    4,
+		"4:spam":                  6,
+		"le":                      2,
+		"d3:fooli1e2:abee5:trail": 16,
+	} {
+		if n, err := bencodedLength([]byte(s)); err != nil || n != expected {
+			t.Errorf("Expected length %d for %q, got %d, %v", expected, s, n, err)
+		}
+	}
+	for _, s := range []string{"", "i42", "5:spam", "l4:spam", "x"} {
+		if _, err := bencodedLength([]byte(s)); err == nil {
+			t.Errorf("Expected error for %q", s)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package btgo
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/mopsled/btgo/peer"
+)
+
+const (
+	defaultUnchokeSlots       = 4
+	defaultRechokeInterval    = 10 * time.Second
+	defaultOptimisticInterval = 30 * time.Second
+
+	// Peers connected for less than newPeerOptimisticRounds optimistic
+	// intervals are this many times as likely to get the optimistic unchoke,
+	// so that they get a chance to start trading.
+	newPeerOptimisticRounds = 3
+	newPeerOptimisticWeight = 3
+)
+
+// Chokable is the part of a peer connection the choker drives; *peer.PeerConn
+// implements it.
+type Chokable interface {
+	State() peer.State
+	DownloadRate() float64
+	UploadRate() float64
+	Choke() error
+	Unchoke() error
+}
+
+// Choker implements tit-for-tat. Every RechokeInterval it unchokes the Slots
+// interested peers we download fastest from, or when Seeding those we upload
+// fastest to, or with RoundRobin those that have waited longest, and chokes
+// the rest. On top of those one more interested peer is unchoked
+// optimistically, rotating every OptimisticInterval with a preference for
+// newly connected peers.
+type Choker struct {
+	Slots              int
+	RechokeInterval    time.Duration
+	OptimisticInterval time.Duration
+	Seeding            bool
+	RoundRobin         bool
+
+	now  func() time.Time
+	rand *rand.Rand
+
+	peers          map[string]*chokerPeer
+	optimistic     string
+	lastRechoke    time.Time
+	lastOptimistic time.Time
+}
+
+type chokerPeer struct {
+	conn         Chokable
+	added        time.Time
+	unchoked     bool
+	lastUnchoked time.Time // last rechoke that left the peer unchoked
+}
+
+func NewChoker() *Choker {
+	return &Choker{
+		Slots:              defaultUnchokeSlots,
+		RechokeInterval:    defaultRechokeInterval,
+		OptimisticInterval: defaultOptimisticInterval,
+		now:                time.Now,
+		rand:               rand.New(rand.NewSource(time.Now().UnixNano())),
+		peers:              make(map[string]*chokerPeer),
+	}
+}
+
+// AddPeer starts managing a peer, which is assumed to be choked.
+func (c *Choker) AddPeer(key string, conn Chokable) {
+	c.peers[key] = &chokerPeer{conn: conn, added: c.now()}
+}
+
+// RemovePeer stops managing a peer. If it was unchoked its slot is given to
+// another peer at the next Tick.
+func (c *Choker) RemovePeer(key string) {
+	p := c.peers[key]
+	if p == nil {
+		return
+	}
+	delete(c.peers, key)
+	if key == c.optimistic {
+		c.optimistic = ""
+	}
+	if p.unchoked {
+		c.lastRechoke = time.Time{}
+	}
+}
+
+// Unchoked lists the peers currently unchoked, in key order.
+func (c *Choker) Unchoked() (keys []string) {
+	for key, p := range c.peers {
+		if p.unchoked {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return
+}
+
+// Optimistic returns the key of the optimistically unchoked peer, if any.
+func (c *Choker) Optimistic() string {
+	return c.optimistic
+}
+
+// Tick rechokes if RechokeInterval has passed since the last rechoke, and
+// should be called at least that often.
+func (c *Choker) Tick() {
+	if c.now().Sub(c.lastRechoke) >= c.RechokeInterval {
+		c.Rechoke()
+	}
+}
+
+// Rechoke recomputes the unchoked set immediately.
+func (c *Choker) Rechoke() {
+	now := c.now()
+	c.lastRechoke = now
+
+	var interested []string
+	for key, p := range c.peers {
+		if p.conn.State().PeerInterested {
+			interested = append(interested, key)
+		}
+	}
+	sort.Strings(interested)
+	sort.SliceStable(interested, func(i, j int) bool {
+		a, b := c.peers[interested[i]], c.peers[interested[j]]
+		switch {
+		case c.Seeding && c.RoundRobin:
+			return a.lastUnchoked.Before(b.lastUnchoked)
+		case c.Seeding:
+			return a.conn.UploadRate() > b.conn.UploadRate()
+		}
+		return a.conn.DownloadRate() > b.conn.DownloadRate()
+	})
+
+	unchoke := make(map[string]bool)
+	for i, key := range interested {
+		if i < c.Slots {
+			unchoke[key] = true
+		}
+	}
+
+	current := c.peers[c.optimistic]
+	if current == nil || !current.conn.State().PeerInterested || unchoke[c.optimistic] || now.Sub(c.lastOptimistic) >= c.OptimisticInterval {
+		c.optimistic = c.pickOptimistic(interested[len(unchoke):], now)
+		c.lastOptimistic = now
+	}
+	if c.optimistic != "" {
+		unchoke[c.optimistic] = true
+	}
+
+	for key, p := range c.peers {
+		if unchoke[key] {
+			p.lastUnchoked = now
+		}
+		switch {
+		case unchoke[key] && !p.unchoked:
+			p.unchoked = true
+			p.conn.Unchoke()
+		case !unchoke[key] && p.unchoked:
+			p.unchoked = false
+			p.conn.Choke()
+		}
+	}
+}
+
+// pickOptimistic chooses among the candidates at random, weighting peers
+// that connected recently.
+func (c *Choker) pickOptimistic(candidates []string, now time.Time) string {
+	total := 0
+	weights := make([]int, len(candidates))
+	for i, key := range candidates {
+		weights[i] = 1
+		if now.Sub(c.peers[key].added) < newPeerOptimisticRounds*c.OptimisticInterval {
+			weights[i] = newPeerOptimisticWeight
+		}
+		total += weights[i]
+	}
+	if total == 0 {
+		return ""
+	}
+	n := c.rand.Intn(total)
+	for i, w := range weights {
+		if n < w {
+			return candidates[i]
+		}
+		n -= w
+	}
+	return ""
+}
@@ -0,0 +1,161 @@
+package btgo
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/mopsled/btgo/peer"
+)
+
+type fakeChokable struct {
+	state      peer.State
+	down, up   float64
+	unchokings int
+}
+
+func (f *fakeChokable) State() peer.State     { return f.state }
+func (f *fakeChokable) DownloadRate() float64 { return f.down }
+func (f *fakeChokable) UploadRate() float64   { return f.up }
+
+func (f *fakeChokable) Choke() error {
+	f.state.AmChoking = true
+	return nil
+}
+
+func (f *fakeChokable) Unchoke() error {
+	f.state.AmChoking = false
+	f.unchokings++
+	return nil
+}
+
+func newTestChoker(peers int) (c *Choker, conns []*fakeChokable, clock *time.Time) {
+	clock = new(time.Time)
+	*clock = time.Unix(1000, 0)
+	c = NewChoker()
+	c.now = func() time.Time { return *clock }
+	c.rand = rand.New(rand.NewSource(1))
+	for i := 0; i < peers; i++ {
+		conn := &fakeChokable{state: peer.State{AmChoking: true, PeerInterested: true}, down: float64(i), up: float64(peers - i)}
+		conns = append(conns, conn)
+		c.AddPeer(fmt.Sprintf("peer%d", i), conn)
+	}
+	return
+}
+
+func TestChokerUnchokesFastestDownloaders(t *testing.T) {
+	c, conns, clock := newTestChoker(8)
+	conns[7].state.PeerInterested = false
+	c.Tick()
+
+	unchoked := c.Unchoked()
+	if len(unchoked) != 5 {
+		t.Fatalf("Expected four regular and one optimistic unchoke, got %v", unchoked)
+	}
+	for _, key := range []string{"peer3", "peer4", "peer5", "peer6"} {
+		if conns[key[4]-'0'].state.AmChoking {
+			t.Errorf("Expected %s to be unchoked, got %v", key, unchoked)
+		}
+	}
+	optimistic := c.Optimistic()
+	if optimistic == "" || optimistic > "peer2" {
+		t.Errorf("Expected a slow interested peer as optimistic unchoke, got %q", optimistic)
+	}
+	if !conns[7].state.AmChoking {
+		t.Error("Expected uninterested peer to stay choked")
+	}
+
+	// Nothing changes before the rechoke interval.
+	conns[0].down = 100
+	*clock = clock.Add(c.RechokeInterval - time.Second)
+	c.Tick()
+	if !sameSlice(c.Unchoked(), unchoked) {
+		t.Errorf("Unexpected rechoke, got %v", c.Unchoked())
+	}
+	*clock = clock.Add(time.Second)
+	c.Tick()
+	if conns[0].state.AmChoking || !conns[3].state.AmChoking && c.Optimistic() != "peer3" {
+		t.Errorf("Expected peer0 to replace peer3, got %v", c.Unchoked())
+	}
+}
+
+func TestChokerRotatesOptimisticUnchoke(t *testing.T) {
+	c, _, clock := newTestChoker(10)
+	c.Tick()
+	seen := map[string]bool{c.Optimistic(): true}
+	kept := c.Optimistic()
+	for i := 0; i < 2; i++ {
+		*clock = clock.Add(c.RechokeInterval)
+		c.Tick()
+		if c.Optimistic() != kept {
+			t.Errorf("Expected optimistic unchoke to last %s", c.OptimisticInterval)
+		}
+	}
+	for i := 0; i < 30; i++ {
+		*clock = clock.Add(c.RechokeInterval)
+		c.Tick()
+		seen[c.Optimistic()] = true
+	}
+	if len(seen) < 4 {
+		t.Errorf("Expected optimistic unchoke to rotate, got %v", seen)
+	}
+
+	// New peers are preferred.
+	newcomers := 0
+	for i := 0; i < 60; i++ {
+		*clock = clock.Add(c.OptimisticInterval)
+		key := fmt.Sprintf("new%d", i)
+		c.AddPeer(key, &fakeChokable{state: peer.State{AmChoking: true, PeerInterested: true}})
+		c.Tick()
+		if c.Optimistic() == key {
+			newcomers++
+		}
+		c.RemovePeer(key)
+	}
+	// One new peer of weight 3 against six old ones of weight 1.
+	if newcomers < 15 {
+		t.Errorf("Expected new peers to be favoured, got %d of 60", newcomers)
+	}
+}
+
+func TestChokerSeeding(t *testing.T) {
+	c, conns, clock := newTestChoker(8)
+	c.Seeding = true
+	c.Tick()
+	for i := 0; i < 4; i++ {
+		if conns[i].state.AmChoking {
+			t.Errorf("Expected fastest uploader peer%d to be unchoked", i)
+		}
+	}
+
+	c.RoundRobin = true
+	counts := make([]int, len(conns))
+	for i := 0; i < 20; i++ {
+		*clock = clock.Add(c.RechokeInterval)
+		c.Tick()
+		for j, conn := range conns {
+			if !conn.state.AmChoking {
+				counts[j]++
+			}
+		}
+	}
+	for i, n := range counts {
+		if n < 8 {
+			t.Errorf("Expected round robin to reach peer%d regularly, got %v", i, counts)
+		}
+	}
+}
+
+func TestChokerRemovePeerFreesSlot(t *testing.T) {
+	c, conns, _ := newTestChoker(6)
+	c.Tick()
+	c.RemovePeer("peer5")
+	c.Tick()
+	if len(c.Unchoked()) != 5 {
+		t.Errorf("Expected the slot to be refilled, got %v", c.Unchoked())
+	}
+	if conns[5].unchokings != 1 {
+		t.Errorf("Expected removed peer to be left alone, got %d unchokes", conns[5].unchokings)
+	}
+}
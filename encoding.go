@@ -0,0 +1,95 @@
+package btgo
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// NamePolicy decides what happens to name and path bytes that are neither
+// valid UTF-8 nor decodable in the torrent's declared encoding.
+type NamePolicy int
+
+const (
+	ReplaceInvalidNames NamePolicy = iota // invalid bytes become U+FFFD
+	EscapeInvalidNames                    // invalid bytes become %XX
+	RejectInvalidNames                    // parsing fails
+)
+
+var legacyEncodings = map[string]encoding.Encoding{
+	"gbk":         simplifiedchinese.GBK,
+	"gb2312":      simplifiedchinese.GBK,
+	"cp936":       simplifiedchinese.GBK,
+	"gb18030":     simplifiedchinese.GB18030,
+	"shiftjis":    japanese.ShiftJIS,
+	"sjis":        japanese.ShiftJIS,
+	"cp932":       japanese.ShiftJIS,
+	"windows31j":  japanese.ShiftJIS,
+	"cp1251":      charmap.Windows1251,
+	"windows1251": charmap.Windows1251,
+}
+
+func lookupEncoding(name string) (enc encoding.Encoding, err error) {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", "_", "", " ", "").Replace(name))
+	if normalized == "" || normalized == "utf8" {
+		return
+	}
+	if enc = legacyEncodings[normalized]; enc != nil {
+		return
+	}
+	if enc, err = htmlindex.Get(name); err != nil {
+		err = fmt.Errorf("Unsupported torfile encoding %q", name)
+	}
+	return
+}
+
+// decodeName picks the best string for a name or path element: the UTF-8
+// variant if present, then the raw bytes if already UTF-8, then the raw bytes
+// transcoded from enc, and finally the policy's fallback.
+func decodeName(raw []byte, utf8Variant []byte, enc encoding.Encoding, policy NamePolicy) (name string, err error) {
+	if utf8Variant != nil && utf8.Valid(utf8Variant) {
+		name = string(utf8Variant)
+		return
+	}
+	if utf8.Valid(raw) {
+		name = string(raw)
+		return
+	}
+	if enc != nil {
+		if decoded, decodeErr := enc.NewDecoder().Bytes(raw); decodeErr == nil && utf8.Valid(decoded) && !strings.ContainsRune(string(decoded), utf8.RuneError) {
+			name = string(decoded)
+			return
+		}
+	}
+
+	switch policy {
+	case EscapeInvalidNames:
+		name = escapeInvalidUTF8(raw)
+	case RejectInvalidNames:
+		err = errors.New("Name is not valid UTF-8 in torfile")
+	default:
+		name = strings.ToValidUTF8(string(raw), string(utf8.RuneError))
+	}
+	return
+}
+
+func escapeInvalidUTF8(raw []byte) string {
+	var b strings.Builder
+	for len(raw) > 0 {
+		r, size := utf8.DecodeRune(raw)
+		if r == utf8.RuneError && size == 1 {
+			fmt.Fprintf(&b, "%%%02X", raw[0])
+		} else {
+			b.Write(raw[:size])
+		}
+		raw = raw[size:]
+	}
+	return b.String()
+}
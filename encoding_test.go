@@ -0,0 +1,79 @@
+package btgo
+
+import (
+	"testing"
+)
+
+func TestLegacyEncodings(t *testing.T) {
+	cases := []struct {
+		encoding string
+		raw      string
+		expected string
+	}{
+		{"GBK", "\xd6\xd0\xce\xc4", "中文"},
+		{"Shift_JIS", "\x93\xfa\x96\x7b", "日本"},
+		{"CP1251", "\xcf\xf0\xe8\xe2\xe5\xf2", "Привет"},
+		{"UTF-8", "plain", "plain"},
+		{"CP1251", "Привет", "Привет"}, // already UTF-8 despite the declared encoding
+	}
+	for _, c := range cases {
+		tfile, err := NewTorfile([]byte(encodedTorrent(c.encoding, c.raw, nil, genSlice(c.raw), nil)))
+		if err != nil {
+			t.Fatalf("Failed to parse %s torrent: %s", c.encoding, err)
+		}
+		if expected := c.expected + "/" + c.expected; tfile.files[0].path != expected {
+			t.Errorf("Wrong path for %s torrent: %q", c.encoding, tfile.files[0].path)
+		}
+	}
+
+	if _, err := NewTorfile([]byte(encodedTorrent("EBCDIC-42", "a", nil, genSlice("a"), nil))); err == nil {
+		t.Error("Expected unknown encoding to fail")
+	}
+}
+
+func TestUTF8Variants(t *testing.T) {
+	tfile, err := NewTorfile([]byte(encodedTorrent("GBK", "\xff\xff", "名字", genSlice("\xff", "b"), genSlice("目录", "b"))))
+	if err != nil {
+		t.Fatalf("Failed to parse torrent: %s", err)
+	}
+	if tfile.files[0].path != "名字/目录/b" {
+		t.Errorf("Expected UTF-8 variants to be preferred: %q", tfile.files[0].path)
+	}
+}
+
+func TestInvalidNamePolicies(t *testing.T) {
+	torrent := []byte(encodedTorrent("", "bad\xff", nil, genSlice("ok"), nil))
+
+	tfile, err := NewTorfileWithPolicy(torrent, ReplaceInvalidNames)
+	if err != nil || tfile.files[0].path != "bad�/ok" {
+		t.Errorf("Wrong replaced path: %v %v", tfile, err)
+	}
+	tfile, err = NewTorfileWithPolicy(torrent, EscapeInvalidNames)
+	if err != nil || tfile.files[0].path != "bad%FF/ok" {
+		t.Errorf("Wrong escaped path: %v %v", tfile, err)
+	}
+	if _, err = NewTorfileWithPolicy(torrent, RejectInvalidNames); err == nil {
+		t.Error("Expected invalid name to be rejected")
+	}
+}
+
+func encodedTorrent(encoding string, name string, utf8Name interface{}, path []interface{}, utf8Path []interface{}) string {
+	file := map[string]interface{}{"length": 1, "path": path}
+	if utf8Path != nil {
+		file["path.utf-8"] = utf8Path
+	}
+	info := map[string]interface{}{
+		"name":         name,
+		"piece length": 16384,
+		"pieces":       string(make([]byte, 20)),
+		"files":        genSlice(file),
+	}
+	if utf8Name != nil {
+		info["name.utf-8"] = utf8Name
+	}
+	m := map[string]interface{}{"announce": "http://example.com/announce", "info": info}
+	if encoding != "" {
+		m["encoding"] = encoding
+	}
+	return Bencode(m)
+}
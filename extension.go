@@ -0,0 +1,341 @@
+package btgo
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/mopsled/btgo/peer"
+)
+
+const (
+	clientVersion = "btgo 0001"
+	defaultReqq   = 250
+
+	extendedHandshakeID = 0
+	maxExtensions       = 255
+)
+
+var (
+	ErrExtensionExists      = errors.New("Extension already registered")
+	ErrExtensionUnsupported = errors.New("Peer does not support extension")
+)
+
+// ExtensionHandshake is the BEP 10 extended handshake. M maps the names of the
+// extensions a peer supports to the extended message IDs it wants them sent
+// with; in a later handshake an ID of zero turns an extension off again. The
+// other fields are left at their zero value when absent.
+type ExtensionHandshake struct {
+	M            map[string]int
+	V            string
+	P            int
+	Reqq         int
+	YourIP       net.IP
+	MetadataSize int64
+}
+
+// Bytes bencodes the handshake, leaving out unset fields.
+func (h *ExtensionHandshake) Bytes() []byte {
+	m := make(map[string]interface{}, len(h.M))
+	for name, id := range h.M {
+		m[name] = id
+	}
+	d := map[string]interface{}{"m": m}
+	if h.V != "" {
+		d["v"] = h.V
+	}
+	if h.P > 0 {
+		d["p"] = h.P
+	}
+	if h.Reqq > 0 {
+		d["reqq"] = h.Reqq
+	}
+	if ip4 := h.YourIP.To4(); ip4 != nil {
+		d["yourip"] = []byte(ip4)
+	} else if len(h.YourIP) == net.IPv6len {
+		d["yourip"] = []byte(h.YourIP)
+	}
+	if h.MetadataSize > 0 {
+		d["metadata_size"] = h.MetadataSize
+	}
+	return []byte(Bencode(d))
+}
+
+// ParseExtensionHandshake decodes an extended handshake. Unknown keys are
+// ignored, as BEP 10 asks.
+func ParseExtensionHandshake(b []byte) (h *ExtensionHandshake, err error) {
+	buncoded, err := tryBuncode(b)
+	if err != nil {
+		return
+	}
+	d, ok := buncoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Unable to parse extended handshake")
+	}
+
+	h = &ExtensionHandshake{M: make(map[string]int)}
+	if d["m"] != nil {
+		m, ok := d["m"].(map[string]interface{})
+		if !ok {
+			return nil, errors.New("Unable to parse m dictionary in extended handshake")
+		}
+		for name, e := range m {
+			id, err := int64FromInterface(e, "extended message ID")
+			if err != nil || id < 0 || id > maxExtensions {
+				return nil, fmt.Errorf("Invalid extended message ID for %s", name)
+			}
+			h.M[name] = int(id)
+		}
+	}
+	h.V, _ = stringFromBytesInterface(d["v"])
+	if p, err := int64FromInterface(d["p"], "port"); err == nil && p > 0 && p < 1<<16 {
+		h.P = int(p)
+	}
+	if reqq, err := int64FromInterface(d["reqq"], "reqq"); err == nil && reqq > 0 && reqq < 1<<31 {
+		h.Reqq = int(reqq)
+	}
+	if ip := bytesFromInterface(d["yourip"]); len(ip) == net.IPv4len || len(ip) == net.IPv6len {
+		h.YourIP = net.IP(ip)
+	}
+	if d["metadata_size"] != nil {
+		if h.MetadataSize, err = int64FromInterface(d["metadata_size"], "metadata size"); err != nil {
+			return nil, err
+		}
+		if h.MetadataSize < 0 {
+			return nil, errors.New("Negative metadata size in extended handshake")
+		}
+	}
+	return
+}
+
+// Extension is a BEP 10 extension plugged into an ExtensionRegistry. Its
+// methods are called from the torrent's running loop and must not block.
+type Extension interface {
+	// Name is the extension's key in the m dictionary, such as "ut_pex".
+	Name() string
+	// Connected is called once a peer's handshake says it supports the
+	// extension.
+	Connected(c *ExtensionConn)
+	// Handle is called with every message the peer sends for the extension,
+	// without the extended message ID. An error drops the peer.
+	Handle(c *ExtensionConn, payload []byte) error
+	// Disconnected is called when a connected peer goes away or turns the
+	// extension off.
+	Disconnected(c *ExtensionConn)
+}
+
+// ExtensionRegistry holds the extensions offered to peers, numbering them in
+// the order they were registered. Extensions registered after a connection
+// was set up are not offered on it.
+type ExtensionRegistry struct {
+	mu         sync.Mutex
+	extensions []Extension
+}
+
+func NewExtensionRegistry() *ExtensionRegistry {
+	return &ExtensionRegistry{}
+}
+
+func (r *ExtensionRegistry) Register(ext Extension) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.extensions {
+		if e.Name() == ext.Name() {
+			return ErrExtensionExists
+		}
+	}
+	if len(r.extensions) >= maxExtensions {
+		return errors.New("Too many extensions registered")
+	}
+	r.extensions = append(r.extensions, ext)
+	return nil
+}
+
+// Extension returns the extension registered under name, or nil.
+func (r *ExtensionRegistry) Extension(name string) Extension {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.extensions {
+		if e.Name() == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// NewConn sets up the extension protocol on a connection whose peer set
+// ReservedExtension in its handshake.
+func (r *ExtensionRegistry) NewConn(conn *peer.PeerConn) *ExtensionConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return &ExtensionConn{
+		conn:       conn,
+		extensions: append([]Extension(nil), r.extensions...),
+		connected:  make(map[string]bool),
+	}
+}
+
+// ExtensionConn is the extension protocol side of one peer connection: it
+// sends our handshake, keeps the peer's, and routes extended messages to the
+// extensions by ID.
+type ExtensionConn struct {
+	conn       *peer.PeerConn
+	extensions []Extension // our extended message ID is the index plus one
+
+	mu        sync.Mutex
+	remote    *ExtensionHandshake
+	connected map[string]bool
+	closed    bool
+}
+
+func (c *ExtensionConn) Conn() *peer.PeerConn {
+	return c.conn
+}
+
+// Remote returns the peer's handshake, or nil until it arrives. It must not
+// be modified.
+func (c *ExtensionConn) Remote() *ExtensionHandshake {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remote
+}
+
+// Supports reports whether the peer has announced the named extension.
+func (c *ExtensionConn) Supports(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remote != nil && c.remote.M[name] != 0
+}
+
+// SendHandshake sends h with the m dictionary filled in from the registry.
+func (c *ExtensionConn) SendHandshake(h ExtensionHandshake) error {
+	h.M = make(map[string]int, len(c.extensions))
+	for i, e := range c.extensions {
+		h.M[e.Name()] = i + 1
+	}
+	return c.conn.Send(&peer.Message{ID: peer.Extended, Payload: append([]byte{extendedHandshakeID}, h.Bytes()...)})
+}
+
+// Send sends an extension message to the peer under the ID it chose for name.
+func (c *ExtensionConn) Send(name string, payload []byte) error {
+	c.mu.Lock()
+	var id int
+	if c.remote != nil {
+		id = c.remote.M[name]
+	}
+	c.mu.Unlock()
+	if id == 0 {
+		return ErrExtensionUnsupported
+	}
+	return c.conn.Send(&peer.Message{ID: peer.Extended, Payload: append([]byte{byte(id)}, payload...)})
+}
+
+// Handle processes an extended message from the peer: handshakes update the
+// peer's extensions, anything else goes to the extension it is addressed to.
+func (c *ExtensionConn) Handle(m *peer.Message) error {
+	if len(m.Payload) == 0 {
+		return errors.New("Empty extended message")
+	}
+	id, payload := int(m.Payload[0]), m.Payload[1:]
+	if id == extendedHandshakeID {
+		h, err := ParseExtensionHandshake(payload)
+		if err != nil {
+			return err
+		}
+		c.updateRemote(h)
+		return nil
+	}
+
+	if id > len(c.extensions) {
+		return fmt.Errorf("Extended message %d was not offered", id)
+	}
+	ext := c.extensions[id-1]
+	c.mu.Lock()
+	connected := c.connected[ext.Name()]
+	c.mu.Unlock()
+	if !connected {
+		return fmt.Errorf("Message for %s before the peer announced it", ext.Name())
+	}
+	return ext.Handle(c, payload)
+}
+
+// updateRemote merges a handshake from the peer into what we know of it, and
+// tells the extensions it turned on or off.
+func (c *ExtensionConn) updateRemote(h *ExtensionHandshake) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	if c.remote == nil {
+		c.remote = &ExtensionHandshake{M: make(map[string]int)}
+	}
+	remote := *c.remote
+	remote.M = make(map[string]int, len(c.remote.M)+len(h.M))
+	for name, id := range c.remote.M {
+		remote.M[name] = id
+	}
+	for name, id := range h.M {
+		if id == 0 {
+			delete(remote.M, name)
+		} else {
+			remote.M[name] = id
+		}
+	}
+	if h.V != "" {
+		remote.V = h.V
+	}
+	if h.P != 0 {
+		remote.P = h.P
+	}
+	if h.Reqq != 0 {
+		remote.Reqq = h.Reqq
+	}
+	if h.YourIP != nil {
+		remote.YourIP = h.YourIP
+	}
+	if h.MetadataSize != 0 {
+		remote.MetadataSize = h.MetadataSize
+	}
+	c.remote = &remote
+
+	var connected, disconnected []Extension
+	for _, e := range c.extensions {
+		supported := remote.M[e.Name()] != 0
+		if supported != c.connected[e.Name()] {
+			c.connected[e.Name()] = supported
+			if supported {
+				connected = append(connected, e)
+			} else {
+				disconnected = append(disconnected, e)
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	for _, e := range disconnected {
+		e.Disconnected(c)
+	}
+	for _, e := range connected {
+		e.Connected(c)
+	}
+}
+
+// Close tells every connected extension that the peer has gone.
+func (c *ExtensionConn) Close() {
+	c.mu.Lock()
+	c.closed = true
+	var connected []Extension
+	for _, e := range c.extensions {
+		if c.connected[e.Name()] {
+			connected = append(connected, e)
+		}
+	}
+	c.connected = make(map[string]bool)
+	c.mu.Unlock()
+
+	for _, e := range connected {
+		e.Disconnected(c)
+	}
+}
@@ -0,0 +1,132 @@
+package btgo
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mopsled/btgo/peer"
+)
+
+func TestExtensionHandshakeRoundTrip(t *testing.T) {
+	h := &ExtensionHandshake{
+		M:            map[string]int{"ut_metadata": 2, "ut_pex": 1},
+		V:            "btgo 0001",
+		P:            6881,
+		Reqq:         250,
+		YourIP:       net.IPv4(10, 0, 0, 1),
+		MetadataSize: 31235,
+	}
+	parsed, err := ParseExtensionHandshake(h.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.M) != 2 || parsed.M["ut_metadata"] != 2 || parsed.M["ut_pex"] != 1 {
+		t.Errorf("Unexpected m dictionary %v", parsed.M)
+	}
+	if parsed.V != h.V || parsed.P != h.P || parsed.Reqq != h.Reqq || parsed.MetadataSize != h.MetadataSize {
+		t.Errorf("Unexpected handshake %+v", parsed)
+	}
+	if !parsed.YourIP.Equal(h.YourIP) || len(parsed.YourIP) != net.IPv4len {
+		t.Errorf("Unexpected yourip %v", parsed.YourIP)
+	}
+
+	for _, bad := range []string{"le", "d1:mi1ee", "d1:md6:ut_pexi256eee", "d13:metadata_sizei-1ee"} {
+		if _, err := ParseExtensionHandshake([]byte(bad)); err == nil {
+			t.Errorf("Expected error parsing %q", bad)
+		}
+	}
+	if h, err := ParseExtensionHandshake([]byte("d1:pi99999e6:yourip2:xx3:fooi1ee")); err != nil || h.P != 0 || h.YourIP != nil {
+		t.Errorf("Expected invalid optional fields to be ignored, got %+v, %v", h, err)
+	}
+}
+
+type recordingExtension struct {
+	name      string
+	connected int
+	gone      int
+	payloads  []string
+}
+
+func (e *recordingExtension) Name() string                  { return e.name }
+func (e *recordingExtension) Connected(c *ExtensionConn)    { e.connected++ }
+func (e *recordingExtension) Disconnected(c *ExtensionConn) { e.gone++ }
+func (e *recordingExtension) Handle(c *ExtensionConn, payload []byte) error {
+	e.payloads = append(e.payloads, string(payload))
+	return nil
+}
+
+func receiveExtended(t *testing.T, c *peer.PeerConn) *peer.Message {
+	select {
+	case m := <-c.Messages():
+		if m == nil || m.ID != peer.Extended {
+			t.Fatalf("Expected extended message, got %v", m)
+		}
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for extended message")
+	}
+	return nil
+}
+
+func TestExtensionRegistryRouting(t *testing.T) {
+	left, right := net.Pipe()
+	a, b := peer.NewPeerConn(left, 4), peer.NewPeerConn(right, 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a.Start(ctx)
+	b.Start(ctx)
+
+	pex, private := &recordingExtension{name: "ut_pex"}, &recordingExtension{name: "x_private"}
+	ra, rb := NewExtensionRegistry(), NewExtensionRegistry()
+	ra.Register(pex)
+	ra.Register(private)
+	if err := ra.Register(&recordingExtension{name: "ut_pex"}); err != ErrExtensionExists {
+		t.Errorf("Expected ErrExtensionExists, got %v", err)
+	}
+	rb.Register(&recordingExtension{name: "ut_pex"})
+	ea, eb := ra.NewConn(a), rb.NewConn(b)
+
+	if err := eb.Send("ut_pex", []byte("early")); err != ErrExtensionUnsupported {
+		t.Errorf("Expected ErrExtensionUnsupported before the handshake, got %v", err)
+	}
+	ea.SendHandshake(ExtensionHandshake{V: "a", MetadataSize: 100})
+	if err := eb.Handle(receiveExtended(t, b)); err != nil {
+		t.Fatal(err)
+	}
+	if remote := eb.Remote(); remote.V != "a" || remote.MetadataSize != 100 || remote.M["x_private"] != 2 {
+		t.Errorf("Unexpected remote handshake %+v", remote)
+	}
+
+	eb.SendHandshake(ExtensionHandshake{V: "b"})
+	if err := ea.Handle(receiveExtended(t, a)); err != nil {
+		t.Fatal(err)
+	}
+	if pex.connected != 1 || private.connected != 0 || !ea.Supports("ut_pex") || ea.Supports("x_private") {
+		t.Errorf("Expected only ut_pex to connect, got %d and %d", pex.connected, private.connected)
+	}
+
+	eb.Send("ut_pex", []byte("added"))
+	eb.Send("x_private", []byte("hello"))
+	if err := ea.Handle(receiveExtended(t, a)); err != nil || len(pex.payloads) != 1 || pex.payloads[0] != "added" {
+		t.Errorf("Expected payload routed to ut_pex, got %v, %v", pex.payloads, err)
+	}
+	if err := ea.Handle(receiveExtended(t, a)); err == nil {
+		t.Error("Expected error for an extension the peer never announced")
+	}
+	if err := ea.Handle(&peer.Message{ID: peer.Extended, Payload: []byte{9}}); err == nil {
+		t.Error("Expected error for an extended ID we never offered")
+	}
+
+	// A later handshake with ID zero turns the extension off.
+	ea.Handle(&peer.Message{ID: peer.Extended, Payload: append([]byte{0}, "d1:md6:ut_pexi0eee"...)})
+	if pex.gone != 1 || ea.Supports("ut_pex") || ea.Remote().V != "b" {
+		t.Errorf("Expected ut_pex to be turned off, got %+v", ea.Remote())
+	}
+	ea.Handle(&peer.Message{ID: peer.Extended, Payload: append([]byte{0}, "d1:md6:ut_pexi3eee"...)})
+	ea.Close()
+	if pex.connected != 2 || pex.gone != 2 {
+		t.Errorf("Expected reconnect and close to reach ut_pex, got %d and %d", pex.connected, pex.gone)
+	}
+}
@@ -0,0 +1,136 @@
+package btgo
+
+import (
+	"fmt"
+	"net/url"
+	"unicode/utf8"
+)
+
+type LintSeverity int
+
+const (
+	LintInfo LintSeverity = iota
+	LintWarning
+	LintError
+)
+
+func (s LintSeverity) String() string {
+	switch s {
+	case LintInfo:
+		return "info"
+	case LintWarning:
+		return "warning"
+	case LintError:
+		return "error"
+	}
+	return fmt.Sprintf("LintSeverity(%d)", int(s))
+}
+
+const (
+	LintPieceCountMismatch = "piece-count-mismatch"
+	LintPiecesLength       = "pieces-length"
+	LintPieceLengthInvalid = "piece-length-invalid"
+	LintPieceLengthNotPow2 = "piece-length-not-power-of-two"
+	LintDuplicatePath      = "duplicate-path"
+	LintEmptyFile          = "empty-file"
+	LintMissingAnnounce    = "missing-announce"
+	LintInvalidTrackerURL  = "invalid-tracker-url"
+	LintNonUTF8Name        = "non-utf8-name"
+)
+
+type LintFinding struct {
+	Severity LintSeverity
+	Code     string
+	Message  string
+}
+
+func (f LintFinding) String() string {
+	return fmt.Sprintf("%s: %s: %s", f.Severity, f.Code, f.Message)
+}
+
+func Lint(tfile Torfile) (findings []LintFinding) {
+	report := func(severity LintSeverity, code string, format string, args ...interface{}) {
+		findings = append(findings, LintFinding{severity, code, fmt.Sprintf(format, args...)})
+	}
+
+	if pieceBytes, ok := tfile.info["pieces"].([]byte); ok && len(pieceBytes)%20 != 0 {
+		report(LintError, LintPiecesLength, "pieces is %d bytes, not a multiple of 20; %d trailing bytes are ignored", len(pieceBytes), len(pieceBytes)%20)
+	}
+
+	pieceLength := tfile.pieceLength
+	if pieceLength <= 0 {
+		report(LintError, LintPieceLengthInvalid, "piece length %d is not positive", pieceLength)
+	} else {
+		if pieceLength&(pieceLength-1) != 0 {
+			report(LintWarning, LintPieceLengthNotPow2, "piece length %d is not a power of two", pieceLength)
+		}
+
+		total, ok := tfile.totalLength()
+		if !ok {
+			report(LintError, LintPieceCountMismatch, "total length of files overflows int64")
+		} else if expected := (total + pieceLength - 1) / pieceLength; tfile.rootHash == nil && expected != int64(len(tfile.pieces)) {
+			report(LintError, LintPieceCountMismatch, "%d pieces of %d bytes cannot hold %d bytes of files (expected %d pieces)", len(tfile.pieces), pieceLength, total, expected)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, f := range tfile.files {
+		if seen[f.path] {
+			report(LintError, LintDuplicatePath, "duplicate file path %q", f.path)
+		}
+		seen[f.path] = true
+
+		if f.length == 0 {
+			report(LintInfo, LintEmptyFile, "file %q is empty", f.path)
+		}
+	}
+
+	trackers := 0
+	for _, tier := range tfile.announceList {
+		for _, announce := range tier {
+			trackers++
+			if !validTrackerURL(announce) {
+				report(LintWarning, LintInvalidTrackerURL, "invalid tracker URL %q", announce)
+			}
+		}
+	}
+	if trackers == 0 {
+		report(LintWarning, LintMissingAnnounce, "torrent has no announce URL")
+	}
+
+	lintNames(tfile.info, report)
+	return
+}
+
+func lintNames(info map[string]interface{}, report func(LintSeverity, string, string, ...interface{})) {
+	if name, ok := info["name"].([]byte); ok && !utf8.Valid(name) && info["name.utf-8"] == nil {
+		report(LintWarning, LintNonUTF8Name, "name %q is not valid UTF-8 and has no name.utf-8", name)
+	}
+
+	filesInterfaceList, _ := info["files"].([]interface{})
+	for _, e := range filesInterfaceList {
+		fileInfo, ok := e.(map[string]interface{})
+		if !ok || fileInfo["path.utf-8"] != nil {
+			continue
+		}
+		pathInterfaces, _ := fileInfo["path"].([]interface{})
+		for _, el := range pathInterfaces {
+			if pathPiece, ok := el.([]byte); ok && !utf8.Valid(pathPiece) {
+				report(LintWarning, LintNonUTF8Name, "path %q is not valid UTF-8 and has no path.utf-8", pathPiece)
+				break
+			}
+		}
+	}
+}
+
+func validTrackerURL(announce string) bool {
+	u, err := url.Parse(announce)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	switch u.Scheme {
+	case "http", "https", "udp":
+		return true
+	}
+	return false
+}
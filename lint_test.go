@@ -0,0 +1,72 @@
+package btgo
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	for _, file := range []string{"test/ubuntu.torrent", "test/backtrack.torrent", "test/multitracks.torrent", "test/stack-exchange.torrent"} {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Failed to open test file %s", file)
+		}
+		tfile, err := NewTorfile(content)
+		if err != nil {
+			t.Fatalf("Failed to parse test file %s: %s", file, err)
+		}
+		for _, f := range Lint(*tfile) {
+			if f.Severity == LintError {
+				t.Errorf("Unexpected lint error for %s: %s", file, f)
+			}
+		}
+	}
+
+	info := map[string]interface{}{
+		"name":         "bad\xff",
+		"piece length": 100000,
+		"pieces":       string(make([]byte, 125)),
+		"files": genSlice(
+			map[string]interface{}{"length": 10, "path": genSlice("a")},
+			map[string]interface{}{"length": 0, "path": genSlice("a")},
+			map[string]interface{}{"length": 500000, "path": genSlice("c\xfe")},
+		),
+	}
+	tfile, err := NewTorfile([]byte(Bencode(map[string]interface{}{"info": info})))
+	if err != nil {
+		t.Fatalf("Failed to parse linted torrent: %s", err)
+	}
+	// NewTorfile rejects a wrong piece count, but a Torfile built otherwise
+	// may still have one.
+	tfile.pieces = tfile.pieces[:2]
+	codes := lintCodes(Lint(*tfile))
+	for _, code := range []string{LintPiecesLength, LintPieceLengthNotPow2, LintPieceCountMismatch, LintDuplicatePath, LintEmptyFile, LintMissingAnnounce, LintNonUTF8Name} {
+		if codes[code] == 0 {
+			t.Errorf("Expected lint finding %s, got %v", code, codes)
+		}
+	}
+	if codes[LintNonUTF8Name] != 2 {
+		t.Errorf("Expected two non-UTF-8 findings, got %d", codes[LintNonUTF8Name])
+	}
+
+	info["name.utf-8"] = "good"
+	tfile, err = NewTorfile([]byte(Bencode(map[string]interface{}{"announce": "ftp://example.com", "info": info})))
+	if err != nil {
+		t.Fatalf("Failed to parse linted torrent: %s", err)
+	}
+	codes = lintCodes(Lint(*tfile))
+	if codes[LintInvalidTrackerURL] != 1 || codes[LintMissingAnnounce] != 0 {
+		t.Errorf("Wrong tracker findings: %v", codes)
+	}
+	if codes[LintNonUTF8Name] != 1 {
+		t.Errorf("Expected name.utf-8 to silence name finding, got %v", codes)
+	}
+}
+
+func lintCodes(findings []LintFinding) map[string]int {
+	codes := make(map[string]int)
+	for _, f := range findings {
+		codes[f.Code]++
+	}
+	return codes
+}
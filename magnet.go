@@ -0,0 +1,92 @@
+package btgo
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Magnet is what a magnet link says about a torrent: its infohash, and
+// optionally a name, trackers and peers to get the metadata from.
+type Magnet struct {
+	InfoHash []byte
+	Name     string
+	Trackers []string
+	Peers    []PeerAddr
+}
+
+// ParseMagnet reads a magnet URI with a BitTorrent infohash in its xt
+// parameter, in hex or base32.
+func ParseMagnet(uri string) (m *Magnet, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return
+	}
+	if u.Scheme != "magnet" {
+		return nil, errors.New("Not a magnet link")
+	}
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return
+	}
+
+	m = &Magnet{Name: q.Get("dn"), Trackers: q["tr"]}
+	for _, xt := range q["xt"] {
+		if !strings.HasPrefix(xt, "urn:btih:") {
+			continue
+		}
+		hash := xt[len("urn:btih:"):]
+		switch len(hash) {
+		case 40:
+			m.InfoHash, err = hex.DecodeString(hash)
+		case 32:
+			m.InfoHash, err = base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+		default:
+			err = errors.New("Invalid infohash length in magnet link")
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	if m.InfoHash == nil {
+		return nil, errors.New("Magnet link has no BitTorrent infohash")
+	}
+
+	for _, pe := range q["x.pe"] {
+		host, port, err := net.SplitHostPort(pe)
+		if err != nil {
+			continue
+		}
+		p, err := strconv.Atoi(port)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil || p <= 0 || p >= 1<<16 {
+			continue
+		}
+		m.Peers = append(m.Peers, PeerAddr{IP: ip, Port: p})
+	}
+	return
+}
+
+// String renders the magnet link with a hex infohash.
+func (m *Magnet) String() string {
+	q := url.Values{}
+	if m.Name != "" {
+		q.Set("dn", m.Name)
+	}
+	for _, tr := range m.Trackers {
+		q.Add("tr", tr)
+	}
+	for _, p := range m.Peers {
+		q.Add("x.pe", p.String())
+	}
+	s := "magnet:?xt=urn:btih:" + hex.EncodeToString(m.InfoHash)
+	if len(q) > 0 {
+		s += "&" + q.Encode()
+	}
+	return s
+}
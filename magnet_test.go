@@ -0,0 +1,46 @@
+package btgo
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseMagnet(t *testing.T) {
+	hash, _ := hex.DecodeString("c12fe1c06bba254a9dc9f519b335aa7c1367a88a")
+	m, err := ParseMagnet("magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&dn=Some+Name" +
+		"&tr=http%3A%2F%2Ftracker.example%2Fannounce&tr=udp%3A%2F%2Ftracker.example%3A80&x.pe=10.0.0.1%3A6881&x.pe=bogus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m.InfoHash, hash) || m.Name != "Some Name" {
+		t.Errorf("Unexpected magnet %+v", m)
+	}
+	if len(m.Trackers) != 2 || m.Trackers[1] != "udp://tracker.example:80" {
+		t.Errorf("Unexpected trackers %v", m.Trackers)
+	}
+	if len(m.Peers) != 1 || m.Peers[0].String() != "10.0.0.1:6881" {
+		t.Errorf("Unexpected peers %v", m.Peers)
+	}
+
+	again, err := ParseMagnet(m.String())
+	if err != nil || !bytes.Equal(again.InfoHash, hash) || again.Name != m.Name || len(again.Trackers) != 2 || len(again.Peers) != 1 {
+		t.Errorf("Unexpected round trip of %s: %+v, %v", m, again, err)
+	}
+
+	base32, err := ParseMagnet("magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK")
+	if err != nil || !bytes.Equal(base32.InfoHash, hash) {
+		t.Errorf("Unexpected base32 infohash %x, %v", base32.InfoHash, err)
+	}
+
+	for _, bad := range []string{
+		"http://example.com/?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a",
+		"magnet:?dn=nohash",
+		"magnet:?xt=urn:btih:c12fe1",
+		"magnet:?xt=urn:btih:zz2fe1c06bba254a9dc9f519b335aa7c1367a88a",
+	} {
+		if _, err := ParseMagnet(bad); err == nil {
+			t.Errorf("Expected error for %s", bad)
+		}
+	}
+}
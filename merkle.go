@@ -0,0 +1,160 @@
+package btgo
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// MerkleHash is one node of a BEP 30 hash chain. Index numbers the tree in
+// heap order: the root is 0 and the children of node i are 2i+1 and 2i+2.
+type MerkleHash struct {
+	Index int
+	Hash  []byte
+}
+
+func (t *Torfile) IsMerkle() bool {
+	return t.rootHash != nil
+}
+
+func (t *Torfile) RootHash() []byte {
+	return t.rootHash
+}
+
+// VerifyMerklePiece checks the data of a piece against the torrent's root hash
+// using the uncle hashes supplied by a peer alongside the piece.
+func (t *Torfile) VerifyMerklePiece(piece int, data []byte, chain []MerkleHash) (err error) {
+	if t.rootHash == nil {
+		err = errors.New("Torfile is not a merkle torrent")
+		return
+	}
+	if piece < 0 || piece >= t.numPieces() {
+		err = fmt.Errorf("Piece %d out of range", piece)
+		return
+	}
+
+	hashes := make(map[int][]byte, len(chain))
+	for _, h := range chain {
+		if len(h.Hash) != sha1.Size {
+			err = fmt.Errorf("Hash for merkle node %d is %d bytes", h.Index, len(h.Hash))
+			return
+		}
+		hashes[h.Index] = h.Hash
+	}
+
+	leaf := sha1.Sum(data)
+	node, hash := merkleLeaves(t.numPieces())-1+piece, leaf[:]
+	for node > 0 {
+		sibling := node + 1
+		if node%2 == 0 {
+			sibling = node - 1
+		}
+		siblingHash, ok := hashes[sibling]
+		if !ok {
+			err = fmt.Errorf("Hash chain for piece %d is missing node %d", piece, sibling)
+			return
+		}
+		if node%2 == 0 {
+			hash = merkleParent(siblingHash, hash)
+		} else {
+			hash = merkleParent(hash, siblingHash)
+		}
+		node = (node - 1) / 2
+	}
+
+	if !bytes.Equal(hash, t.rootHash) {
+		err = fmt.Errorf("Piece %d does not match root hash", piece)
+	}
+	return
+}
+
+// ParseMerkleHashChain decodes the bencoded list of [index, hash] pairs that
+// accompanies the first block of a piece in a merkle torrent.
+func ParseMerkleHashChain(encoded []byte) (chain []MerkleHash, err error) {
+	buncoded, err := tryBuncode(encoded)
+	if err != nil {
+		return
+	}
+	list, ok := buncoded.([]interface{})
+	if !ok {
+		err = errors.New("Unable to parse merkle hash chain")
+		return
+	}
+	// A single pair decodes without the outer list.
+	if len(list) == 2 {
+		if _, ok := list[0].(*big.Int); ok {
+			list = []interface{}{list}
+		}
+	}
+
+	chain = make([]MerkleHash, len(list))
+	for i, e := range list {
+		pair, ok := e.([]interface{})
+		if !ok || len(pair) != 2 {
+			err = errors.New("Unable to parse merkle hash chain entry")
+			return
+		}
+		index, ok := pair[0].(*big.Int)
+		if !ok || !index.IsInt64() || index.Sign() < 0 {
+			err = errors.New("Unable to parse merkle node index")
+			return
+		}
+		hash, ok := pair[1].([]byte)
+		if !ok {
+			err = errors.New("Unable to parse merkle node hash")
+			return
+		}
+		chain[i] = MerkleHash{int(index.Int64()), hash}
+	}
+	return
+}
+
+func merkleLeaves(pieces int) int {
+	leaves := 1
+	for leaves < pieces {
+		leaves *= 2
+	}
+	return leaves
+}
+
+func merkleParent(left, right []byte) []byte {
+	h := sha1.New()
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleTree builds the full tree in heap order from piece hashes, padding
+// the leaves with zero hashes up to a power of two.
+func merkleTree(pieceHashes [][]byte) [][]byte {
+	leaves := merkleLeaves(len(pieceHashes))
+	tree := make([][]byte, 2*leaves-1)
+	for i := range tree[leaves-1:] {
+		if i < len(pieceHashes) {
+			tree[leaves-1+i] = pieceHashes[i]
+		} else {
+			tree[leaves-1+i] = make([]byte, sha1.Size)
+		}
+	}
+	for i := leaves - 2; i >= 0; i-- {
+		tree[i] = merkleParent(tree[2*i+1], tree[2*i+2])
+	}
+	return tree
+}
+
+// merkleChain returns the uncle hashes a peer needs to verify piece against
+// the root of tree.
+func merkleChain(tree [][]byte, piece int) (chain []MerkleHash) {
+	node := len(tree)/2 + piece
+	for node > 0 {
+		sibling := node + 1
+		if node%2 == 0 {
+			sibling = node - 1
+		}
+		chain = append(chain, MerkleHash{sibling, tree[sibling]})
+		node = (node - 1) / 2
+	}
+	return
+}
@@ -0,0 +1,71 @@
+package btgo
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"testing"
+)
+
+func TestMerkleTorfile(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	pieceLength := 8
+	var pieceHashes [][]byte
+	for begin := 0; begin < len(data); begin += pieceLength {
+		end := begin + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		h := sha1.Sum(data[begin:end])
+		pieceHashes = append(pieceHashes, h[:])
+	}
+	tree := merkleTree(pieceHashes)
+
+	info := map[string]interface{}{"name": "fox.txt", "length": len(data), "piece length": pieceLength, "root hash": tree[0]}
+	tfile, err := NewTorfile([]byte(Bencode(map[string]interface{}{"announce": "http://example.com/announce", "info": info})))
+	if err != nil {
+		t.Fatalf("Failed to parse merkle torrent: %s", err)
+	}
+	if !tfile.IsMerkle() || !bytes.Equal(tfile.RootHash(), tree[0]) {
+		t.Fatalf("Wrong root hash: %x", tfile.RootHash())
+	}
+	if tfile.numPieces() != 6 {
+		t.Errorf("Wrong number of pieces: %d", tfile.numPieces())
+	}
+	for _, f := range Lint(*tfile) {
+		if f.Severity == LintError {
+			t.Errorf("Unexpected lint error: %s", f)
+		}
+	}
+
+	for piece := range pieceHashes {
+		begin, end := piece*pieceLength, (piece+1)*pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		chain := merkleChain(tree, piece)
+		if err := tfile.VerifyMerklePiece(piece, data[begin:end], chain); err != nil {
+			t.Errorf("Failed to verify piece %d: %s", piece, err)
+		}
+		if err := tfile.VerifyMerklePiece(piece, []byte("corrupt!"), chain); err == nil {
+			t.Errorf("Corrupt piece %d verified", piece)
+		}
+		if err := tfile.VerifyMerklePiece(piece, data[begin:end], chain[1:]); err == nil {
+			t.Errorf("Piece %d verified with incomplete chain", piece)
+		}
+	}
+}
+
+func TestParseMerkleHashChain(t *testing.T) {
+	a, b := bytes.Repeat([]byte{1}, 20), bytes.Repeat([]byte{2}, 20)
+	chain, err := ParseMerkleHashChain([]byte(Bencode(genSlice(genSlice(4, a), genSlice(2, b)))))
+	if err != nil || len(chain) != 2 || chain[0].Index != 4 || !bytes.Equal(chain[1].Hash, b) {
+		t.Errorf("Wrong hash chain: %v %v", chain, err)
+	}
+	chain, err = ParseMerkleHashChain([]byte(Bencode(genSlice(genSlice(1, a)))))
+	if err != nil || len(chain) != 1 || chain[0].Index != 1 || !bytes.Equal(chain[0].Hash, a) {
+		t.Errorf("Wrong single-entry hash chain: %v %v", chain, err)
+	}
+	if _, err = ParseMerkleHashChain([]byte("l?")); err == nil {
+		t.Error("Expected malformed hash chain to fail")
+	}
+}
@@ -0,0 +1,398 @@
+package btgo
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	MetadataPieceSize = 16 * 1024
+
+	maxMetadataSize        = 16 << 20
+	maxMetadataRequests    = 4
+	metadataRequestTimeout = 30 * time.Second
+)
+
+const (
+	metadataRequest = iota
+	metadataData
+	metadataReject
+)
+
+// NewTorfileFromInfo builds a torfile around an info dictionary fetched by
+// infohash, such as for a magnet link, announcing to the given tiers.
+func NewTorfileFromInfo(info []byte, announceList [][]string) (tfile *Torfile, err error) {
+	buncoded, err := tryBuncode(info)
+	if err != nil {
+		return
+	}
+	if _, ok := buncoded.(map[string]interface{}); !ok {
+		return nil, errors.New("Unable to parse info dictionary")
+	}
+	metainfo := map[string]interface{}{"info": buncoded}
+	if len(announceList) > 0 {
+		metainfo["announce-list"] = announceList
+	}
+	if tfile, err = NewTorfile([]byte(Bencode(metainfo))); err != nil {
+		return
+	}
+	if sum := sha1.Sum(info); !bytes.Equal(sum[:], tfile.infoHash) {
+		return nil, errors.New("Info dictionary is not canonically bencoded")
+	}
+	return
+}
+
+// metadataMessage is a BEP 9 ut_metadata message. Data follows the bencoded
+// dictionary of data messages.
+type metadataMessage struct {
+	msgType   int
+	piece     int
+	totalSize int
+	data      []byte
+}
+
+func (m *metadataMessage) bytes() []byte {
+	d := map[string]interface{}{"msg_type": m.msgType, "piece": m.piece}
+	if m.msgType == metadataData {
+		d["total_size"] = m.totalSize
+	}
+	return append([]byte(Bencode(d)), m.data...)
+}
+
+func parseMetadataMessage(b []byte) (m *metadataMessage, err error) {
+	n, err := bencodedLength(b)
+	if err != nil {
+		return
+	}
+	buncoded, err := tryBuncode(b[:n])
+	if err != nil {
+		return
+	}
+	d, ok := buncoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Unable to parse ut_metadata message")
+	}
+
+	m = &metadataMessage{data: b[n:]}
+	msgType, err := int64FromInterface(d["msg_type"], "ut_metadata message type")
+	if err != nil {
+		return nil, err
+	}
+	piece, err := int64FromInterface(d["piece"], "ut_metadata piece")
+	if err != nil {
+		return nil, err
+	}
+	if piece < 0 || piece >= maxMetadataSize/MetadataPieceSize {
+		return nil, fmt.Errorf("Metadata piece %d out of range", piece)
+	}
+	m.msgType, m.piece = int(msgType), int(piece)
+	if m.msgType == metadataData {
+		totalSize, err := int64FromInterface(d["total_size"], "ut_metadata total size")
+		if err != nil {
+			return nil, err
+		}
+		if totalSize <= 0 || totalSize > maxMetadataSize {
+			return nil, fmt.Errorf("Metadata size %d out of range", totalSize)
+		}
+		m.totalSize = int(totalSize)
+	}
+	return
+}
+
+type metadataPieceRequest struct {
+	c  *ExtensionConn
+	at time.Time
+}
+
+// MetadataExtension implements BEP 9 ut_metadata. With the info dictionary it
+// serves it to peers in MetadataPieceSize pieces; without, it downloads the
+// pieces from peers that announce a metadata size, checks the whole against
+// the infohash and closes Done. Peers announcing another size than the one
+// being fetched are kept to fall back on. Once a check has failed, each
+// attempt fetches from a single peer so a lying one can be told apart and
+// dropped.
+type MetadataExtension struct {
+	infoHash []byte
+	now      func() time.Time
+
+	mu        sync.Mutex
+	info      []byte
+	size      int
+	pieces    [][]byte
+	from      []*ExtensionConn // the peer each piece came from
+	requested map[int]metadataPieceRequest
+	sources   []*ExtensionConn // peers pieces are fetched from
+	peers     []*ExtensionConn // every peer offering metadata, in order
+	sizes     map[*ExtensionConn]int
+	banned    map[*ExtensionConn]bool
+	solo      bool
+	done      chan struct{}
+}
+
+// NewMetadataExtension serves info, or fetches it when info is nil.
+func NewMetadataExtension(infoHash []byte, info []byte) *MetadataExtension {
+	e := &MetadataExtension{
+		infoHash:  infoHash,
+		now:       time.Now,
+		info:      info,
+		requested: make(map[int]metadataPieceRequest),
+		sizes:     make(map[*ExtensionConn]int),
+		banned:    make(map[*ExtensionConn]bool),
+		done:      make(chan struct{}),
+	}
+	if info != nil {
+		close(e.done)
+	}
+	return e
+}
+
+func (e *MetadataExtension) Name() string {
+	return "ut_metadata"
+}
+
+// Done is closed once the extension has verified metadata.
+func (e *MetadataExtension) Done() <-chan struct{} {
+	return e.done
+}
+
+// Metadata returns the bencoded info dictionary, or nil until it is known.
+func (e *MetadataExtension) Metadata() []byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.info
+}
+
+func (e *MetadataExtension) Connected(c *ExtensionConn) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.info != nil || e.banned[c] {
+		return
+	}
+	size := c.Remote().MetadataSize
+	if size <= 0 || size > maxMetadataSize {
+		return
+	}
+	e.peers = append(e.peers, c)
+	e.sizes[c] = int(size)
+	if e.pieces == nil {
+		e.restart()
+	} else if int(size) == e.size && !e.solo {
+		e.sources = append(e.sources, c)
+		e.requestFrom(c)
+	}
+}
+
+func (e *MetadataExtension) Disconnected(c *ExtensionConn) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.dropSource(c)
+}
+
+func (e *MetadataExtension) Handle(c *ExtensionConn, payload []byte) error {
+	m, err := parseMetadataMessage(payload)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch m.msgType {
+	case metadataRequest:
+		e.serve(c, m.piece)
+	case metadataData:
+		if e.info != nil || !e.isSource(c) {
+			return nil
+		}
+		if m.totalSize != e.size || m.piece >= len(e.pieces) || len(m.data) != e.pieceSize(m.piece) {
+			return fmt.Errorf("Unexpected metadata piece %d of %d bytes", m.piece, len(m.data))
+		}
+		if r, ok := e.requested[m.piece]; ok && r.c == c {
+			delete(e.requested, m.piece)
+		}
+		if e.pieces[m.piece] == nil {
+			e.pieces[m.piece], e.from[m.piece] = m.data, c
+			if err := e.checkComplete(); err != nil {
+				return err
+			}
+		}
+		if e.info == nil && e.isSource(c) {
+			e.requestFrom(c)
+		}
+	case metadataReject:
+		e.dropSource(c)
+	}
+	return nil
+}
+
+// Maintain forgets requests left unanswered for metadataRequestTimeout and asks
+// the sources for the missing pieces again. It should be called regularly
+// while fetching.
+func (e *MetadataExtension) Maintain() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.info != nil {
+		return
+	}
+	now := e.now()
+	for piece, r := range e.requested {
+		if now.Sub(r.at) >= metadataRequestTimeout {
+			delete(e.requested, piece)
+		}
+	}
+	for _, s := range e.sources {
+		e.requestFrom(s)
+	}
+}
+
+func (e *MetadataExtension) serve(c *ExtensionConn, piece int) {
+	if e.info == nil || piece*MetadataPieceSize >= len(e.info) {
+		c.Send(e.Name(), (&metadataMessage{msgType: metadataReject, piece: piece}).bytes())
+		return
+	}
+	begin := piece * MetadataPieceSize
+	end := begin + MetadataPieceSize
+	if end > len(e.info) {
+		end = len(e.info)
+	}
+	c.Send(e.Name(), (&metadataMessage{msgType: metadataData, piece: piece, totalSize: len(e.info), data: e.info[begin:end]}).bytes())
+}
+
+func (e *MetadataExtension) pieceSize(piece int) int {
+	if piece == len(e.pieces)-1 {
+		return e.size - piece*MetadataPieceSize
+	}
+	return MetadataPieceSize
+}
+
+func (e *MetadataExtension) isSource(c *ExtensionConn) bool {
+	for _, s := range e.sources {
+		if s == c {
+			return true
+		}
+	}
+	return false
+}
+
+// restart throws away what has been fetched and starts over with the size the
+// first remaining peer offers, fetching from every peer offering it or, once
+// a check has failed, from that peer alone.
+func (e *MetadataExtension) restart() {
+	e.size, e.pieces, e.from, e.sources = 0, nil, nil, nil
+	e.requested = make(map[int]metadataPieceRequest)
+	if len(e.peers) == 0 {
+		return
+	}
+	e.size = e.sizes[e.peers[0]]
+	numPieces := (e.size + MetadataPieceSize - 1) / MetadataPieceSize
+	e.pieces, e.from = make([][]byte, numPieces), make([]*ExtensionConn, numPieces)
+	for _, c := range e.peers {
+		if e.sizes[c] != e.size || e.solo && len(e.sources) > 0 {
+			continue
+		}
+		e.sources = append(e.sources, c)
+		e.requestFrom(c)
+	}
+}
+
+// dropSource forgets c and asks the other sources for what it had been asked
+// for, starting over with the next peer if no source is left.
+func (e *MetadataExtension) dropSource(c *ExtensionConn) {
+	e.peers = removeExtensionConn(e.peers, c)
+	delete(e.sizes, c)
+	if !e.isSource(c) {
+		return
+	}
+	e.sources = removeExtensionConn(e.sources, c)
+	for piece, r := range e.requested {
+		if r.c == c {
+			delete(e.requested, piece)
+		}
+	}
+	if e.info != nil {
+		return
+	}
+	if len(e.sources) == 0 {
+		e.restart()
+		return
+	}
+	for _, s := range e.sources {
+		e.requestFrom(s)
+	}
+}
+
+// requestFrom asks c for missing pieces nobody else has been asked for lately,
+// keeping at most maxMetadataRequests outstanding.
+func (e *MetadataExtension) requestFrom(c *ExtensionConn) {
+	now := e.now()
+	outstanding := 0
+	for _, r := range e.requested {
+		if r.c == c {
+			outstanding++
+		}
+	}
+	for piece := range e.pieces {
+		if outstanding >= maxMetadataRequests {
+			return
+		}
+		if e.pieces[piece] != nil {
+			continue
+		}
+		if r, ok := e.requested[piece]; ok && now.Sub(r.at) < metadataRequestTimeout {
+			continue
+		}
+		if c.Send(e.Name(), (&metadataMessage{msgType: metadataRequest, piece: piece}).bytes()) != nil {
+			return
+		}
+		e.requested[piece] = metadataPieceRequest{c, now}
+		outstanding++
+	}
+}
+
+// checkComplete verifies the metadata once every piece is in. If it does not
+// match the infohash and came from a single peer, that peer is banned and an
+// error returned to drop it; if it came from several, it is fetched again
+// from one peer at a time.
+func (e *MetadataExtension) checkComplete() error {
+	for _, p := range e.pieces {
+		if p == nil {
+			return nil
+		}
+	}
+	info := bytes.Join(e.pieces, nil)
+	if sum := sha1.Sum(info); !bytes.Equal(sum[:], e.infoHash) {
+		culprit := e.from[0]
+		for _, c := range e.from {
+			if c != culprit {
+				culprit = nil
+				break
+			}
+		}
+		e.solo = true
+		if culprit != nil {
+			e.banned[culprit] = true
+			e.peers = removeExtensionConn(e.peers, culprit)
+			delete(e.sizes, culprit)
+		}
+		e.restart()
+		if culprit != nil {
+			return errors.New("Metadata does not match infohash")
+		}
+		return nil
+	}
+	e.info, e.pieces, e.from, e.requested, e.sources, e.peers, e.sizes = info, nil, nil, nil, nil, nil, nil
+	close(e.done)
+	return nil
+}
+
+func removeExtensionConn(conns []*ExtensionConn, c *ExtensionConn) []*ExtensionConn {
+	for i, other := range conns {
+		if other == c {
+			return append(conns[:i], conns[i+1:]...)
+		}
+	}
+	return conns
+}
@@ -0,0 +1,243 @@
+package btgo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mopsled/btgo/peer"
+)
+
+func TestMetadataMessageRoundTrip(t *testing.T) {
+	messages := []*metadataMessage{
+		{msgType: metadataRequest, piece: 3, data: []byte{}},
+		{msgType: metadataData, piece: 1, totalSize: 20000, data: bytes.Repeat([]byte("e"), 3616)},
+		{msgType: metadataReject, piece: 0, data: []byte{}},
+	}
+	for _, m := range messages {
+		parsed, err := parseMetadataMessage(m.bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.msgType != m.msgType || parsed.piece != m.piece || parsed.totalSize != m.totalSize || !bytes.Equal(parsed.data, m.data) {
+			t.Errorf("Expected %+v, got %+v", m, parsed)
+		}
+	}
+
+	for _, bad := range []string{"", "d8:msg_typei0ee", "d8:msg_typei1e5:piecei0ee", "d8:msg_typei0e5:piecei-1ee", "d8:msg_typei0e5:piecei0e"} {
+		if _, err := parseMetadataMessage([]byte(bad)); err == nil {
+			t.Errorf("Expected error parsing %q", bad)
+		}
+	}
+}
+
+// largeInfo is an info dictionary spanning several metadata pieces.
+func largeInfo() []byte {
+	pieces := bytes.Repeat([]byte{1}, 20*2000)
+	return []byte(Bencode(map[string]interface{}{"name": "large", "piece length": 16384, "length": 16384 * 2000, "pieces": pieces}))
+}
+
+func TestNewTorfileFromInfo(t *testing.T) {
+	info := largeInfo()
+	tfile, err := NewTorfileFromInfo(info, [][]string{{"http://tracker.example/announce"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha1.Sum(info); !bytes.Equal(tfile.infoHash, sum[:]) || tfile.numPieces() != 2000 {
+		t.Errorf("Unexpected torfile for info %x", tfile.infoHash)
+	}
+	if len(tfile.announceList) != 1 || tfile.announceList[0][0] != "http://tracker.example/announce" {
+		t.Errorf("Unexpected announce list %v", tfile.announceList)
+	}
+
+	unsorted := []byte("d6:lengthi1e4:name1:x6:pieces20:aaaaaaaaaaaaaaaaaaaa12:piece lengthi1ee")
+	if _, err = NewTorfileFromInfo(unsorted, nil); err == nil {
+		t.Error("Expected error for info dictionary that is not canonically bencoded")
+	}
+}
+
+// pumpExtensions hands every extended message a connection receives to its
+// extension side.
+func pumpExtensions(c *ExtensionConn) {
+	go func() {
+		for m := range c.Conn().Messages() {
+			if m.ID == peer.Extended && c.Handle(m) != nil {
+				c.Conn().Close()
+			}
+		}
+		c.Close()
+	}()
+}
+
+func TestMetadataExtensionFetch(t *testing.T) {
+	info := largeInfo()
+	sum := sha1.Sum(info)
+	left, right := net.Pipe()
+	a, b := peer.NewPeerConn(left, 0), peer.NewPeerConn(right, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a.Start(ctx)
+	b.Start(ctx)
+
+	serving, fetching := NewMetadataExtension(sum[:], info), NewMetadataExtension(sum[:], nil)
+	rs, rf := NewExtensionRegistry(), NewExtensionRegistry()
+	rs.Register(serving)
+	rf.Register(fetching)
+	es, ef := rs.NewConn(a), rf.NewConn(b)
+	pumpExtensions(es)
+	pumpExtensions(ef)
+	es.SendHandshake(ExtensionHandshake{MetadataSize: int64(len(info))})
+	ef.SendHandshake(ExtensionHandshake{})
+
+	select {
+	case <-fetching.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out fetching metadata")
+	}
+	if !bytes.Equal(fetching.Metadata(), info) {
+		t.Error("Fetched metadata differs from the original")
+	}
+}
+
+func TestMetadataExtensionRejectsWithoutInfo(t *testing.T) {
+	left, right := net.Pipe()
+	a, b := peer.NewPeerConn(left, 0), peer.NewPeerConn(right, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a.Start(ctx)
+	b.Start(ctx)
+
+	empty, fetching := NewMetadataExtension(make([]byte, 20), nil), NewMetadataExtension(make([]byte, 20), nil)
+	re, rf := NewExtensionRegistry(), NewExtensionRegistry()
+	re.Register(empty)
+	rf.Register(fetching)
+	ee, ef := re.NewConn(a), rf.NewConn(b)
+	pumpExtensions(ee)
+	ee.SendHandshake(ExtensionHandshake{MetadataSize: 100})
+	ef.SendHandshake(ExtensionHandshake{})
+	m := <-b.Messages()
+	if err := ef.Handle(m); err != nil {
+		t.Fatal(err)
+	}
+
+	// The peer claimed a size it cannot serve: its reject drops it as a source.
+	m = <-b.Messages()
+	if err := ef.Handle(m); err != nil {
+		t.Fatal(err)
+	}
+	fetching.mu.Lock()
+	defer fetching.mu.Unlock()
+	if len(fetching.sources) != 0 || len(fetching.requested) != 0 {
+		t.Errorf("Expected rejecting peer to be dropped, got %d sources", len(fetching.sources))
+	}
+}
+
+// connectMetadataPeer connects a peer serving info to the fetching extension
+// and returns the fetcher's side of the connection.
+func connectMetadataPeer(ctx context.Context, fetching *MetadataExtension, info []byte) *ExtensionConn {
+	left, right := net.Pipe()
+	a, b := peer.NewPeerConn(left, 0), peer.NewPeerConn(right, 0)
+	a.Start(ctx)
+	b.Start(ctx)
+	rs, rf := NewExtensionRegistry(), NewExtensionRegistry()
+	rs.Register(NewMetadataExtension(make([]byte, 20), info))
+	rf.Register(fetching)
+	es, ef := rs.NewConn(a), rf.NewConn(b)
+	pumpExtensions(es)
+	pumpExtensions(ef)
+	es.SendHandshake(ExtensionHandshake{MetadataSize: int64(len(info))})
+	ef.SendHandshake(ExtensionHandshake{})
+	return ef
+}
+
+func TestMetadataExtensionDropsBadSource(t *testing.T) {
+	info := largeInfo()
+	sum := sha1.Sum(info)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fetching := NewMetadataExtension(sum[:], nil)
+
+	// The liar offers a different size, so the honest peer is only a fallback
+	// until the liar's metadata fails the check.
+	liar := connectMetadataPeer(ctx, fetching, bytes.Repeat([]byte{'x'}, len(info)+5))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fetching.mu.Lock()
+		seen := len(fetching.peers) > 0 || fetching.banned[liar]
+		fetching.mu.Unlock()
+		if seen {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the first peer")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	connectMetadataPeer(ctx, fetching, info)
+
+	select {
+	case <-fetching.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out fetching metadata")
+	}
+	if !bytes.Equal(fetching.Metadata(), info) {
+		t.Error("Fetched metadata differs from the original")
+	}
+	fetching.mu.Lock()
+	defer fetching.mu.Unlock()
+	if !fetching.banned[liar] {
+		t.Error("Expected the peer sending bad metadata to be banned")
+	}
+}
+
+func TestMetadataExtensionMaintain(t *testing.T) {
+	now := time.Unix(1000, 0)
+	e := NewMetadataExtension(make([]byte, 20), nil)
+	e.now = func() time.Time { return now }
+	left, right := net.Pipe()
+	a, b := peer.NewPeerConn(left, 0), peer.NewPeerConn(right, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a.Start(ctx)
+	b.Start(ctx)
+	rs, rf := NewExtensionRegistry(), NewExtensionRegistry()
+	rs.Register(NewMetadataExtension(make([]byte, 20), nil))
+	rf.Register(e)
+	es, ef := rs.NewConn(a), rf.NewConn(b)
+	pumpExtensions(ef)
+	es.SendHandshake(ExtensionHandshake{MetadataSize: 100})
+
+	request := func() {
+		for m := range a.Messages() {
+			if m.ID == peer.Extended && len(m.Payload) > 0 && m.Payload[0] != extendedHandshakeID {
+				return
+			}
+		}
+	}
+	ef.SendHandshake(ExtensionHandshake{})
+	request()
+
+	e.Maintain()
+	e.mu.Lock()
+	requested := len(e.requested)
+	e.mu.Unlock()
+	if requested != 1 {
+		t.Errorf("Expected fresh request to be kept, got %d", requested)
+	}
+
+	now = now.Add(metadataRequestTimeout)
+	e.Maintain()
+	done := make(chan struct{})
+	go func() {
+		request()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out request was not sent again")
+	}
+}
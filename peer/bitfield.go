@@ -0,0 +1,49 @@
+package peer
+
+// Bitfield holds one bit per piece, the high bit of the first byte being
+// piece zero, as sent in the bitfield message.
+type Bitfield []byte
+
+func NewBitfield(pieces int) Bitfield {
+	return make(Bitfield, (pieces+7)/8)
+}
+
+func (b Bitfield) Has(index int) bool {
+	if index < 0 || index/8 >= len(b) {
+		return false
+	}
+	return b[index/8]&(0x80>>uint(index%8)) != 0
+}
+
+func (b Bitfield) Set(index int) {
+	if index >= 0 && index/8 < len(b) {
+		b[index/8] |= 0x80 >> uint(index%8)
+	}
+}
+
+func (b Bitfield) Clear(index int) {
+	if index >= 0 && index/8 < len(b) {
+		b[index/8] &^= 0x80 >> uint(index%8)
+	}
+}
+
+func (b Bitfield) Count() (n int) {
+	for _, c := range b {
+		for ; c != 0; c &= c - 1 {
+			n++
+		}
+	}
+	return
+}
+
+// validFor reports whether b has the right length for pieces and no spare
+// bits set past the last piece.
+func (b Bitfield) validFor(pieces int) bool {
+	if len(b) != (pieces+7)/8 {
+		return false
+	}
+	if spare := pieces % 8; spare != 0 && b[len(b)-1]&(0xff>>uint(spare)) != 0 {
+		return false
+	}
+	return true
+}
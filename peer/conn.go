@@ -0,0 +1,589 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRequestTimeout    = time.Minute
+	DefaultKeepAliveInterval = 2 * time.Minute
+	DefaultIdleTimeout       = 3 * time.Minute
+	DefaultMaxOutstanding    = 16
+
+	rateWindow = 10 * time.Second
+)
+
+var (
+	ErrClosed          = errors.New("Peer connection closed")
+	ErrIdleTimeout     = errors.New("Peer connection idle for too long")
+	ErrPeerChoking     = errors.New("Peer is choking us")
+	ErrTooManyRequests = errors.New("Too many outstanding requests")
+	ErrNotFast         = errors.New("Fast extension not negotiated")
+)
+
+// Block is a request for Length bytes at Begin in piece Index.
+type Block struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+// State holds the four choke and interest flags of a connection.
+type State struct {
+	AmChoking      bool
+	AmInterested   bool
+	PeerChoking    bool
+	PeerInterested bool
+}
+
+// PeerConn runs the wire protocol over an already handshaken connection with
+// one reader and one writer goroutine. It keeps the choke and interest state,
+// the peer's bitfield and our outstanding requests up to date, and hands every
+// message the caller must act on to Messages; blocks we did not request are
+// dropped. Requests that time out, or that are dropped by the peer choking us
+// or rejecting them, are collected for DroppedRequests.
+//
+// Fast should be set before Start when both handshakes carry ReservedFast.
+// The peer choking us then no longer drops our requests: the peer rejects
+// them one by one, and requests it will not serve are rejected in turn
+// instead of being ignored. Blocks of allowed fast pieces may be requested
+// and served while choked.
+//
+// The timeouts and the pipelining depth may be changed before Start.
+type PeerConn struct {
+	RequestTimeout    time.Duration
+	KeepAliveInterval time.Duration
+	IdleTimeout       time.Duration
+	MaxOutstanding    int
+	Fast              bool
+
+	conn      net.Conn
+	dec       *Decoder
+	numPieces int
+	now       func() time.Time
+	tick      time.Duration
+
+	out      chan *Message
+	messages chan *Message
+	done     chan struct{}
+	stop     sync.Once
+
+	mu           sync.Mutex
+	state        State
+	bitfield     Bitfield
+	allowed      Bitfield // pieces we may request while choked
+	allowing     Bitfield // pieces we serve while choking the peer
+	received     bool
+	outstanding  map[Block]time.Time
+	cancelled    map[Block]time.Time // cancels a Fast peer may still answer, until RequestTimeout
+	dropped      []Block
+	download     rateMeter
+	upload       rateMeter
+	lastReceived time.Time
+	lastSent     time.Time
+	err          error
+}
+
+func NewPeerConn(conn net.Conn, numPieces int) *PeerConn {
+	dec := NewDecoder(conn)
+	dec.NumPieces = numPieces
+	return &PeerConn{
+		RequestTimeout:    DefaultRequestTimeout,
+		KeepAliveInterval: DefaultKeepAliveInterval,
+		IdleTimeout:       DefaultIdleTimeout,
+		MaxOutstanding:    DefaultMaxOutstanding,
+		conn:              conn,
+		dec:               dec,
+		numPieces:         numPieces,
+		now:               time.Now,
+		tick:              time.Second,
+		out:               make(chan *Message, 64),
+		messages:          make(chan *Message, 64),
+		done:              make(chan struct{}),
+		state:             State{AmChoking: true, PeerChoking: true},
+		bitfield:          NewBitfield(numPieces),
+		allowed:           NewBitfield(numPieces),
+		allowing:          NewBitfield(numPieces),
+		outstanding:       make(map[Block]time.Time),
+		cancelled:         make(map[Block]time.Time),
+	}
+}
+
+// Start launches the reader and writer. The connection is closed when ctx is
+// done, when Close is called or on the first error.
+func (c *PeerConn) Start(ctx context.Context) {
+	now := c.now()
+	c.mu.Lock()
+	c.lastReceived, c.lastSent = now, now
+	c.mu.Unlock()
+	go c.readLoop()
+	go c.writeLoop(ctx)
+}
+
+func (c *PeerConn) Close() error {
+	c.shutdown(ErrClosed)
+	return nil
+}
+
+// Done is closed once the connection has shut down.
+func (c *PeerConn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection shut down, or nil while it is running.
+func (c *PeerConn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Messages delivers have, bitfield, request, piece, cancel, port and unknown
+// messages, and with Fast have all, have none, suggest piece and allowed fast
+// too. Have all comes with the full bitfield set. Requests are only delivered
+// while we are not choking the peer, or for pieces we allowed fast. The
+// channel is closed when the connection shuts down.
+func (c *PeerConn) Messages() <-chan *Message {
+	return c.messages
+}
+
+func (c *PeerConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *PeerConn) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// Bitfield returns a copy of the pieces the peer has announced.
+func (c *PeerConn) Bitfield() Bitfield {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append(Bitfield(nil), c.bitfield...)
+}
+
+func (c *PeerConn) Outstanding() (blocks []Block) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for b := range c.outstanding {
+		blocks = append(blocks, b)
+	}
+	return
+}
+
+// Requestable returns the pieces the peer has that we may ask for now: all of
+// them while unchoked, only the allowed fast ones while choked.
+func (c *PeerConn) Requestable() Bitfield {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := append(Bitfield(nil), c.bitfield...)
+	if c.state.PeerChoking {
+		for i := range b {
+			b[i] &= c.allowed[i]
+		}
+	}
+	return b
+}
+
+// CanRequest reports whether a Request would currently be accepted for some
+// piece.
+func (c *PeerConn) CanRequest() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return (!c.state.PeerChoking || c.allowed.Count() > 0) && len(c.outstanding) < c.MaxOutstanding
+}
+
+// DroppedRequests returns and forgets the requests that timed out, were
+// discarded because the peer choked us or were rejected, so they can be asked
+// elsewhere.
+func (c *PeerConn) DroppedRequests() (blocks []Block) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	blocks, c.dropped = c.dropped, nil
+	return
+}
+
+// DownloadRate and UploadRate are in bytes of piece data per second, averaged
+// over roughly the last ten seconds.
+func (c *PeerConn) DownloadRate() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.download.rateAt(c.now())
+}
+
+func (c *PeerConn) UploadRate() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.upload.rateAt(c.now())
+}
+
+// Downloaded and Uploaded are the totals of piece data moved so far.
+func (c *PeerConn) Downloaded() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.download.total
+}
+
+func (c *PeerConn) Uploaded() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.upload.total
+}
+
+func (c *PeerConn) Choke() error {
+	return c.setFlag(&c.state.AmChoking, true, Choke)
+}
+
+func (c *PeerConn) Unchoke() error {
+	return c.setFlag(&c.state.AmChoking, false, Unchoke)
+}
+
+func (c *PeerConn) SetInterested(interested bool) error {
+	if interested {
+		return c.setFlag(&c.state.AmInterested, true, Interested)
+	}
+	return c.setFlag(&c.state.AmInterested, false, NotInterested)
+}
+
+func (c *PeerConn) setFlag(flag *bool, value bool, id MessageID) error {
+	c.mu.Lock()
+	changed := *flag != value
+	*flag = value
+	c.mu.Unlock()
+	if !changed {
+		return nil
+	}
+	return c.Send(&Message{ID: id})
+}
+
+func (c *PeerConn) Have(index int) error {
+	return c.Send(&Message{ID: Have, Index: uint32(index)})
+}
+
+// SendBitfield sends our pieces, as have all or have none when Fast allows.
+func (c *PeerConn) SendBitfield(b Bitfield) error {
+	if c.Fast {
+		switch b.Count() {
+		case 0:
+			return c.Send(&Message{ID: HaveNone})
+		case c.numPieces:
+			return c.Send(&Message{ID: HaveAll})
+		}
+	}
+	return c.Send(&Message{ID: BitfieldMsg, Bitfield: b})
+}
+
+// Request asks the peer for a block, failing while the peer chokes us unless
+// the piece is allowed fast, or once MaxOutstanding requests are pending.
+func (c *PeerConn) Request(b Block) error {
+	c.mu.Lock()
+	if c.state.PeerChoking && !c.allowed.Has(int(b.Index)) {
+		c.mu.Unlock()
+		return ErrPeerChoking
+	}
+	if _, ok := c.outstanding[b]; !ok && len(c.outstanding) >= c.MaxOutstanding {
+		c.mu.Unlock()
+		return ErrTooManyRequests
+	}
+	c.outstanding[b] = c.now()
+	delete(c.cancelled, b)
+	c.mu.Unlock()
+	return c.Send(&Message{ID: Request, Index: b.Index, Begin: b.Begin, Length: b.Length})
+}
+
+func (c *PeerConn) Cancel(b Block) error {
+	c.mu.Lock()
+	_, ok := c.outstanding[b]
+	delete(c.outstanding, b)
+	if ok && c.Fast {
+		c.cancelled[b] = c.now()
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return c.Send(&Message{ID: Cancel, Index: b.Index, Begin: b.Begin, Length: b.Length})
+}
+
+func (c *PeerConn) SendPiece(index, begin uint32, block []byte) error {
+	return c.Send(&Message{ID: Piece, Index: index, Begin: begin, Block: block})
+}
+
+// Reject tells the peer we will not serve a request. Without Fast the request
+// is silently dropped instead.
+func (c *PeerConn) Reject(b Block) error {
+	if !c.Fast {
+		return nil
+	}
+	return c.Send(&Message{ID: RejectRequest, Index: b.Index, Begin: b.Begin, Length: b.Length})
+}
+
+// AllowFast lets the peer request a piece while we choke it.
+func (c *PeerConn) AllowFast(index int) error {
+	if !c.Fast {
+		return ErrNotFast
+	}
+	c.mu.Lock()
+	c.allowing.Set(index)
+	c.mu.Unlock()
+	return c.Send(&Message{ID: AllowedFast, Index: uint32(index)})
+}
+
+// Suggest hints that the peer should download a piece from us.
+func (c *PeerConn) Suggest(index int) error {
+	if !c.Fast {
+		return ErrNotFast
+	}
+	return c.Send(&Message{ID: SuggestPiece, Index: uint32(index)})
+}
+
+// Send queues any message for the writer.
+func (c *PeerConn) Send(m *Message) error {
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+	select {
+	case c.out <- m:
+		return nil
+	case <-c.done:
+		return ErrClosed
+	}
+}
+
+func (c *PeerConn) shutdown(err error) {
+	c.stop.Do(func() {
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *PeerConn) readLoop() {
+	defer close(c.messages)
+	for {
+		m, err := c.dec.Decode()
+		if err != nil {
+			c.shutdown(err)
+			return
+		}
+		deliver, reply, err := c.handle(m)
+		if err != nil {
+			c.shutdown(err)
+			return
+		}
+		if reply != nil {
+			c.Send(reply)
+		}
+		if !deliver {
+			continue
+		}
+		select {
+		case c.messages <- m:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// handle applies a received message to the connection state and reports
+// whether it should be passed on to the caller, and any message to answer it
+// with.
+func (c *PeerConn) handle(m *Message) (deliver bool, reply *Message, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	c.lastReceived = now
+	first := !c.received
+	switch m.ID {
+	case KeepAlive, Extended, Port:
+		// Some clients send their extended handshake or DHT port before the
+		// bitfield, so these do not end the window for it.
+	default:
+		c.received = true
+	}
+
+	switch m.ID {
+	case SuggestPiece, HaveAll, HaveNone, RejectRequest, AllowedFast:
+		if !c.Fast {
+			return false, nil, fmt.Errorf("Unexpected %s message without fast extension", m.ID)
+		}
+	}
+
+	switch m.ID {
+	case KeepAlive:
+	case Choke:
+		c.state.PeerChoking = true
+		if c.Fast {
+			break
+		}
+		for b := range c.outstanding {
+			c.dropped = append(c.dropped, b)
+		}
+		c.outstanding = make(map[Block]time.Time)
+	case Unchoke:
+		c.state.PeerChoking = false
+	case Interested:
+		c.state.PeerInterested = true
+	case NotInterested:
+		c.state.PeerInterested = false
+	case Have:
+		c.bitfield.Set(int(m.Index))
+		deliver = true
+	case BitfieldMsg, HaveAll, HaveNone:
+		if !first {
+			return false, nil, fmt.Errorf("%s message after the first message", m.ID)
+		}
+		switch m.ID {
+		case HaveAll:
+			for i := 0; i < c.numPieces; i++ {
+				c.bitfield.Set(i)
+			}
+			m.Bitfield = append(Bitfield(nil), c.bitfield...)
+		case BitfieldMsg:
+			copy(c.bitfield, m.Bitfield)
+		}
+		deliver = true
+	case Request:
+		deliver = !c.state.AmChoking || c.allowing.Has(int(m.Index))
+		if !deliver && c.Fast {
+			reply = &Message{ID: RejectRequest, Index: m.Index, Begin: m.Begin, Length: m.Length}
+		}
+	case RejectRequest:
+		b := Block{m.Index, m.Begin, m.Length}
+		if _, ok := c.outstanding[b]; ok {
+			delete(c.outstanding, b)
+			c.dropped = append(c.dropped, b)
+		} else if _, ok := c.cancelled[b]; ok {
+			delete(c.cancelled, b)
+		} else {
+			return false, nil, errors.New("Peer rejected a request we did not send")
+		}
+	case AllowedFast:
+		c.allowed.Set(int(m.Index))
+		deliver = true
+	case Piece:
+		// Blocks we did not ask for, or no longer wait for, are dropped so
+		// that only the peer we asked can fill a block.
+		b := Block{m.Index, m.Begin, uint32(len(m.Block))}
+		_, deliver = c.outstanding[b]
+		delete(c.outstanding, b)
+		delete(c.cancelled, b)
+		if deliver {
+			c.download.add(now, int64(len(m.Block)))
+		}
+	default:
+		deliver = true
+	}
+	return
+}
+
+func (c *PeerConn) writeLoop(ctx context.Context) {
+	ticker := time.NewTicker(c.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			c.shutdown(ctx.Err())
+			return
+		case <-c.done:
+			return
+		case m := <-c.out:
+			if err := c.write(m); err != nil {
+				c.shutdown(err)
+				return
+			}
+		case <-ticker.C:
+			if err := c.maintain(); err != nil {
+				c.shutdown(err)
+				return
+			}
+		}
+	}
+}
+
+func (c *PeerConn) write(m *Message) (err error) {
+	if err = WriteMessage(c.conn, m); err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	c.lastSent = now
+	if m.ID == Piece {
+		c.upload.add(now, int64(len(m.Block)))
+	}
+	return
+}
+
+// maintain runs on every tick: it drops the connection once idle, sends
+// keep-alives, cancels requests that have timed out and forgets cancels the
+// peer never answered.
+func (c *PeerConn) maintain() error {
+	c.mu.Lock()
+	now := c.now()
+	if c.IdleTimeout > 0 && now.Sub(c.lastReceived) >= c.IdleTimeout {
+		c.mu.Unlock()
+		return ErrIdleTimeout
+	}
+	var messages []*Message
+	if c.KeepAliveInterval > 0 && now.Sub(c.lastSent) >= c.KeepAliveInterval {
+		messages = append(messages, &Message{ID: KeepAlive})
+	}
+	if c.RequestTimeout > 0 {
+		for b, at := range c.outstanding {
+			if now.Sub(at) >= c.RequestTimeout {
+				delete(c.outstanding, b)
+				if c.Fast {
+					c.cancelled[b] = now
+				}
+				c.dropped = append(c.dropped, b)
+				messages = append(messages, &Message{ID: Cancel, Index: b.Index, Begin: b.Begin, Length: b.Length})
+			}
+		}
+		for b, at := range c.cancelled {
+			if now.Sub(at) >= c.RequestTimeout {
+				delete(c.cancelled, b)
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	for _, m := range messages {
+		if err := c.write(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rateMeter is an exponentially decaying average of bytes per second.
+type rateMeter struct {
+	total int64
+	rate  float64
+	last  time.Time
+}
+
+func (r *rateMeter) add(now time.Time, n int64) {
+	r.rate = r.rateAt(now) + float64(n)/rateWindow.Seconds()
+	r.last = now
+	r.total += n
+}
+
+func (r *rateMeter) rateAt(now time.Time) float64 {
+	if r.last.IsZero() {
+		return 0
+	}
+	return r.rate * math.Exp(-now.Sub(r.last).Seconds()/rateWindow.Seconds())
+}
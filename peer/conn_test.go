@@ -0,0 +1,351 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func newConnPair(t *testing.T, numPieces int, configure ...func(*PeerConn)) (a, b *PeerConn, clock *fakeClock, cancel context.CancelFunc) {
+	left, right := net.Pipe()
+	clock = &fakeClock{t: time.Unix(1000, 0)}
+	a, b = NewPeerConn(left, numPieces), NewPeerConn(right, numPieces)
+	for _, c := range []*PeerConn{a, b} {
+		c.now = clock.now
+		c.tick = 5 * time.Millisecond
+		for _, f := range configure {
+			f(c)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	a.Start(ctx)
+	b.Start(ctx)
+	t.Cleanup(cancel)
+	return
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func receive(t *testing.T, c *PeerConn, id MessageID) *Message {
+	for {
+		select {
+		case m, ok := <-c.Messages():
+			if !ok {
+				t.Fatalf("Connection closed waiting for %s: %v", id, c.Err())
+			}
+			if m.ID == id {
+				return m
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for %s", id)
+		}
+	}
+}
+
+func TestPeerConnExchange(t *testing.T) {
+	a, b, _, _ := newConnPair(t, 4)
+
+	have := NewBitfield(4)
+	have.Set(1)
+	b.SendBitfield(have)
+	b.Have(3)
+	receive(t, a, Have)
+	if bf := a.Bitfield(); !bf.Has(1) || !bf.Has(3) || bf.Has(0) {
+		t.Errorf("Unexpected peer bitfield %08b", bf)
+	}
+
+	if err := a.Request(Block{1, 0, 4}); err != ErrPeerChoking {
+		t.Errorf("Expected ErrPeerChoking, got %v", err)
+	}
+	a.SetInterested(true)
+	waitFor(t, "interest", func() bool { return b.State().PeerInterested })
+	b.Unchoke()
+	waitFor(t, "unchoke", func() bool { return !a.State().PeerChoking })
+
+	if err := a.Request(Block{1, 0, 4}); err != nil {
+		t.Fatal(err)
+	}
+	request := receive(t, b, Request)
+	if request.Index != 1 || request.Begin != 0 || request.Length != 4 {
+		t.Errorf("Unexpected request %s", request)
+	}
+	b.SendPiece(2, 0, []byte("junk")) // never requested, so dropped
+	b.SendPiece(1, 0, []byte("data"))
+	piece := receive(t, a, Piece)
+	if piece.Index != 1 || !bytes.Equal(piece.Block, []byte("data")) {
+		t.Errorf("Unexpected block %q", piece.Block)
+	}
+	if len(a.Outstanding()) != 0 {
+		t.Errorf("Expected no outstanding requests, got %v", a.Outstanding())
+	}
+	waitFor(t, "upload accounting", func() bool { return b.Uploaded() == 8 }) // junk and data
+	if a.Downloaded() != 4 || a.DownloadRate() <= 0 {
+		t.Errorf("Unexpected download accounting %d at %f", a.Downloaded(), a.DownloadRate())
+	}
+
+	if state := a.State(); state != (State{AmChoking: true, AmInterested: true}) {
+		t.Errorf("Unexpected state %+v", state)
+	}
+}
+
+func TestPeerConnPipelining(t *testing.T) {
+	a, b, _, _ := newConnPair(t, 4)
+	a.MaxOutstanding = 2
+	b.Unchoke()
+	waitFor(t, "unchoke", func() bool { return a.CanRequest() })
+
+	a.Request(Block{0, 0, 16384})
+	a.Request(Block{0, 16384, 16384})
+	if a.CanRequest() {
+		t.Error("Expected pipeline to be full")
+	}
+	if err := a.Request(Block{0, 32768, 16384}); err != ErrTooManyRequests {
+		t.Errorf("Expected ErrTooManyRequests, got %v", err)
+	}
+	a.Cancel(Block{0, 0, 16384})
+	receive(t, b, Cancel)
+	if !a.CanRequest() {
+		t.Error("Expected room in the pipeline after cancel")
+	}
+
+	b.Choke()
+	waitFor(t, "choke", func() bool { return a.State().PeerChoking })
+	dropped := a.DroppedRequests()
+	if len(dropped) != 1 || dropped[0] != (Block{0, 16384, 16384}) || len(a.Outstanding()) != 0 {
+		t.Errorf("Expected choke to drop the outstanding request, got %v", dropped)
+	}
+}
+
+func TestPeerConnRequestTimeout(t *testing.T) {
+	a, b, clock, _ := newConnPair(t, 4)
+	b.Unchoke()
+	waitFor(t, "unchoke", func() bool { return a.CanRequest() })
+	a.Request(Block{2, 0, 100})
+	receive(t, b, Request)
+
+	clock.advance(a.RequestTimeout)
+	m := receive(t, b, Cancel)
+	if m.Index != 2 || m.Length != 100 {
+		t.Errorf("Unexpected cancel %s", m)
+	}
+	if dropped := a.DroppedRequests(); len(dropped) != 1 || dropped[0] != (Block{2, 0, 100}) {
+		t.Errorf("Expected timed out request, got %v", dropped)
+	}
+	if dropped := a.DroppedRequests(); len(dropped) != 0 {
+		t.Errorf("Expected dropped requests to be forgotten, got %v", dropped)
+	}
+}
+
+func TestPeerConnKeepAliveAndIdleTimeout(t *testing.T) {
+	a, b, clock, _ := newConnPair(t, 4)
+	b.KeepAliveInterval = 0
+
+	// a keeps sending keep-alives, so b stays up while a hears nothing.
+	clock.advance(a.KeepAliveInterval)
+	waitFor(t, "keep-alive", func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.lastReceived.Equal(clock.now())
+	})
+	clock.advance(a.IdleTimeout - a.KeepAliveInterval)
+	select {
+	case <-a.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected idle connection to shut down")
+	}
+	if a.Err() != ErrIdleTimeout {
+		t.Errorf("Expected ErrIdleTimeout, got %v", a.Err())
+	}
+}
+
+func TestPeerConnShutdown(t *testing.T) {
+	a, b, _, cancel := newConnPair(t, 4)
+	cancel()
+	for _, c := range []*PeerConn{a, b} {
+		select {
+		case <-c.Done():
+		case <-time.After(2 * time.Second):
+			t.Fatal("Expected shutdown on context cancellation")
+		}
+		for range c.Messages() {
+		}
+		if err := c.Send(&Message{ID: Interested}); err != ErrClosed {
+			t.Errorf("Expected ErrClosed, got %v", err)
+		}
+	}
+	if a.Err() != context.Canceled && b.Err() != context.Canceled {
+		t.Errorf("Expected a cancelled connection, got %v and %v", a.Err(), b.Err())
+	}
+}
+
+func TestPeerConnRejectsLateBitfield(t *testing.T) {
+	a, b, _, _ := newConnPair(t, 4)
+	b.Have(0)
+	b.SendBitfield(NewBitfield(4))
+	select {
+	case <-a.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected late bitfield to close the connection")
+	}
+}
+
+func TestPeerConnBitfieldAfterExtended(t *testing.T) {
+	a, b, _, _ := newConnPair(t, 4)
+	bitfield := NewBitfield(4)
+	bitfield.Set(2)
+	b.Send(&Message{ID: Extended, Payload: []byte("\x00de")})
+	b.Send(&Message{ID: Port, Port: 6881})
+	b.SendBitfield(bitfield)
+	for i := 0; i < 3; i++ {
+		select {
+		case m := <-a.Messages():
+			if m.ID == BitfieldMsg && !a.Bitfield().Has(2) {
+				t.Error("Bitfield after extended handshake was not applied")
+			}
+		case <-a.Done():
+			t.Fatalf("Connection closed: %v", a.Err())
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timed out waiting for messages")
+		}
+	}
+}
+
+func TestPeerConnFastExtension(t *testing.T) {
+	a, b, _, _ := newConnPair(t, 12, func(c *PeerConn) { c.Fast = true })
+
+	b.SendBitfield(Bitfield{0xff, 0xf0})
+	if m := receive(t, a, HaveAll); m.Bitfield.Count() != 12 {
+		t.Errorf("Expected have all to carry a full bitfield, got %08b", m.Bitfield)
+	}
+	if a.CanRequest() || a.Request(Block{5, 0, 4}) != ErrPeerChoking {
+		t.Error("Expected requests to be refused while choked")
+	}
+
+	b.AllowFast(5)
+	receive(t, a, AllowedFast)
+	if r := a.Requestable(); !r.Has(5) || r.Count() != 1 || !a.CanRequest() {
+		t.Errorf("Expected only the allowed fast piece to be requestable, got %08b", r)
+	}
+	if err := a.Request(Block{5, 0, 4}); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, b, Request); m.Index != 5 {
+		t.Errorf("Unexpected request %s", m)
+	}
+
+	// b chokes us, so other requests are rejected rather than ignored.
+	a.mu.Lock()
+	a.outstanding[Block{6, 0, 4}] = a.now()
+	a.mu.Unlock()
+	a.Send(&Message{ID: Request, Index: 6, Begin: 0, Length: 4})
+	waitFor(t, "reject", func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return len(a.dropped) == 1
+	})
+	if dropped := a.DroppedRequests(); dropped[0] != (Block{6, 0, 4}) {
+		t.Errorf("Expected the rejected request to be dropped, got %v", dropped)
+	}
+
+	// Choking no longer drops outstanding requests.
+	b.Unchoke()
+	waitFor(t, "unchoke", func() bool { return !a.State().PeerChoking })
+	a.Request(Block{1, 0, 4})
+	receive(t, b, Request)
+	b.Choke()
+	waitFor(t, "choke", func() bool { return a.State().PeerChoking })
+	if len(a.Outstanding()) != 2 || len(a.DroppedRequests()) != 0 {
+		t.Errorf("Expected requests to survive the choke, got %v", a.Outstanding())
+	}
+	b.Reject(Block{1, 0, 4})
+	waitFor(t, "reject", func() bool { return len(a.Outstanding()) == 1 })
+
+	// Rejecting a request that was never sent is a protocol error.
+	b.Reject(Block{2, 0, 4})
+	select {
+	case <-a.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected bogus reject to close the connection")
+	}
+}
+
+func TestPeerConnRejectsFastMessagesWithoutFast(t *testing.T) {
+	a, b, _, _ := newConnPair(t, 4)
+	b.Send(&Message{ID: HaveNone})
+	select {
+	case <-a.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected have none without fast extension to close the connection")
+	}
+}
+
+func TestPeerConnFastAcceptsRejectAfterCancel(t *testing.T) {
+	a, b, clock, _ := newConnPair(t, 4, func(c *PeerConn) { c.Fast = true })
+	b.Unchoke()
+	waitFor(t, "unchoke", func() bool { return a.CanRequest() })
+
+	a.Request(Block{1, 0, 4})
+	receive(t, b, Request)
+	a.Cancel(Block{1, 0, 4})
+	receive(t, b, Cancel)
+	b.Reject(Block{1, 0, 4})
+
+	// A timed out request may be rejected after its cancel too.
+	a.Request(Block{2, 0, 4})
+	receive(t, b, Request)
+	clock.advance(a.RequestTimeout)
+	receive(t, b, Cancel)
+	b.Reject(Block{2, 0, 4})
+
+	b.Have(3)
+	receive(t, a, Have)
+	if a.Err() != nil {
+		t.Fatalf("Expected rejects of cancelled requests to be accepted, got %v", a.Err())
+	}
+	a.mu.Lock()
+	cancelled := len(a.cancelled)
+	a.mu.Unlock()
+	if cancelled != 0 {
+		t.Errorf("Expected answered cancels to be forgotten, got %d", cancelled)
+	}
+
+	// Cancels the peer ignores are forgotten once they time out.
+	a.Request(Block{3, 0, 4})
+	receive(t, b, Request)
+	a.Cancel(Block{3, 0, 4})
+	receive(t, b, Cancel)
+	clock.advance(a.RequestTimeout)
+	waitFor(t, "ignored cancel to expire", func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return len(a.cancelled) == 0
+	})
+}
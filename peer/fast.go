@@ -0,0 +1,47 @@
+package peer
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+)
+
+// DefaultAllowedFast is the size of the allowed fast set BEP 6 suggests.
+const DefaultAllowedFast = 10
+
+// AllowedFastSet generates the canonical allowed fast set of k pieces for a
+// peer at ip, so that both sides of a connection agree on it. BEP 6 only
+// defines it for IPv4 addresses; other addresses get no set.
+func AllowedFastSet(ip net.IP, infoHash [20]byte, numPieces, k int) (set []int) {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces <= 0 {
+		return nil
+	}
+	if k > numPieces {
+		k = numPieces
+	}
+
+	x := make([]byte, 0, 4+len(infoHash))
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash[:]...)
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces))
+			if !containsPiece(set, index) {
+				set = append(set, index)
+			}
+		}
+	}
+	return
+}
+
+func containsPiece(set []int, index int) bool {
+	for _, i := range set {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,27 @@
+package peer
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	// The example from BEP 6.
+	var infoHash [20]byte
+	copy(infoHash[:], bytes.Repeat([]byte{0xaa}, 20))
+	ip := net.ParseIP("80.4.4.200")
+	if set := AllowedFastSet(ip, infoHash, 1313, 7); !reflect.DeepEqual(set, []int{1059, 431, 808, 1217, 287, 376, 1188}) {
+		t.Errorf("Unexpected set of 7 %v", set)
+	}
+	if set := AllowedFastSet(ip, infoHash, 1313, 9); !reflect.DeepEqual(set, []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}) {
+		t.Errorf("Unexpected set of 9 %v", set)
+	}
+	if set := AllowedFastSet(ip, infoHash, 3, 10); len(set) != 3 {
+		t.Errorf("Expected the set capped at the piece count, got %v", set)
+	}
+	if set := AllowedFastSet(net.ParseIP("2001:db8::1"), infoHash, 1313, 7); set != nil {
+		t.Errorf("Expected no set for IPv6, got %v", set)
+	}
+}
@@ -0,0 +1,70 @@
+package peer
+
+import (
+	"errors"
+	"io"
+)
+
+const Protocol = "BitTorrent protocol"
+
+const HandshakeLength = 1 + len(Protocol) + 8 + 20 + 20
+
+// ReservedBit names one capability bit of the handshake's reserved bytes.
+type ReservedBit struct {
+	index int
+	mask  byte
+}
+
+var (
+	ReservedDHT       = ReservedBit{7, 0x01}
+	ReservedFast      = ReservedBit{7, 0x04}
+	ReservedExtension = ReservedBit{5, 0x10}
+)
+
+type Handshake struct {
+	Reserved [8]byte
+	InfoHash [20]byte
+	PeerID   [20]byte
+}
+
+func (h *Handshake) Set(bit ReservedBit) {
+	h.Reserved[bit.index] |= bit.mask
+}
+
+func (h Handshake) Has(bit ReservedBit) bool {
+	return h.Reserved[bit.index]&bit.mask != 0
+}
+
+func WriteHandshake(w io.Writer, h Handshake) (err error) {
+	buf := make([]byte, 0, HandshakeLength)
+	buf = append(buf, byte(len(Protocol)))
+	buf = append(buf, Protocol...)
+	buf = append(buf, h.Reserved[:]...)
+	buf = append(buf, h.InfoHash[:]...)
+	buf = append(buf, h.PeerID[:]...)
+	_, err = w.Write(buf)
+	return
+}
+
+func ReadHandshake(r io.Reader) (h Handshake, err error) {
+	buf := make([]byte, HandshakeLength)
+	if _, err = io.ReadFull(r, buf[:1]); err != nil {
+		return
+	}
+	if int(buf[0]) != len(Protocol) {
+		err = errors.New("Unexpected protocol string length in handshake")
+		return
+	}
+	if _, err = io.ReadFull(r, buf[1:]); err != nil {
+		return
+	}
+	if string(buf[1:1+len(Protocol)]) != Protocol {
+		err = errors.New("Unexpected protocol string in handshake")
+		return
+	}
+	rest := buf[1+len(Protocol):]
+	copy(h.Reserved[:], rest[0:8])
+	copy(h.InfoHash[:], rest[8:28])
+	copy(h.PeerID[:], rest[28:48])
+	return
+}
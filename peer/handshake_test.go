@@ -0,0 +1,49 @@
+package peer
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	var sent Handshake
+	copy(sent.InfoHash[:], "01234567890123456789")
+	copy(sent.PeerID[:], "-BG0001-abcdefghijkl")
+	sent.Set(ReservedExtension)
+	sent.Set(ReservedFast)
+
+	errs := make(chan error, 1)
+	go func() { errs <- WriteHandshake(a, sent) }()
+	received, err := ReadHandshake(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if received != sent {
+		t.Errorf("Expected %v, got %v", sent, received)
+	}
+	if !received.Has(ReservedExtension) || !received.Has(ReservedFast) || received.Has(ReservedDHT) {
+		t.Errorf("Unexpected reserved bits %x", received.Reserved)
+	}
+}
+
+func TestReadHandshakeRejectsOtherProtocols(t *testing.T) {
+	valid := new(bytes.Buffer)
+	WriteHandshake(valid, Handshake{})
+
+	wrongLength := append([]byte{18}, valid.Bytes()[1:]...)
+	wrongName := append([]byte(nil), valid.Bytes()...)
+	wrongName[1] = 'b'
+	for _, data := range [][]byte{wrongLength, wrongName, valid.Bytes()[:30]} {
+		if _, err := ReadHandshake(bytes.NewReader(data)); err == nil {
+			t.Errorf("Expected error reading handshake %q", data)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package peer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+type MessageID uint8
+
+const (
+	Choke MessageID = iota
+	Unchoke
+	Interested
+	NotInterested
+	Have
+	BitfieldMsg
+	Request
+	Piece
+	Cancel
+	Port
+)
+
+// Messages of the Fast Extension (BEP 6), only valid once both handshakes
+// set ReservedFast.
+const (
+	SuggestPiece MessageID = 0x0d + iota
+	HaveAll
+	HaveNone
+	RejectRequest
+	AllowedFast
+)
+
+// Extended carries BEP 10 extension messages, whose payload starts with the
+// extended message ID. It is only valid once both handshakes set
+// ReservedExtension.
+const Extended MessageID = 20
+
+// KeepAlive is not sent on the wire: it stands for the zero-length message.
+const KeepAlive MessageID = 0xff
+
+const (
+	MaxBlockLength          = 16 * 1024
+	DefaultMaxMessageLength = 1 << 17
+)
+
+func (id MessageID) String() string {
+	switch id {
+	case Choke:
+		return "choke"
+	case Unchoke:
+		return "unchoke"
+	case Interested:
+		return "interested"
+	case NotInterested:
+		return "not interested"
+	case Have:
+		return "have"
+	case BitfieldMsg:
+		return "bitfield"
+	case Request:
+		return "request"
+	case Piece:
+		return "piece"
+	case Cancel:
+		return "cancel"
+	case Port:
+		return "port"
+	case SuggestPiece:
+		return "suggest piece"
+	case HaveAll:
+		return "have all"
+	case HaveNone:
+		return "have none"
+	case RejectRequest:
+		return "reject request"
+	case AllowedFast:
+		return "allowed fast"
+	case Extended:
+		return "extended"
+	case KeepAlive:
+		return "keep-alive"
+	}
+	return fmt.Sprintf("message %d", uint8(id))
+}
+
+// Message is one peer wire message. Which fields are meaningful depends on
+// ID; messages this package does not know keep their body in Payload.
+type Message struct {
+	ID       MessageID
+	Index    uint32
+	Begin    uint32
+	Length   uint32
+	Bitfield Bitfield
+	Block    []byte
+	Port     uint16
+	Payload  []byte
+}
+
+func (m *Message) String() string {
+	switch m.ID {
+	case Have, SuggestPiece, AllowedFast:
+		return fmt.Sprintf("%s %d", m.ID, m.Index)
+	case Request, Cancel, RejectRequest:
+		return fmt.Sprintf("%s %d+%d:%d", m.ID, m.Index, m.Begin, m.Length)
+	case Piece:
+		return fmt.Sprintf("piece %d+%d:%d", m.Index, m.Begin, len(m.Block))
+	}
+	return m.ID.String()
+}
+
+// MarshalBinary encodes the message with its length prefix.
+func (m *Message) MarshalBinary() ([]byte, error) {
+	if m.ID == KeepAlive {
+		return []byte{0, 0, 0, 0}, nil
+	}
+
+	buf := make([]byte, 5, 17+len(m.Bitfield)+len(m.Block)+len(m.Payload))
+	buf[4] = byte(m.ID)
+	switch m.ID {
+	case Choke, Unchoke, Interested, NotInterested, HaveAll, HaveNone:
+	case Have, SuggestPiece, AllowedFast:
+		buf = binary.BigEndian.AppendUint32(buf, m.Index)
+	case BitfieldMsg:
+		buf = append(buf, m.Bitfield...)
+	case Request, Cancel, RejectRequest:
+		buf = binary.BigEndian.AppendUint32(buf, m.Index)
+		buf = binary.BigEndian.AppendUint32(buf, m.Begin)
+		buf = binary.BigEndian.AppendUint32(buf, m.Length)
+	case Piece:
+		buf = binary.BigEndian.AppendUint32(buf, m.Index)
+		buf = binary.BigEndian.AppendUint32(buf, m.Begin)
+		buf = append(buf, m.Block...)
+	case Port:
+		buf = binary.BigEndian.AppendUint16(buf, m.Port)
+	default:
+		buf = append(buf, m.Payload...)
+	}
+	binary.BigEndian.PutUint32(buf, uint32(len(buf)-4))
+	return buf, nil
+}
+
+func WriteMessage(w io.Writer, m *Message) (err error) {
+	buf, err := m.MarshalBinary()
+	if err != nil {
+		return
+	}
+	_, err = w.Write(buf)
+	return
+}
+
+// Decoder reads messages, rejecting any longer than MaxMessageLength, blocks
+// longer than MaxBlockLength and malformed fixed-size messages. When
+// NumPieces is set, piece indexes and bitfields are checked against it too.
+type Decoder struct {
+	MaxMessageLength int
+	NumPieces        int
+
+	r *bufio.Reader
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{MaxMessageLength: DefaultMaxMessageLength, r: bufio.NewReader(r)}
+}
+
+func (d *Decoder) Decode() (m *Message, err error) {
+	var prefix [4]byte
+	if _, err = io.ReadFull(d.r, prefix[:]); err != nil {
+		return
+	}
+	length := binary.BigEndian.Uint32(prefix[:])
+	if length == 0 {
+		return &Message{ID: KeepAlive}, nil
+	}
+	if length > uint32(d.MaxMessageLength) {
+		return nil, fmt.Errorf("Message of %d bytes exceeds limit of %d", length, d.MaxMessageLength)
+	}
+	body := make([]byte, length)
+	if _, err = io.ReadFull(d.r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	return d.parse(body)
+}
+
+func (d *Decoder) parse(body []byte) (m *Message, err error) {
+	m = &Message{ID: MessageID(body[0])}
+	payload := body[1:]
+
+	expected := -1
+	switch m.ID {
+	case Choke, Unchoke, Interested, NotInterested, HaveAll, HaveNone:
+		expected = 0
+	case Have, SuggestPiece, AllowedFast:
+		expected = 4
+	case Request, Cancel, RejectRequest:
+		expected = 12
+	case Port:
+		expected = 2
+	case Piece:
+		if len(payload) < 8 {
+			return nil, fmt.Errorf("Short piece message of %d bytes", len(payload))
+		}
+	}
+	if expected >= 0 && len(payload) != expected {
+		return nil, fmt.Errorf("Wrong length %d for %s message", len(payload), m.ID)
+	}
+
+	switch m.ID {
+	case Have, SuggestPiece, AllowedFast:
+		m.Index = binary.BigEndian.Uint32(payload)
+	case BitfieldMsg:
+		m.Bitfield = Bitfield(payload)
+		if d.NumPieces > 0 && !m.Bitfield.validFor(d.NumPieces) {
+			return nil, fmt.Errorf("Invalid bitfield of %d bytes for %d pieces", len(payload), d.NumPieces)
+		}
+	case Request, Cancel, RejectRequest:
+		m.Index = binary.BigEndian.Uint32(payload[0:])
+		m.Begin = binary.BigEndian.Uint32(payload[4:])
+		m.Length = binary.BigEndian.Uint32(payload[8:])
+		if m.Length == 0 || m.Length > MaxBlockLength {
+			return nil, fmt.Errorf("Invalid block length %d in %s message", m.Length, m.ID)
+		}
+	case Piece:
+		m.Index = binary.BigEndian.Uint32(payload[0:])
+		m.Begin = binary.BigEndian.Uint32(payload[4:])
+		m.Block = payload[8:]
+		if len(m.Block) > MaxBlockLength {
+			return nil, fmt.Errorf("Block of %d bytes exceeds limit of %d", len(m.Block), MaxBlockLength)
+		}
+	case Port:
+		m.Port = binary.BigEndian.Uint16(payload)
+	case Choke, Unchoke, Interested, NotInterested, HaveAll, HaveNone:
+	default:
+		m.Payload = payload
+	}
+
+	switch m.ID {
+	case Have, Request, Cancel, Piece, SuggestPiece, RejectRequest, AllowedFast:
+		if d.NumPieces > 0 && m.Index >= uint32(d.NumPieces) {
+			return nil, fmt.Errorf("Piece index %d out of range in %s message", m.Index, m.ID)
+		}
+	}
+	return
+}
@@ -0,0 +1,117 @@
+package peer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	bitfield := NewBitfield(12)
+	bitfield.Set(0)
+	bitfield.Set(11)
+	messages := []*Message{
+		{ID: KeepAlive},
+		{ID: Choke},
+		{ID: Unchoke},
+		{ID: Interested},
+		{ID: NotInterested},
+		{ID: Have, Index: 11},
+		{ID: BitfieldMsg, Bitfield: bitfield},
+		{ID: Request, Index: 3, Begin: 16384, Length: 16384},
+		{ID: Piece, Index: 3, Begin: 16384, Block: bytes.Repeat([]byte{7}, MaxBlockLength)},
+		{ID: Cancel, Index: 3, Begin: 16384, Length: 16384},
+		{ID: Port, Port: 6881},
+		{ID: SuggestPiece, Index: 2},
+		{ID: HaveAll},
+		{ID: HaveNone},
+		{ID: RejectRequest, Index: 3, Begin: 16384, Length: 16384},
+		{ID: AllowedFast, Index: 11},
+		{ID: Extended, Payload: []byte("\x00d1:md6:ut_pexi1eee")},
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go func() {
+		for _, m := range messages {
+			if err := WriteMessage(a, m); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	d := NewDecoder(b)
+	d.NumPieces = 12
+	for _, expected := range messages {
+		m, err := d.Decode()
+		if err != nil {
+			t.Fatalf("Decoding %s: %s", expected, err)
+		}
+		if !reflect.DeepEqual(m, expected) {
+			t.Errorf("Expected %s, got %s", expected, m)
+		}
+	}
+}
+
+func TestDecodeRejectsMalformedMessages(t *testing.T) {
+	frame := func(id MessageID, payload []byte) []byte {
+		buf := binary.BigEndian.AppendUint32(nil, uint32(1+len(payload)))
+		return append(append(buf, byte(id)), payload...)
+	}
+	request := func(index, begin, length uint32) []byte {
+		payload := binary.BigEndian.AppendUint32(nil, index)
+		payload = binary.BigEndian.AppendUint32(payload, begin)
+		return binary.BigEndian.AppendUint32(payload, length)
+	}
+
+	cases := map[string][]byte{
+		"oversized":           binary.BigEndian.AppendUint32(nil, DefaultMaxMessageLength+1),
+		"truncated":           frame(Have, []byte{0, 0, 0, 1})[:6],
+		"long choke":          frame(Choke, []byte{0}),
+		"short have":          frame(Have, []byte{0, 0, 1}),
+		"long request":        frame(Request, append(request(0, 0, 16384), 0)),
+		"zero length request": frame(Request, request(0, 0, 0)),
+		"huge request":        frame(Request, request(0, 0, MaxBlockLength+1)),
+		"huge cancel":         frame(Cancel, request(0, 0, 1<<20)),
+		"short piece":         frame(Piece, []byte{0, 0, 0, 0, 0, 0}),
+		"huge block":          frame(Piece, make([]byte, 8+MaxBlockLength+1)),
+		"short port":          frame(Port, []byte{1}),
+		"have out of range":   frame(Have, []byte{0, 0, 0, 12}),
+		"short bitfield":      frame(BitfieldMsg, []byte{0xff}),
+		"spare bitfield bits": frame(BitfieldMsg, []byte{0xff, 0xf8}),
+		"long have all":       frame(HaveAll, []byte{0}),
+		"short reject":        frame(RejectRequest, []byte{0, 0, 0, 1}),
+		"allowed fast range":  frame(AllowedFast, []byte{0, 0, 0, 12}),
+	}
+	for name, data := range cases {
+		d := NewDecoder(bytes.NewReader(data))
+		d.NumPieces = 12
+		if m, err := d.Decode(); err == nil {
+			t.Errorf("%s: expected error, got %s", name, m)
+		}
+	}
+}
+
+func TestBitfield(t *testing.T) {
+	b := NewBitfield(10)
+	if len(b) != 2 {
+		t.Fatalf("Expected 2 bytes, got %d", len(b))
+	}
+	b.Set(0)
+	b.Set(9)
+	b.Set(16)
+	if !b.Has(0) || !b.Has(9) || b.Has(1) || b.Has(16) || b.Count() != 2 {
+		t.Errorf("Unexpected bitfield %08b", b)
+	}
+	b.Clear(0)
+	if b.Has(0) || b.Count() != 1 {
+		t.Errorf("Unexpected bitfield %08b", b)
+	}
+	if !b.validFor(10) || b.validFor(9) || b.validFor(17) {
+		t.Errorf("Unexpected validity for %08b", b)
+	}
+}
@@ -0,0 +1,241 @@
+package btgo
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// PEX flags describing an added peer, as in BEP 11.
+const (
+	PexEncryption byte = 1 << iota
+	PexSeed
+	PexUTP
+	PexHolepunch
+	PexReachable
+)
+
+const (
+	pexInterval    = time.Minute
+	pexMinInterval = 45 * time.Second // accepted gap between messages from a peer
+	maxPexAdded    = 50
+	maxPexDropped  = 50
+	maxPexFound    = 200
+)
+
+// PexPeer is a peer's listening address and its PEX flags.
+type PexPeer struct {
+	Addr  PeerAddr
+	Flags byte
+}
+
+type pexMessage struct {
+	added   []PexPeer
+	dropped []PeerAddr
+}
+
+func (m *pexMessage) bytes() []byte {
+	var added []PeerAddr
+	flags, flags6 := []byte{}, []byte{}
+	for _, p := range m.added {
+		added = append(added, p.Addr)
+		if p.Addr.IP.To4() != nil {
+			flags = append(flags, p.Flags)
+		} else {
+			flags6 = append(flags6, p.Flags)
+		}
+	}
+	added4, added6 := compactPeers(added)
+	dropped4, dropped6 := compactPeers(m.dropped)
+	return []byte(Bencode(map[string]interface{}{
+		"added":    added4,
+		"added.f":  flags,
+		"added6":   added6,
+		"added6.f": flags6,
+		"dropped":  dropped4,
+		"dropped6": dropped6,
+	}))
+}
+
+func parsePexMessage(b []byte) (m *pexMessage, err error) {
+	buncoded, err := tryBuncode(b)
+	if err != nil {
+		return
+	}
+	d, ok := buncoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Unable to parse ut_pex message")
+	}
+
+	m = &pexMessage{}
+	for _, family := range []struct {
+		key   string
+		ipLen int
+	}{{"", net.IPv4len}, {"6", net.IPv6len}} {
+		added, err := parseCompactPeers(bytesFromInterface(d["added"+family.key]), family.ipLen)
+		if err != nil {
+			return nil, err
+		}
+		flags := bytesFromInterface(d["added"+family.key+".f"])
+		for i, addr := range added {
+			p := PexPeer{Addr: addr}
+			if len(flags) == len(added) {
+				p.Flags = flags[i]
+			}
+			m.added = append(m.added, p)
+		}
+		dropped, err := parseCompactPeers(bytesFromInterface(d["dropped"+family.key]), family.ipLen)
+		if err != nil {
+			return nil, err
+		}
+		m.dropped = append(m.dropped, dropped...)
+	}
+	return
+}
+
+type pexConn struct {
+	sent         map[string]PexPeer
+	lastSent     time.Time
+	lastReceived time.Time
+}
+
+// PexExtension implements BEP 11 ut_pex. Send tells connected peers about
+// the peers we are connected to, at most once a minute each, and Found hands
+// out the peers they told us about. Peers sending too often or too many
+// peers at once are only partly listened to.
+type PexExtension struct {
+	now func() time.Time
+
+	mu    sync.Mutex
+	conns map[*ExtensionConn]*pexConn
+	found []PeerAddr
+}
+
+func NewPexExtension() *PexExtension {
+	return &PexExtension{now: time.Now, conns: make(map[*ExtensionConn]*pexConn)}
+}
+
+func (e *PexExtension) Name() string {
+	return "ut_pex"
+}
+
+func (e *PexExtension) Connected(c *ExtensionConn) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.conns[c] = &pexConn{sent: make(map[string]PexPeer)}
+}
+
+func (e *PexExtension) Disconnected(c *ExtensionConn) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.conns, c)
+}
+
+func (e *PexExtension) Handle(c *ExtensionConn, payload []byte) error {
+	m, err := parsePexMessage(payload)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	state := e.conns[c]
+	if state == nil {
+		return nil
+	}
+	now := e.now()
+	if !state.lastReceived.IsZero() && now.Sub(state.lastReceived) < pexMinInterval {
+		return nil
+	}
+	state.lastReceived = now
+
+	dropped := make(map[string]bool, len(m.dropped))
+	for _, addr := range m.dropped {
+		dropped[addr.String()] = true
+	}
+	found := e.found[:0]
+	for _, addr := range e.found {
+		if !dropped[addr.String()] {
+			found = append(found, addr)
+		}
+	}
+	for i, p := range m.added {
+		if i >= maxPexAdded || len(found) >= maxPexFound {
+			break
+		}
+		if p.Addr.Port > 0 && !p.Addr.IP.IsUnspecified() {
+			found = append(found, p.Addr)
+		}
+	}
+	e.found = found
+	return nil
+}
+
+// Found returns and forgets the peers learnt through PEX.
+func (e *PexExtension) Found() (peers []PeerAddr) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	peers, e.found = e.found, nil
+	return
+}
+
+// Send tells every peer that is due a message which of current have been
+// added and which dropped since its last one. A peer is never told about
+// itself.
+func (e *PexExtension) Send(current []PexPeer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := e.now()
+	for c, state := range e.conns {
+		if !state.lastSent.IsZero() && now.Sub(state.lastSent) < pexInterval {
+			continue
+		}
+		self := pexListenAddrs(c)
+
+		m := &pexMessage{}
+		keep := make(map[string]bool, len(current))
+		for _, p := range current {
+			key := p.Addr.String()
+			if self[key] {
+				continue
+			}
+			keep[key] = true
+			if _, ok := state.sent[key]; !ok && len(m.added) < maxPexAdded {
+				m.added = append(m.added, p)
+			}
+		}
+		for key, p := range state.sent {
+			if !keep[key] && len(m.dropped) < maxPexDropped {
+				m.dropped = append(m.dropped, p.Addr)
+			}
+		}
+		if len(m.added) == 0 && len(m.dropped) == 0 {
+			continue
+		}
+		if c.Send(e.Name(), m.bytes()) != nil {
+			continue
+		}
+		state.lastSent = now
+		for _, p := range m.added {
+			state.sent[p.Addr.String()] = p
+		}
+		for _, addr := range m.dropped {
+			delete(state.sent, addr.String())
+		}
+	}
+}
+
+// pexListenAddrs are the addresses a peer may be listed under: the one it
+// connected from and its listening port from the extended handshake.
+func pexListenAddrs(c *ExtensionConn) map[string]bool {
+	addrs := make(map[string]bool)
+	tcp, ok := c.Conn().RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return addrs
+	}
+	addrs[PeerAddr{IP: tcp.IP, Port: tcp.Port}.String()] = true
+	if remote := c.Remote(); remote != nil && remote.P > 0 {
+		addrs[PeerAddr{IP: tcp.IP, Port: remote.P}.String()] = true
+	}
+	return addrs
+}
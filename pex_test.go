@@ -0,0 +1,166 @@
+package btgo
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mopsled/btgo/peer"
+)
+
+func TestPexMessageRoundTrip(t *testing.T) {
+	m := &pexMessage{
+		added: []PexPeer{
+			{PeerAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 6881}, PexSeed | PexReachable},
+			{PeerAddr{IP: net.ParseIP("2001:db8::1"), Port: 51413}, PexEncryption},
+			{PeerAddr{IP: net.IPv4(10, 0, 0, 2).To4(), Port: 6882}, 0},
+		},
+		dropped: []PeerAddr{{IP: net.IPv4(10, 0, 0, 3).To4(), Port: 6883}},
+	}
+	parsed, err := parsePexMessage(m.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.added) != 3 || len(parsed.dropped) != 1 {
+		t.Fatalf("Unexpected message %+v", parsed)
+	}
+	if a := parsed.added[0]; a.Addr.String() != "10.0.0.1:6881" || a.Flags != PexSeed|PexReachable {
+		t.Errorf("Unexpected first peer %+v", a)
+	}
+	if a := parsed.added[1]; a.Addr.String() != "10.0.0.2:6882" || a.Flags != 0 {
+		t.Errorf("Unexpected second IPv4 peer %+v", a)
+	}
+	if a := parsed.added[2]; a.Addr.String() != "[2001:db8::1]:51413" || a.Flags != PexEncryption {
+		t.Errorf("Unexpected IPv6 peer %+v", a)
+	}
+	if parsed.dropped[0].String() != "10.0.0.3:6883" {
+		t.Errorf("Unexpected dropped peer %v", parsed.dropped[0])
+	}
+
+	if _, err = parsePexMessage([]byte("d5:added5:abcdee")); err == nil {
+		t.Error("Expected error for truncated compact peers")
+	}
+}
+
+// tcpPair connects two PeerConns over loopback TCP.
+func tcpPair(t *testing.T) (a, b *peer.PeerConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	left, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	right, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b = peer.NewPeerConn(left, 0), peer.NewPeerConn(right, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	a.Start(ctx)
+	b.Start(ctx)
+	return
+}
+
+func TestPexExtensionExchange(t *testing.T) {
+	a, b := tcpPair(t)
+	clock := &struct{ t time.Time }{time.Unix(1000, 0)}
+	pa, pb := NewPexExtension(), NewPexExtension()
+	pa.now = func() time.Time { return clock.t }
+	pb.now = pa.now
+	ra, rb := NewExtensionRegistry(), NewExtensionRegistry()
+	ra.Register(pa)
+	rb.Register(pb)
+	ea, eb := ra.NewConn(a), rb.NewConn(b)
+	ea.SendHandshake(ExtensionHandshake{})
+	eb.SendHandshake(ExtensionHandshake{P: 7000})
+	eb.Handle(receiveExtended(t, b))
+	ea.Handle(receiveExtended(t, a))
+
+	// b's own address is never sent back to it.
+	bAddr := a.RemoteAddr().(*net.TCPAddr)
+	current := []PexPeer{
+		{PeerAddr{IP: bAddr.IP, Port: 7000}, 0},
+		{PeerAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 6881}, PexReachable},
+		{PeerAddr{IP: net.IPv4(10, 0, 0, 2).To4(), Port: 6882}, PexSeed},
+	}
+	pa.Send(current)
+	if err := eb.Handle(receiveExtended(t, b)); err != nil {
+		t.Fatal(err)
+	}
+	found := pb.Found()
+	if len(found) != 2 || found[0].String() != "10.0.0.1:6881" || found[1].String() != "10.0.0.2:6882" {
+		t.Errorf("Unexpected peers found %v", found)
+	}
+	if len(pb.Found()) != 0 {
+		t.Error("Expected found peers to be forgotten")
+	}
+
+	// Nothing more is sent within the interval, then only the difference.
+	pa.Send(current[:2])
+	clock.t = clock.t.Add(pexInterval)
+	pa.Send([]PexPeer{current[0], current[1], {PeerAddr{IP: net.IPv4(10, 0, 0, 4).To4(), Port: 6884}, 0}})
+	m, err := parsePexMessage(receiveExtended(t, b).Payload[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.added) != 1 || m.added[0].Addr.String() != "10.0.0.4:6884" || len(m.dropped) != 1 || m.dropped[0].String() != "10.0.0.2:6882" {
+		t.Errorf("Unexpected update %+v", m)
+	}
+}
+
+func TestPexExtensionRateLimits(t *testing.T) {
+	a, _ := tcpPair(t)
+	now := time.Unix(1000, 0)
+	pex := NewPexExtension()
+	pex.now = func() time.Time { return now }
+	r := NewExtensionRegistry()
+	r.Register(pex)
+	c := r.NewConn(a)
+	c.Handle(&peer.Message{ID: peer.Extended, Payload: append([]byte{0}, "d1:md6:ut_pexi1eee"...)})
+
+	var many []PexPeer
+	for i := 0; i < 2*maxPexAdded; i++ {
+		many = append(many, PexPeer{Addr: PeerAddr{IP: net.IPv4(10, 0, 1, byte(i)).To4(), Port: 6881}})
+	}
+	if err := pex.Handle(c, (&pexMessage{added: many}).bytes()); err != nil {
+		t.Fatal(err)
+	}
+	pex.Handle(c, (&pexMessage{added: many[:1]}).bytes())
+	if found := pex.Found(); len(found) != maxPexAdded {
+		t.Errorf("Expected %d peers from one message, got %d", maxPexAdded, len(found))
+	}
+
+	// Dropped peers not yet dialed are forgotten.
+	now = now.Add(pexMinInterval)
+	pex.Handle(c, (&pexMessage{added: many[:2]}).bytes())
+	now = now.Add(pexMinInterval)
+	pex.Handle(c, (&pexMessage{dropped: []PeerAddr{many[0].Addr}}).bytes())
+	if found := pex.Found(); len(found) != 1 || found[0].String() != many[1].Addr.String() {
+		t.Errorf("Expected only the undropped peer, got %v", found)
+	}
+}
+
+func TestPrivateTorrentsDisablePex(t *testing.T) {
+	info := map[string]interface{}{"name": "private", "piece length": 16384, "length": 1, "pieces": make([]byte, 20), "private": 1}
+	private, err := NewTorfile([]byte(Bencode(map[string]interface{}{"announce": "http://tracker.example/announce", "info": info})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(info, "private")
+	public, err := NewTorfile([]byte(Bencode(map[string]interface{}{"announce": "http://tracker.example/announce", "info": info})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tor := newTorrent(nil, private, NewMemoryStorage(private)); tor.pex != nil || tor.Extensions.Extension("ut_pex") != nil {
+		t.Error("Expected no ut_pex for a private torrent")
+	}
+	if tor := newTorrent(nil, public, NewMemoryStorage(public)); tor.pex == nil || tor.Extensions.Extension("ut_pex") == nil {
+		t.Error("Expected ut_pex for a public torrent")
+	}
+}
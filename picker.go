@@ -0,0 +1,308 @@
+package btgo
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/mopsled/btgo/peer"
+)
+
+type FilePriority int
+
+const (
+	PrioritySkip   FilePriority = -1
+	PriorityNormal FilePriority = 0
+	PriorityHigh   FilePriority = 1
+)
+
+const blockLength = peer.MaxBlockLength
+
+// PiecePicker decides which blocks to request from which peer. It counts how
+// many peers have each piece and picks rarest-first with random tie-breaking,
+// except for a random first piece, or lowest index first in Sequential mode.
+// Pieces already started are finished before new ones, and higher priority
+// files go before lower ones. Once every missing block has been requested it
+// enters endgame and hands out duplicate requests, reporting which peers to
+// cancel when a block arrives.
+//
+// Peers are identified by an arbitrary key, such as their address. The
+// picker is not safe for concurrent use.
+type PiecePicker struct {
+	Sequential bool
+
+	tfile         *Torfile
+	filePriority  []FilePriority
+	piecePriority []FilePriority
+	availability  []int
+	have          peer.Bitfield
+	partial       map[int]*pickerPiece
+	rand          *rand.Rand
+}
+
+type pickerPiece struct {
+	received    []bool
+	requested   []map[string]bool
+	numReceived int
+}
+
+func NewPiecePicker(tfile *Torfile) *PiecePicker {
+	p := &PiecePicker{
+		tfile:         tfile,
+		filePriority:  make([]FilePriority, len(tfile.files)),
+		piecePriority: make([]FilePriority, tfile.numPieces()),
+		availability:  make([]int, tfile.numPieces()),
+		have:          peer.NewBitfield(tfile.numPieces()),
+		partial:       make(map[int]*pickerPiece),
+		rand:          rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	p.updatePiecePriorities()
+	return p
+}
+
+// SetFilePriority changes the priority of the file at the given index of the
+// torfile's files. Pieces shared by several files take the highest priority
+// among them, so a skipped file's boundary pieces may still be downloaded.
+func (p *PiecePicker) SetFilePriority(file int, priority FilePriority) error {
+	if file < 0 || file >= len(p.filePriority) {
+		return errors.New("File index out of range")
+	}
+	p.filePriority[file] = priority
+	p.updatePiecePriorities()
+	return nil
+}
+
+func (p *PiecePicker) updatePiecePriorities() {
+	for i := range p.piecePriority {
+		p.piecePriority[i] = PrioritySkip
+	}
+	var offset int64
+	for i, f := range p.tfile.files {
+		if f.length > 0 && p.tfile.pieceLength > 0 {
+			first, last := offset/p.tfile.pieceLength, (offset+f.length-1)/p.tfile.pieceLength
+			for piece := first; piece <= last && piece < int64(len(p.piecePriority)); piece++ {
+				if p.filePriority[i] > p.piecePriority[piece] {
+					p.piecePriority[piece] = p.filePriority[i]
+				}
+			}
+		}
+		offset += f.length
+	}
+}
+
+// PeerHave counts a newly connected peer's bitfield towards availability.
+func (p *PiecePicker) PeerHave(has peer.Bitfield) {
+	for i := range p.availability {
+		if has.Has(i) {
+			p.availability[i]++
+		}
+	}
+}
+
+// PeerHas counts a peer's have message towards availability.
+func (p *PiecePicker) PeerHas(index int) {
+	if index >= 0 && index < len(p.availability) {
+		p.availability[index]++
+	}
+}
+
+// PeerGone forgets a disconnected peer's pieces and requests.
+func (p *PiecePicker) PeerGone(from string, has peer.Bitfield) {
+	for i := range p.availability {
+		if has.Has(i) && p.availability[i] > 0 {
+			p.availability[i]--
+		}
+	}
+	for _, piece := range p.partial {
+		for _, requesters := range piece.requested {
+			delete(requesters, from)
+		}
+	}
+}
+
+func (p *PiecePicker) wanted(index int) bool {
+	return !p.have.Has(index) && p.piecePriority[index] != PrioritySkip
+}
+
+// Interesting reports whether a peer with the given pieces has any we want.
+func (p *PiecePicker) Interesting(has peer.Bitfield) bool {
+	for i := range p.piecePriority {
+		if p.wanted(i) && has.Has(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// Done reports whether every piece not skipped has been verified.
+func (p *PiecePicker) Done() bool {
+	for i := range p.piecePriority {
+		if p.wanted(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// Have returns a copy of the verified pieces.
+func (p *PiecePicker) Have() peer.Bitfield {
+	return append(peer.Bitfield(nil), p.have...)
+}
+
+// Has reports whether the piece has been verified.
+func (p *PiecePicker) Has(index int) bool {
+	return p.have.Has(index)
+}
+
+// Endgame reports whether every missing block has been requested at least
+// once.
+func (p *PiecePicker) Endgame() bool {
+	for i := range p.piecePriority {
+		if !p.wanted(i) {
+			continue
+		}
+		piece := p.partial[i]
+		if piece == nil {
+			return false
+		}
+		for j, received := range piece.received {
+			if !received && len(piece.requested[j]) == 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Pick returns up to n blocks to request from the peer and records them as
+// requested by it.
+func (p *PiecePicker) Pick(from string, has peer.Bitfield, n int) (blocks []peer.Block) {
+	order := p.candidates(has)
+	for _, index := range order {
+		if len(blocks) == n {
+			return
+		}
+		piece := p.piece(index)
+		for j, received := range piece.received {
+			if len(blocks) < n && !received && len(piece.requested[j]) == 0 {
+				piece.requested[j][from] = true
+				blocks = append(blocks, p.block(index, j))
+			}
+		}
+	}
+	if len(blocks) == n || !p.Endgame() {
+		return
+	}
+	for _, index := range order {
+		piece := p.partial[index]
+		for j, received := range piece.received {
+			if len(blocks) < n && !received && !piece.requested[j][from] {
+				piece.requested[j][from] = true
+				blocks = append(blocks, p.block(index, j))
+			}
+		}
+	}
+	return
+}
+
+// candidates lists the wanted pieces the peer has, best first.
+func (p *PiecePicker) candidates(has peer.Bitfield) (order []int) {
+	for i := range p.piecePriority {
+		if p.wanted(i) && has.Has(i) {
+			order = append(order, i)
+		}
+	}
+	if p.Sequential {
+		return
+	}
+
+	randomFirst := p.have.Count() == 0 && len(p.partial) == 0
+	p.rand.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if p.piecePriority[a] != p.piecePriority[b] {
+			return p.piecePriority[a] > p.piecePriority[b]
+		}
+		if startedA, startedB := p.partial[a] != nil, p.partial[b] != nil; startedA != startedB {
+			return startedA
+		}
+		return !randomFirst && p.availability[a] < p.availability[b]
+	})
+	return
+}
+
+func (p *PiecePicker) piece(index int) *pickerPiece {
+	piece := p.partial[index]
+	if piece == nil {
+		n := int((p.tfile.pieceSize(index) + blockLength - 1) / blockLength)
+		piece = &pickerPiece{received: make([]bool, n), requested: make([]map[string]bool, n)}
+		for j := range piece.requested {
+			piece.requested[j] = make(map[string]bool)
+		}
+		p.partial[index] = piece
+	}
+	return piece
+}
+
+func (p *PiecePicker) block(index, j int) peer.Block {
+	begin := int64(j) * blockLength
+	length := p.tfile.pieceSize(index) - begin
+	if length > blockLength {
+		length = blockLength
+	}
+	return peer.Block{Index: uint32(index), Begin: uint32(begin), Length: uint32(length)}
+}
+
+// lookup finds the state of a block handed out by Pick.
+func (p *PiecePicker) lookup(b peer.Block) (piece *pickerPiece, j int, ok bool) {
+	piece = p.partial[int(b.Index)]
+	j = int(b.Begin / blockLength)
+	if piece == nil || b.Begin%blockLength != 0 || j >= len(piece.received) || p.block(int(b.Index), j) != b {
+		return nil, 0, false
+	}
+	return piece, j, true
+}
+
+// BlockReceived marks a block as received, returning the other peers it was
+// requested from, which should be sent a cancel, and whether that completed
+// its piece, which should then be verified. Blocks that were not requested or
+// already arrived are ignored.
+func (p *PiecePicker) BlockReceived(from string, b peer.Block) (cancel []string, pieceDone bool) {
+	piece, j, ok := p.lookup(b)
+	if !ok || piece.received[j] {
+		return
+	}
+	for requester := range piece.requested[j] {
+		if requester != from {
+			cancel = append(cancel, requester)
+		}
+	}
+	sort.Strings(cancel)
+	piece.received[j] = true
+	piece.requested[j] = make(map[string]bool)
+	piece.numReceived++
+	pieceDone = piece.numReceived == len(piece.received)
+	return
+}
+
+// BlockDropped returns a block that the peer will not send, after a timeout,
+// choke or reject, to the pool.
+func (p *PiecePicker) BlockDropped(from string, b peer.Block) {
+	if piece, j, ok := p.lookup(b); ok {
+		delete(piece.requested[j], from)
+	}
+}
+
+// PieceVerified records a piece as complete, whether downloaded and hashed or
+// found on disk.
+func (p *PiecePicker) PieceVerified(index int) {
+	p.have.Set(index)
+	delete(p.partial, index)
+}
+
+// PieceFailed throws away a piece that did not match its hash so that it is
+// downloaded again.
+func (p *PiecePicker) PieceFailed(index int) {
+	delete(p.partial, index)
+}
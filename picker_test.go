@@ -0,0 +1,172 @@
+package btgo
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/mopsled/btgo/peer"
+)
+
+// pickerTorfile has pieces of two blocks, the last one a single short block.
+func pickerTorfile(numPieces int, fileLengths ...int64) *Torfile {
+	tfile := &Torfile{pieceLength: 2 * blockLength, pieces: make([][]byte, numPieces)}
+	for _, length := range fileLengths {
+		tfile.files = append(tfile.files, File{"f", length})
+	}
+	return tfile
+}
+
+func fullBitfield(pieces int) peer.Bitfield {
+	b := peer.NewBitfield(pieces)
+	for i := 0; i < pieces; i++ {
+		b.Set(i)
+	}
+	return b
+}
+
+func bitfieldOf(pieces int, have ...int) peer.Bitfield {
+	b := peer.NewBitfield(pieces)
+	for _, i := range have {
+		b.Set(i)
+	}
+	return b
+}
+
+func TestPickerBlocks(t *testing.T) {
+	p := NewPiecePicker(pickerTorfile(2, 3*blockLength-100))
+	p.Sequential = true
+	blocks := p.Pick("a", fullBitfield(2), 10)
+	expected := []peer.Block{
+		{Index: 0, Begin: 0, Length: blockLength},
+		{Index: 0, Begin: blockLength, Length: blockLength},
+		{Index: 1, Begin: 0, Length: blockLength - 100},
+	}
+	if !sameSlice(blocks, expected) {
+		t.Errorf("Expected %v, got %v", expected, blocks)
+	}
+	if more := p.Pick("b", fullBitfield(2), 10); len(more) != 3 {
+		t.Errorf("Expected endgame duplicates, got %v", more)
+	}
+}
+
+func TestPickerRandomFirstThenRarest(t *testing.T) {
+	firsts := make(map[uint32]bool)
+	for seed := int64(0); seed < 20; seed++ {
+		p := NewPiecePicker(pickerTorfile(8, 16*blockLength))
+		p.rand = rand.New(rand.NewSource(seed))
+		p.PeerHave(fullBitfield(8))
+		p.PeerHave(bitfieldOf(8, 0, 1, 2, 3, 4, 5, 6))
+		firsts[p.Pick("a", fullBitfield(8), 1)[0].Index] = true
+	}
+	if len(firsts) < 3 {
+		t.Errorf("Expected a random first piece, got %v", firsts)
+	}
+
+	p := NewPiecePicker(pickerTorfile(8, 16*blockLength))
+	p.PeerHave(fullBitfield(8))
+	p.PeerHave(bitfieldOf(8, 0, 1, 2, 3, 4, 5, 6))
+	p.PeerHave(bitfieldOf(8, 0, 1, 2, 3, 4, 6))
+	p.PieceVerified(0)
+	if !p.Has(0) || p.Has(1) {
+		t.Error("Expected only piece 0 to be verified")
+	}
+	if blocks := p.Pick("a", fullBitfield(8), 2); blocks[0].Index != 7 || blocks[1].Index != 7 {
+		t.Errorf("Expected rarest piece 7, got %v", blocks)
+	}
+	if blocks := p.Pick("a", fullBitfield(8), 2); blocks[0].Index != 5 {
+		t.Errorf("Expected next rarest piece 5, got %v", blocks)
+	}
+
+	// A started piece is finished before a rarer one is begun.
+	p.Pick("b", bitfieldOf(8, 4), 1)
+	if blocks := p.Pick("c", fullBitfield(8), 1); blocks[0].Index != 4 {
+		t.Errorf("Expected started piece 4, got %v", blocks)
+	}
+}
+
+func TestPickerPriorities(t *testing.T) {
+	// Three files of one and a half pieces each over five pieces.
+	p := NewPiecePicker(pickerTorfile(5, 3*blockLength, 3*blockLength, 3*blockLength))
+	p.Sequential = true
+	p.SetFilePriority(0, PrioritySkip)
+	p.SetFilePriority(2, PriorityHigh)
+	if err := p.SetFilePriority(3, PriorityHigh); err == nil {
+		t.Error("Expected error for out of range file")
+	}
+
+	expected := []int{piecePriorityOf(p, 0), piecePriorityOf(p, 1), piecePriorityOf(p, 2), piecePriorityOf(p, 3), piecePriorityOf(p, 4)}
+	if !sameSlice(expected, []int{-1, 0, 0, 1, 1}) {
+		t.Errorf("Unexpected piece priorities %v", expected)
+	}
+
+	p.Sequential = false
+	if blocks := p.Pick("a", fullBitfield(5), 4); blocks[0].Index < 3 || blocks[2].Index < 3 {
+		t.Errorf("Expected high priority pieces first, got %v", blocks)
+	}
+	if p.Interesting(bitfieldOf(5, 0)) {
+		t.Error("Expected skipped piece not to be interesting")
+	}
+	for i := 1; i < 5; i++ {
+		p.PieceVerified(i)
+	}
+	if !p.Done() {
+		t.Error("Expected picker to be done without the skipped file")
+	}
+}
+
+func piecePriorityOf(p *PiecePicker, index int) int {
+	return int(p.piecePriority[index])
+}
+
+func TestPickerSequential(t *testing.T) {
+	p := NewPiecePicker(pickerTorfile(6, 12*blockLength))
+	p.Sequential = true
+	p.PeerHave(bitfieldOf(6, 5))
+	var indexes []uint32
+	for _, b := range p.Pick("a", bitfieldOf(6, 1, 2, 4, 5), 6) {
+		indexes = append(indexes, b.Index)
+	}
+	if !sameSlice(indexes, []uint32{1, 1, 2, 2, 4, 4}) {
+		t.Errorf("Expected sequential pieces, got %v", indexes)
+	}
+}
+
+func TestPickerEndgame(t *testing.T) {
+	p := NewPiecePicker(pickerTorfile(2, 4*blockLength))
+	p.Sequential = true
+	all := fullBitfield(2)
+	first := p.Pick("a", all, 3)
+	if p.Endgame() {
+		t.Error("Unexpected endgame with unrequested blocks")
+	}
+	last := p.Pick("b", all, 3)
+	if len(last) != 3 || !p.Endgame() {
+		t.Fatalf("Expected endgame duplicates, got %v", last)
+	}
+	if blocks := p.Pick("b", all, 3); len(blocks) != 1 || blocks[0] != first[2] {
+		t.Errorf("Expected the last duplicate, got %v", blocks)
+	}
+	if p.Pick("b", all, 3) != nil {
+		t.Error("Expected no further duplicates for the same peer")
+	}
+
+	cancel, done := p.BlockReceived("b", first[0])
+	if !sameSlice(cancel, []string{"a"}) {
+		t.Errorf("Expected to cancel a, got %v", cancel)
+	}
+	if cancel, _ = p.BlockReceived("a", first[0]); cancel != nil {
+		t.Errorf("Expected duplicate block to be ignored, got %v", cancel)
+	}
+	if _, done = p.BlockReceived("b", first[1]); !done {
+		t.Error("Expected first piece to be complete")
+	}
+
+	p.PieceFailed(int(first[0].Index))
+	if p.Endgame() {
+		t.Error("Expected failed piece to leave endgame")
+	}
+	p.BlockDropped("b", peer.Block{Index: 9})
+	if blocks := p.Pick("c", all, 2); !sameSlice(blocks, first[:2]) {
+		t.Errorf("Expected the failed piece again, got %v", blocks)
+	}
+}
@@ -0,0 +1,145 @@
+package btgo
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/mopsled/btgo/peer"
+)
+
+// ResumeData is what a session remembers about a torrent between runs so
+// that it need not rehash data that has not changed since.
+type ResumeData struct {
+	InfoHash   []byte
+	Completed  peer.Bitfield
+	Files      []ResumeFile
+	Uploaded   int64
+	Downloaded int64
+	Peers      []PeerAddr
+}
+
+// ResumeFile records a file's size and modification time when the resume
+// data was saved.
+type ResumeFile struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// Bytes bencodes the resume data.
+func (r *ResumeData) Bytes() []byte {
+	files := make([]interface{}, len(r.Files))
+	for i, f := range r.Files {
+		files[i] = map[string]interface{}{"size": f.Size, "mtime": f.ModTime.UnixNano()}
+	}
+	v4, v6 := compactPeers(r.Peers)
+	return []byte(Bencode(map[string]interface{}{
+		"info-hash":  r.InfoHash,
+		"pieces":     []byte(r.Completed),
+		"files":      files,
+		"uploaded":   r.Uploaded,
+		"downloaded": r.Downloaded,
+		"peers":      v4,
+		"peers6":     v6,
+	}))
+}
+
+// ParseResumeData decodes resume data written by ResumeData.Bytes.
+func ParseResumeData(b []byte) (r *ResumeData, err error) {
+	buncoded, err := tryBuncode(b)
+	if err != nil {
+		return
+	}
+	m, ok := buncoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Unable to parse resume data")
+	}
+
+	r = &ResumeData{InfoHash: bytesFromInterface(m["info-hash"]), Completed: peer.Bitfield(bytesFromInterface(m["pieces"]))}
+	if len(r.InfoHash) != 20 {
+		return nil, errors.New("Unable to parse infohash in resume data")
+	}
+	if r.Uploaded, err = int64FromInterface(m["uploaded"], "uploaded total in resume data"); err != nil {
+		return nil, err
+	}
+	if r.Downloaded, err = int64FromInterface(m["downloaded"], "downloaded total in resume data"); err != nil {
+		return nil, err
+	}
+
+	files, ok := m["files"].([]interface{})
+	if !ok {
+		return nil, errors.New("Unable to parse files in resume data")
+	}
+	for _, e := range files {
+		f, ok := e.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("Unable to parse file in resume data")
+		}
+		var size, mtime int64
+		if size, err = int64FromInterface(f["size"], "file size in resume data"); err != nil {
+			return nil, err
+		}
+		if mtime, err = int64FromInterface(f["mtime"], "file mtime in resume data"); err != nil {
+			return nil, err
+		}
+		r.Files = append(r.Files, ResumeFile{size, time.Unix(0, mtime)})
+	}
+
+	var peers, peers6 []PeerAddr
+	if peers, err = parseCompactPeers(bytesFromInterface(m["peers"]), 4); err != nil {
+		return nil, err
+	}
+	if peers6, err = parseCompactPeers(bytesFromInterface(m["peers6"]), 16); err != nil {
+		return nil, err
+	}
+	r.Peers = append(peers, peers6...)
+	return
+}
+
+// statResumeFiles records the current size and modification time of files.
+func statResumeFiles(paths []string) (files []ResumeFile, err error) {
+	for _, path := range paths {
+		var info os.FileInfo
+		if info, err = os.Stat(path); err != nil {
+			return
+		}
+		files = append(files, ResumeFile{info.Size(), info.ModTime()})
+	}
+	return
+}
+
+// validFor checks the resume data against a torfile and the files on disk
+// without reading them: it is only trusted if every file still has the size
+// and modification time it had when the data was saved.
+func (r *ResumeData) validFor(tfile *Torfile, paths []string) error {
+	if !bytes.Equal(r.InfoHash, tfile.infoHash) {
+		return errors.New("Resume data is for another torrent")
+	}
+	if len(r.Completed) != len(peer.NewBitfield(tfile.numPieces())) || len(r.Files) != len(paths) {
+		return errors.New("Resume data does not match torrent layout")
+	}
+	current, err := statResumeFiles(paths)
+	if err != nil {
+		return err
+	}
+	for i, f := range current {
+		if f.Size != r.Files[i].Size || !f.ModTime.Equal(r.Files[i].ModTime) {
+			return errors.New("Files changed since resume data was saved")
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic replaces path with data so that a crash leaves either the
+// old or the new contents.
+func writeFileAtomic(path string, data []byte) (err error) {
+	if err = ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+	}
+	return
+}
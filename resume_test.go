@@ -0,0 +1,104 @@
+package btgo
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mopsled/btgo/peer"
+)
+
+func TestResumeDataRoundTrip(t *testing.T) {
+	completed := peer.NewBitfield(10)
+	completed.Set(0)
+	completed.Set(9)
+	r := &ResumeData{
+		InfoHash:   bytes.Repeat([]byte{7}, 20),
+		Completed:  completed,
+		Files:      []ResumeFile{{1000, time.Unix(1500000000, 123)}, {0, time.Unix(0, 0)}},
+		Uploaded:   1 << 40,
+		Downloaded: 12345,
+		Peers:      []PeerAddr{{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 6881}, {IP: net.ParseIP("2001:db8::1"), Port: 51413}},
+	}
+	parsed, err := ParseResumeData(r.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(parsed.InfoHash, r.InfoHash) || !bytes.Equal(parsed.Completed, r.Completed) {
+		t.Errorf("Unexpected infohash or pieces %x %x", parsed.InfoHash, parsed.Completed)
+	}
+	if parsed.Uploaded != r.Uploaded || parsed.Downloaded != r.Downloaded {
+		t.Errorf("Unexpected totals %d %d", parsed.Uploaded, parsed.Downloaded)
+	}
+	if len(parsed.Files) != 2 || parsed.Files[0].Size != 1000 || !parsed.Files[0].ModTime.Equal(r.Files[0].ModTime) {
+		t.Errorf("Unexpected files %+v", parsed.Files)
+	}
+	if len(parsed.Peers) != 2 || !parsed.Peers[0].IP.Equal(r.Peers[0].IP) || parsed.Peers[1].Port != 51413 {
+		t.Errorf("Unexpected peers %+v", parsed.Peers)
+	}
+
+	if _, err = ParseResumeData([]byte("d9:info-hash3:abce")); err == nil {
+		t.Error("Expected error for short infohash")
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btgo-resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tfile := generatedTorrent(t, dir, "http://127.0.0.1:1/announce")
+
+	s := newTestSession(t)
+	s.ResumeDir = filepath.Join(dir, "resume")
+	tor, err := s.AddTorrent(tfile, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tor.Stop()
+	if _, err = os.Stat(tor.resumePath); err != nil {
+		t.Fatalf("Expected resume data to be saved on stop: %v", err)
+	}
+
+	// Corrupt a piece without changing the file's size or mtime: resume
+	// data is trusted, so the piece still counts as done.
+	path := filepath.Join(dir, "generated", "first.bin")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt(make([]byte, 100), 0)
+	f.Close()
+	os.Chtimes(path, info.ModTime(), info.ModTime())
+
+	resumed := newTestSession(t)
+	resumed.ResumeDir = s.ResumeDir
+	tor, err = resumed.AddTorrent(tfile, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := tor.Stats(); stats.PiecesDone != stats.Pieces {
+		t.Errorf("Expected resume data to skip the recheck, got %+v", tor.Stats())
+	}
+
+	// Once the mtime moves on, the files are rehashed.
+	os.Chtimes(path, info.ModTime().Add(time.Second), info.ModTime().Add(time.Second))
+	rechecked := newTestSession(t)
+	rechecked.ResumeDir = s.ResumeDir
+	tor, err = rechecked.AddTorrent(tfile, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := tor.Stats(); stats.PiecesDone != stats.Pieces-1 {
+		t.Errorf("Expected changed file to be rechecked, got %+v", stats)
+	}
+}
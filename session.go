@@ -0,0 +1,152 @@
+package btgo
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mopsled/btgo/peer"
+)
+
+const (
+	sessionTick      = time.Second
+	handshakeTimeout = 10 * time.Second
+	peerIDPrefix     = "-BG0001-"
+)
+
+var (
+	ErrTorrentExists = errors.New("Torrent already added to session")
+	ErrSessionClosed = errors.New("Session is closed")
+)
+
+// Session downloads and seeds torrents, accepting peer connections for all of
+// them on one listening port. With ResumeDir set, each torrent's progress is
+// saved there when it is paused or stopped, and picked up by AddTorrent
+// instead of rehashing files that have not changed.
+type Session struct {
+	PeerID    [20]byte
+	ResumeDir string
+
+	listener net.Listener
+	tick     time.Duration
+
+	mu       sync.Mutex
+	torrents map[string]*Torrent
+	closed   bool
+}
+
+// NewSession listens on listenAddr, such as ":6881", for incoming peers.
+func NewSession(listenAddr string) (s *Session, err error) {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return
+	}
+	s = &Session{listener: listener, tick: sessionTick, torrents: make(map[string]*Torrent)}
+	copy(s.PeerID[:], peerIDPrefix)
+	rand.Read(s.PeerID[len(peerIDPrefix):])
+	go s.accept()
+	return
+}
+
+func (s *Session) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// AddTorrent adds a torfile whose files live under dir, checking any data
+// already there. The torrent does nothing until started.
+func (s *Session) AddTorrent(tfile *Torfile, dir string) (t *Torrent, err error) {
+	if tfile.IsMerkle() {
+		return nil, errors.New("Merkle torrents are not supported by sessions")
+	}
+	s.mu.Lock()
+	_, exists := s.torrents[string(tfile.infoHash)]
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return nil, ErrSessionClosed
+	}
+	if exists {
+		return nil, ErrTorrentExists
+	}
+
+	storage, err := NewFileStorage(tfile, dir, AllocateSparse)
+	if err != nil {
+		return
+	}
+	t = newTorrent(s, tfile, storage)
+	if s.ResumeDir != "" {
+		t.resumePath = filepath.Join(s.ResumeDir, hex.EncodeToString(tfile.infoHash)+".resume")
+	}
+	if !t.resume() {
+		if err = t.recheck(); err != nil {
+			storage.Close()
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.torrents[string(tfile.infoHash)] != nil {
+		storage.Close()
+		return nil, ErrTorrentExists
+	}
+	s.torrents[string(tfile.infoHash)] = t
+	return
+}
+
+// Close stops every torrent and the listener.
+func (s *Session) Close() (err error) {
+	s.mu.Lock()
+	s.closed = true
+	torrents := make([]*Torrent, 0, len(s.torrents))
+	for _, t := range s.torrents {
+		torrents = append(torrents, t)
+	}
+	s.mu.Unlock()
+
+	err = s.listener.Close()
+	for _, t := range torrents {
+		t.Stop()
+		t.storage.Close()
+	}
+	return
+}
+
+func (s *Session) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleIncoming(conn)
+	}
+}
+
+// handleIncoming reads the handshake of an incoming connection and hands it
+// to the running torrent it asks for.
+func (s *Session) handleIncoming(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	h, err := peer.ReadHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	s.mu.Lock()
+	t := s.torrents[string(h.InfoHash[:])]
+	s.mu.Unlock()
+	ctx := t.runningContext()
+	if ctx == nil {
+		conn.Close()
+		return
+	}
+	if err = peer.WriteHandshake(conn, t.handshake()); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	t.addConn(ctx, conn, h, PeerAddr{})
+}
@@ -0,0 +1,177 @@
+package btgo
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/mopsled/btgo/peer"
+)
+
+const maxMetadataPeers = 20
+
+// metadataEvent carries a message from a peer we fetch metadata from, or a
+// nil message once the connection has shut down.
+type metadataEvent struct {
+	c *ExtensionConn
+	m *peer.Message
+}
+
+// FetchMetadata downloads the info dictionary of a magnet link from peers
+// supporting BEP 9, found through the link's trackers and the peers it lists,
+// and returns a torfile for it to pass to AddTorrent. It gives up when ctx is
+// done.
+func (s *Session) FetchMetadata(ctx context.Context, m *Magnet) (*Torfile, error) {
+	if len(m.InfoHash) != 20 {
+		return nil, errors.New("Invalid infohash in magnet link")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var tiers [][]string
+	for _, tr := range m.Trackers {
+		tiers = append(tiers, []string{tr})
+	}
+	metadata := NewMetadataExtension(m.InfoHash, nil)
+	registry := NewExtensionRegistry()
+	registry.Register(metadata)
+
+	var ours peer.Handshake
+	copy(ours.InfoHash[:], m.InfoHash)
+	ours.PeerID = s.PeerID
+	ours.Set(peer.ReservedExtension)
+
+	found := make(chan []PeerAddr)
+	conns := make(chan *ExtensionConn)
+	dialed := make(chan struct{})
+	events := make(chan metadataEvent, 256)
+	if len(tiers) > 0 {
+		go s.announceForMetadata(ctx, &Torfile{announceList: tiers, infoHash: m.InfoHash}, found)
+	}
+
+	candidates := append([]PeerAddr(nil), m.Peers...)
+	attempted := make(map[string]bool)
+	active := make(map[*ExtensionConn]bool)
+	dialing := 0
+	ticker := time.NewTicker(s.tick)
+	defer ticker.Stop()
+	defer func() {
+		for c := range active {
+			c.Conn().Close()
+		}
+	}()
+	for {
+		for len(candidates) > 0 && len(active)+dialing < maxMetadataPeers {
+			addr := candidates[0]
+			candidates = candidates[1:]
+			if attempted[addr.String()] || len(addr.ID) == 20 && string(addr.ID) == string(s.PeerID[:]) {
+				continue
+			}
+			attempted[addr.String()] = true
+			dialing++
+			go s.dialForMetadata(ctx, addr, ours, registry, conns, dialed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-metadata.Done():
+			return NewTorfileFromInfo(metadata.Metadata(), tiers)
+		case peers := <-found:
+			candidates = append(candidates, peers...)
+		case <-dialed:
+			dialing--
+		case c := <-conns:
+			active[c] = true
+			s.startMetadataConn(ctx, c, events)
+		case e := <-events:
+			if e.m == nil {
+				delete(active, e.c)
+				e.c.Close()
+			} else if e.m.ID == peer.Extended && e.c.Handle(e.m) != nil {
+				e.c.Conn().Close()
+			}
+		case <-ticker.C:
+			metadata.Maintain()
+		}
+	}
+}
+
+// announceForMetadata passes the peers the trackers return to found until ctx
+// is done. Left is unknown without the metadata, so we claim a single byte
+// to be counted as a leecher.
+func (s *Session) announceForMetadata(ctx context.Context, stub *Torfile, found chan<- []PeerAddr) {
+	trackers := NewTrackerManager(stub)
+	req := AnnounceRequest{InfoHash: stub.infoHash, PeerID: s.PeerID[:], Port: s.Port(), Left: 1, NumWant: -1}
+	for {
+		if resp, err := trackers.Announce(ctx, req); err == nil {
+			select {
+			case found <- resp.Peers:
+			case <-ctx.Done():
+				return
+			}
+		}
+		wait := time.Until(trackers.NextAnnounce())
+		if wait <= 0 {
+			wait = failedAnnounceRetry
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Session) dialForMetadata(ctx context.Context, addr PeerAddr, ours peer.Handshake, registry *ExtensionRegistry, conns chan<- *ExtensionConn, dialed chan<- struct{}) {
+	defer func() {
+		select {
+		case dialed <- struct{}{}:
+		case <-ctx.Done():
+		}
+	}()
+
+	d := net.Dialer{Timeout: dialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", addr.String())
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	h, err := exchangeHandshakes(conn, ours)
+	if err != nil || h.PeerID == s.PeerID || !h.Has(peer.ReservedExtension) {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	c := registry.NewConn(peer.NewPeerConn(conn, 0))
+	select {
+	case conns <- c:
+	case <-ctx.Done():
+		conn.Close()
+	}
+}
+
+// startMetadataConn sends our extended handshake and forwards the peer's
+// messages to events.
+func (s *Session) startMetadataConn(ctx context.Context, c *ExtensionConn, events chan<- metadataEvent) {
+	c.Conn().Start(ctx)
+	h := ExtensionHandshake{V: clientVersion, P: s.Port(), Reqq: defaultReqq}
+	if tcp, ok := c.Conn().RemoteAddr().(*net.TCPAddr); ok {
+		h.YourIP = tcp.IP
+	}
+	c.SendHandshake(h)
+	go func() {
+		for m := range c.Conn().Messages() {
+			select {
+			case events <- metadataEvent{c, m}:
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case events <- metadataEvent{c: c}:
+		case <-ctx.Done():
+		}
+	}()
+}
@@ -0,0 +1,191 @@
+package btgo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// generatedTorrent writes two files of random data under dir and returns a
+// torfile for them announcing to the given tracker.
+func generatedTorrent(t *testing.T, dir, announce string) *Torfile {
+	const pieceLength = 32 * 1024
+	lengths := []int{5*pieceLength + 1000, 70000}
+	r := rand.New(rand.NewSource(2))
+	var all []byte
+	var files []interface{}
+	for i, length := range lengths {
+		data := make([]byte, length)
+		r.Read(data)
+		name := []string{"first.bin", "second.bin"}[i]
+		if err := os.MkdirAll(filepath.Join(dir, "generated"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "generated", name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, data...)
+		files = append(files, map[string]interface{}{"length": length, "path": genSlice(name)})
+	}
+	var pieces []byte
+	for offset := 0; offset < len(all); offset += pieceLength {
+		end := offset + pieceLength
+		if end > len(all) {
+			end = len(all)
+		}
+		sum := sha1.Sum(all[offset:end])
+		pieces = append(pieces, sum[:]...)
+	}
+	info := map[string]interface{}{"name": "generated", "piece length": pieceLength, "pieces": pieces, "files": files}
+	tfile, err := NewTorfile([]byte(Bencode(map[string]interface{}{"announce": announce, "info": info})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tfile
+}
+
+func newTestSession(t *testing.T) *Session {
+	s, err := NewSession("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.tick = 20 * time.Millisecond
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSessionsSwarmOverLoopback(t *testing.T) {
+	tracker := httptest.NewServer(NewTrackerServer())
+	defer tracker.Close()
+	seedDir, err := ioutil.TempDir("", "btgo-seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(seedDir)
+	leechDir, err := ioutil.TempDir("", "btgo-leech")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(leechDir)
+
+	tfile := generatedTorrent(t, seedDir, tracker.URL+"/announce")
+	seeder, leecher := newTestSession(t), newTestSession(t)
+
+	seed, err := seeder.AddTorrent(tfile, seedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-seed.Completed():
+	default:
+		t.Fatal("Expected existing data to complete the seeding torrent")
+	}
+	if _, err = seeder.AddTorrent(tfile, seedDir); err != ErrTorrentExists {
+		t.Errorf("Expected ErrTorrentExists, got %v", err)
+	}
+	leech, err := leecher.AddTorrent(tfile, leechDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := leech.Stats(); stats.PiecesDone != 0 || stats.Left != 5*32*1024+1000+70000 || stats.State != TorrentStopped {
+		t.Errorf("Unexpected stats before download %+v", stats)
+	}
+
+	seed.Start()
+	leech.Start()
+	select {
+	case <-leech.Completed():
+	case <-time.After(20 * time.Second):
+		t.Fatalf("Download did not complete: %+v", leech.Stats())
+	}
+
+	for _, name := range []string{"first.bin", "second.bin"} {
+		expected, _ := ioutil.ReadFile(filepath.Join(seedDir, "generated", name))
+		downloaded, err := ioutil.ReadFile(filepath.Join(leechDir, "generated", name))
+		if err != nil || !bytes.Equal(expected, downloaded) {
+			t.Errorf("Downloaded %s differs from the original (%v)", name, err)
+		}
+	}
+	stats := leech.Stats()
+	if stats.PiecesDone != stats.Pieces || stats.Left != 0 || stats.Downloaded < 5*32*1024 || stats.State != TorrentRunning {
+		t.Errorf("Unexpected stats after download %+v", stats)
+	}
+	if seed.Stats().Uploaded < 5*32*1024 {
+		t.Errorf("Expected seeder to count uploads, got %+v", seed.Stats())
+	}
+
+	leech.Pause()
+	if stats = leech.Stats(); stats.State != TorrentPaused || stats.Peers != 0 || stats.Downloaded < 5*32*1024 {
+		t.Errorf("Unexpected stats after pause %+v", stats)
+	}
+	leech.Stop()
+	if state := leech.Stats().State; state != TorrentStopped {
+		t.Errorf("Expected stopped torrent, got %s", state)
+	}
+}
+
+func TestSessionFetchMetadataFromMagnet(t *testing.T) {
+	tracker := httptest.NewServer(NewTrackerServer())
+	defer tracker.Close()
+	seedDir, err := ioutil.TempDir("", "btgo-seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(seedDir)
+
+	tfile := generatedTorrent(t, seedDir, tracker.URL+"/announce")
+	seeder, fetcher := newTestSession(t), newTestSession(t)
+	seed, err := seeder.AddTorrent(tfile, seedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed.Start()
+	// The fetcher only learns of the seeder from the tracker, so it must not
+	// announce first.
+	deadline := time.Now().Add(5 * time.Second)
+	for seed.trackers.Status()[0].LastAnnounce.IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatal("Seeder did not announce")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	m := &Magnet{InfoHash: tfile.infoHash, Trackers: []string{tracker.URL + "/announce"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	fetched, err := fetcher.FetchMetadata(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fetched.infoHash, tfile.infoHash) || len(fetched.files) != 2 || fetched.files[1].length != 70000 {
+		t.Errorf("Unexpected fetched torfile %+v", fetched.files)
+	}
+	if len(fetched.announceList) != 1 || fetched.announceList[0][0] != m.Trackers[0] {
+		t.Errorf("Expected the magnet's tracker, got %v", fetched.announceList)
+	}
+}
+
+func TestTorrentCandidates(t *testing.T) {
+	s := &Session{}
+	s.PeerID[0] = 'x'
+	tor := newTorrent(s, generatedTorrent(t, t.TempDir(), "http://127.0.0.1:1/announce"), nil)
+	tor.queued, tor.attempted = make(map[string]bool), map[string]bool{"10.0.0.1:1": true}
+
+	self := PeerAddr{IP: net.ParseIP("10.0.0.3"), Port: 1, ID: s.PeerID[:]}
+	addrs := []PeerAddr{{IP: net.ParseIP("10.0.0.1"), Port: 1}, {IP: net.ParseIP("10.0.0.2"), Port: 1}, {IP: net.ParseIP("10.0.0.2"), Port: 1}, self}
+	for i := 0; i < maxCandidates; i++ {
+		addrs = append(addrs, PeerAddr{IP: net.IPv4(10, 1, byte(i>>8), byte(i)), Port: 1})
+	}
+	tor.addCandidates(addrs)
+	if len(tor.candidates) != maxCandidates || tor.candidates[0].String() != "10.0.0.2:1" || tor.candidates[1].String() != "10.1.0.0:1" {
+		t.Errorf("Wrong candidates: %d starting with %v", len(tor.candidates), tor.candidates[:2])
+	}
+}
@@ -0,0 +1,729 @@
+package btgo
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mopsled/btgo/peer"
+)
+
+const (
+	defaultMaxPeers = 50
+	maxCandidates   = 1000
+	dialTimeout     = 10 * time.Second
+	stopTimeout     = 5 * time.Second
+)
+
+type TorrentState int
+
+const (
+	TorrentStopped TorrentState = iota
+	TorrentRunning
+	TorrentPaused
+)
+
+func (s TorrentState) String() string {
+	switch s {
+	case TorrentRunning:
+		return "running"
+	case TorrentPaused:
+		return "paused"
+	}
+	return "stopped"
+}
+
+type TorrentStats struct {
+	State        TorrentState
+	Pieces       int
+	PiecesDone   int
+	Left         int64
+	Downloaded   int64
+	Uploaded     int64
+	DownloadRate float64
+	UploadRate   float64
+	Peers        int
+}
+
+// Torrent is one torfile in a session. While running, a single goroutine owns
+// the picker and choker and reacts to peer messages, tracker responses and a
+// periodic tick; every connection forwards its messages to it. Extensions
+// registered before Start are offered to peers supporting BEP 10; metadata
+// exchange always is, and peer exchange unless the torrent is private.
+type Torrent struct {
+	MaxPeers   int
+	Extensions *ExtensionRegistry
+
+	session   *Session
+	tfile     *Torfile
+	storage   Storage
+	picker    *PiecePicker
+	choker    *Choker
+	assembler *PieceAssembler
+	trackers  *TrackerManager
+	pex       *PexExtension // nil for private torrents
+	key       uint32
+	infoSize  int64
+
+	resumePath  string
+	cachedPeers []PeerAddr
+
+	completed    chan struct{}
+	completeOnce sync.Once
+
+	mu         sync.Mutex
+	state      TorrentState
+	ctx        context.Context
+	cancel     context.CancelFunc
+	done       chan struct{}
+	peers      map[string]*torrentPeer
+	downloaded int64
+	uploaded   int64
+	piecesDone int
+	left       int64
+
+	events    chan peerEvent
+	conns     chan *torrentPeer
+	dialed    chan struct{}
+	announced chan *AnnounceResponse
+
+	// Owned by the running loop.
+	candidates   []PeerAddr
+	queued       map[string]bool
+	attempted    map[string]bool
+	dialing      int
+	announcing   bool
+	nextAnnounce time.Time
+}
+
+type torrentPeer struct {
+	key        string
+	addr       PeerAddr // listening address, known for peers we dialed
+	id         [20]byte
+	conn       *peer.PeerConn
+	ext        *ExtensionConn // nil unless the peer supports BEP 10
+	interested bool
+}
+
+// peerEvent carries a message from a peer, or a nil message once the
+// connection has shut down.
+type peerEvent struct {
+	p *torrentPeer
+	m *peer.Message
+}
+
+func newTorrent(s *Session, tfile *Torfile, storage Storage) *Torrent {
+	left, _ := tfile.totalLength()
+	info := []byte(Bencode(tfile.info))
+	t := &Torrent{
+		MaxPeers:   defaultMaxPeers,
+		Extensions: NewExtensionRegistry(),
+		session:    s,
+		tfile:      tfile,
+		storage:    storage,
+		picker:     NewPiecePicker(tfile),
+		choker:     NewChoker(),
+		assembler:  NewPieceAssembler(tfile, storage),
+		trackers:   NewTrackerManager(tfile),
+		key:        rand.Uint32(),
+		infoSize:   int64(len(info)),
+		completed:  make(chan struct{}),
+		peers:      make(map[string]*torrentPeer),
+		left:       left,
+		events:     make(chan peerEvent, 256),
+		conns:      make(chan *torrentPeer),
+		dialed:     make(chan struct{}),
+		announced:  make(chan *AnnounceResponse),
+	}
+	t.Extensions.Register(NewMetadataExtension(tfile.infoHash, info))
+	if !tfile.Private() {
+		t.pex = NewPexExtension()
+		t.Extensions.Register(t.pex)
+	}
+	return t
+}
+
+// recheck hashes the data already in storage.
+func (t *Torrent) recheck() error {
+	for i := 0; i < t.tfile.numPieces(); i++ {
+		ok, err := t.assembler.VerifyPiece(i)
+		if err != nil {
+			return err
+		}
+		if ok {
+			t.pieceVerified(i)
+		}
+	}
+	t.checkComplete()
+	return nil
+}
+
+// resume restores progress from the saved resume data if it is still valid
+// for the files on disk.
+func (t *Torrent) resume() bool {
+	if t.resumePath == "" {
+		return false
+	}
+	b, err := ioutil.ReadFile(t.resumePath)
+	if err != nil {
+		return false
+	}
+	r, err := ParseResumeData(b)
+	if err != nil || r.validFor(t.tfile, t.storage.(*FileStorage).paths) != nil {
+		return false
+	}
+
+	for i := 0; i < t.tfile.numPieces(); i++ {
+		if r.Completed.Has(i) {
+			t.pieceVerified(i)
+		}
+	}
+	t.mu.Lock()
+	t.uploaded, t.downloaded = r.Uploaded, r.Downloaded
+	t.mu.Unlock()
+	t.cachedPeers = r.Peers
+	t.checkComplete()
+	return true
+}
+
+// ResumeData returns the torrent's current progress, the state of its files
+// and the peers it has dialed.
+func (t *Torrent) ResumeData() (r *ResumeData, err error) {
+	stats := t.Stats()
+	r = &ResumeData{
+		InfoHash:   t.tfile.infoHash,
+		Completed:  t.assembler.Verified(),
+		Uploaded:   stats.Uploaded,
+		Downloaded: stats.Downloaded,
+	}
+	if r.Files, err = statResumeFiles(t.storage.(*FileStorage).paths); err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, p := range t.peers {
+		if p.addr.IP != nil {
+			r.Peers = append(r.Peers, p.addr)
+		}
+	}
+	return
+}
+
+// SaveResume writes the resume data to the session's ResumeDir.
+func (t *Torrent) SaveResume() error {
+	if t.resumePath == "" {
+		return errors.New("Session has no resume directory")
+	}
+	r, err := t.ResumeData()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(t.resumePath), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(t.resumePath, r.Bytes())
+}
+
+// Completed is closed once every wanted piece has been downloaded and
+// verified, straight away if the data was already complete.
+func (t *Torrent) Completed() <-chan struct{} {
+	return t.completed
+}
+
+func (t *Torrent) Stats() (stats TorrentStats) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats = TorrentStats{
+		State:      t.state,
+		Pieces:     t.tfile.numPieces(),
+		PiecesDone: t.piecesDone,
+		Left:       t.left,
+		Downloaded: t.downloaded,
+		Uploaded:   t.uploaded,
+		Peers:      len(t.peers),
+	}
+	for _, p := range t.peers {
+		stats.Downloaded += p.conn.Downloaded()
+		stats.Uploaded += p.conn.Uploaded()
+		stats.DownloadRate += p.conn.DownloadRate()
+		stats.UploadRate += p.conn.UploadRate()
+	}
+	return
+}
+
+// Start announces to the trackers and begins connecting to and accepting
+// peers.
+func (t *Torrent) Start() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state == TorrentRunning {
+		return
+	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	t.done = make(chan struct{})
+	t.state = TorrentRunning
+	go t.run(t.ctx, t.done)
+}
+
+// Pause disconnects every peer but leaves the trackers believing we are
+// still in the swarm, for a quick Start later. Like Stop, it saves resume
+// data if the session has a ResumeDir.
+func (t *Torrent) Pause() {
+	t.halt(TorrentPaused)
+}
+
+// Stop disconnects every peer and tells the trackers we have left.
+func (t *Torrent) Stop() {
+	t.halt(TorrentStopped)
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	t.trackers.Stop(ctx, t.announceRequest())
+}
+
+func (t *Torrent) halt(state TorrentState) {
+	t.mu.Lock()
+	running, done := t.state == TorrentRunning, t.done
+	if running || state == TorrentStopped {
+		t.state = state
+	}
+	if running {
+		t.cancel()
+		t.ctx = nil
+	}
+	t.mu.Unlock()
+	if running {
+		<-done
+	}
+	if t.resumePath != "" {
+		t.SaveResume()
+	}
+}
+
+func (t *Torrent) runningContext() context.Context {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ctx
+}
+
+func (t *Torrent) handshake() (h peer.Handshake) {
+	copy(h.InfoHash[:], t.tfile.infoHash)
+	h.PeerID = t.session.PeerID
+	h.Set(peer.ReservedFast)
+	h.Set(peer.ReservedExtension)
+	return
+}
+
+func (t *Torrent) announceRequest() AnnounceRequest {
+	stats := t.Stats()
+	return AnnounceRequest{
+		InfoHash:   t.tfile.infoHash,
+		PeerID:     t.session.PeerID[:],
+		Port:       t.session.Port(),
+		Uploaded:   stats.Uploaded,
+		Downloaded: stats.Downloaded,
+		Left:       stats.Left,
+		NumWant:    -1,
+		Key:        t.key,
+	}
+}
+
+func (t *Torrent) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	t.candidates, t.queued, t.attempted, t.dialing = nil, make(map[string]bool), make(map[string]bool), 0
+	t.addCandidates(t.cachedPeers)
+	t.announce(ctx)
+
+	ticker := time.NewTicker(t.session.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			t.mu.Lock()
+			peers := make([]*torrentPeer, 0, len(t.peers))
+			for _, p := range t.peers {
+				peers = append(peers, p)
+			}
+			t.mu.Unlock()
+			for _, p := range peers {
+				t.removePeer(p)
+			}
+			return
+		case p := <-t.conns:
+			t.addPeer(ctx, p)
+		case <-t.dialed:
+			t.dialing--
+		case e := <-t.events:
+			t.handleEvent(e)
+		case resp := <-t.announced:
+			t.announcing = false
+			t.nextAnnounce = t.trackers.NextAnnounce()
+			if now := time.Now(); t.nextAnnounce.Before(now) {
+				t.nextAnnounce = now.Add(failedAnnounceRetry)
+			}
+			if resp != nil {
+				t.addCandidates(resp.Peers)
+			}
+		case <-ticker.C:
+			t.maintain(ctx)
+		}
+	}
+}
+
+func (t *Torrent) announce(ctx context.Context) {
+	t.announcing = true
+	req := t.announceRequest()
+	go func() {
+		resp, err := t.trackers.Announce(ctx, req)
+		if err != nil {
+			resp = nil
+		}
+		select {
+		case t.announced <- resp:
+		case <-ctx.Done():
+		}
+	}()
+}
+
+// maintain runs every tick: it keeps requests flowing, rechokes, announces
+// when due, exchanges peers and connects to more of them.
+func (t *Torrent) maintain(ctx context.Context) {
+	for _, p := range t.peerList() {
+		t.updatePeer(p)
+	}
+	t.choker.Tick()
+	if !t.announcing && !time.Now().Before(t.nextAnnounce) {
+		t.announce(ctx)
+	}
+	if t.pex != nil {
+		t.pex.Send(t.pexPeers())
+		t.addCandidates(t.pex.Found())
+	}
+
+	for len(t.candidates) > 0 && len(t.peerList())+t.dialing < t.MaxPeers {
+		addr := t.candidates[0]
+		t.candidates = t.candidates[1:]
+		key := addr.String()
+		delete(t.queued, key)
+		t.attempted[key] = true
+		t.dialing++
+		go t.dial(ctx, addr)
+	}
+}
+
+// addCandidates queues peers to dial, up to maxCandidates, leaving out
+// ourselves and addresses already queued, attempted or connected.
+func (t *Torrent) addCandidates(addrs []PeerAddr) {
+	connected := make(map[string]bool)
+	for _, p := range t.pexPeers() {
+		connected[p.Addr.String()] = true
+	}
+	for _, addr := range addrs {
+		if len(t.candidates) >= maxCandidates {
+			return
+		}
+		key := addr.String()
+		if t.queued[key] || t.attempted[key] || connected[key] || len(addr.ID) == 20 && string(addr.ID) == string(t.session.PeerID[:]) {
+			continue
+		}
+		t.queued[key] = true
+		t.candidates = append(t.candidates, addr)
+	}
+}
+
+// pexPeers lists the connected peers whose listening address we know: the
+// ones we dialed, which are reachable, and the ones that gave their port in
+// the extended handshake.
+func (t *Torrent) pexPeers() (peers []PexPeer) {
+	for _, p := range t.peerList() {
+		var pp PexPeer
+		var remote *ExtensionHandshake
+		if p.ext != nil {
+			remote = p.ext.Remote()
+		}
+		tcp, _ := p.conn.RemoteAddr().(*net.TCPAddr)
+		if p.addr.IP != nil {
+			pp = PexPeer{Addr: PeerAddr{IP: p.addr.IP, Port: p.addr.Port}, Flags: PexReachable}
+		} else if tcp != nil && remote != nil && remote.P > 0 {
+			pp = PexPeer{Addr: PeerAddr{IP: tcp.IP, Port: remote.P}}
+		} else {
+			continue
+		}
+		if p.conn.Bitfield().Count() == t.tfile.numPieces() {
+			pp.Flags |= PexSeed
+		}
+		peers = append(peers, pp)
+	}
+	return
+}
+
+func (t *Torrent) dial(ctx context.Context, addr PeerAddr) {
+	defer func() {
+		select {
+		case t.dialed <- struct{}{}:
+		case <-ctx.Done():
+		}
+	}()
+
+	d := net.Dialer{Timeout: dialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", addr.String())
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	h, err := exchangeHandshakes(conn, t.handshake())
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	t.addConn(ctx, conn, h, addr)
+}
+
+// exchangeHandshakes sends ours on a connection we dialed and reads the
+// peer's, which must be for the same infohash.
+func exchangeHandshakes(conn net.Conn, ours peer.Handshake) (h peer.Handshake, err error) {
+	if err = peer.WriteHandshake(conn, ours); err != nil {
+		return
+	}
+	if h, err = peer.ReadHandshake(conn); err != nil {
+		return
+	}
+	if h.InfoHash != ours.InfoHash {
+		err = errors.New("Peer answered with another infohash")
+	}
+	return
+}
+
+// addConn hands a handshaken connection to the running loop.
+func (t *Torrent) addConn(ctx context.Context, conn net.Conn, h peer.Handshake, addr PeerAddr) {
+	p := &torrentPeer{key: conn.RemoteAddr().String(), addr: addr, id: h.PeerID, conn: peer.NewPeerConn(conn, t.tfile.numPieces())}
+	p.conn.Fast = h.Has(peer.ReservedFast)
+	if h.Has(peer.ReservedExtension) {
+		p.ext = t.Extensions.NewConn(p.conn)
+	}
+	select {
+	case t.conns <- p:
+	case <-ctx.Done():
+		conn.Close()
+	}
+}
+
+func (t *Torrent) peerList() []*torrentPeer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	peers := make([]*torrentPeer, 0, len(t.peers))
+	for _, p := range t.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+func (t *Torrent) addPeer(ctx context.Context, p *torrentPeer) {
+	reject := t.assembler.Banned(p.key) || p.id == t.session.PeerID
+	t.mu.Lock()
+	reject = reject || len(t.peers) >= t.MaxPeers || t.peers[p.key] != nil
+	for _, other := range t.peers {
+		reject = reject || other.id == p.id
+	}
+	if !reject {
+		t.peers[p.key] = p
+	}
+	t.mu.Unlock()
+	if reject {
+		p.conn.Close()
+		return
+	}
+
+	p.conn.Start(ctx)
+	t.choker.AddPeer(p.key, p.conn)
+	t.assembler.AddConn(p.key, p.conn)
+	have := t.picker.Have()
+	if have.Count() > 0 || p.conn.Fast {
+		p.conn.SendBitfield(have)
+	}
+	tcp, _ := p.conn.RemoteAddr().(*net.TCPAddr)
+	if tcp != nil && p.conn.Fast {
+		var infoHash [20]byte
+		copy(infoHash[:], t.tfile.infoHash)
+		for _, i := range peer.AllowedFastSet(tcp.IP, infoHash, t.tfile.numPieces(), peer.DefaultAllowedFast) {
+			if have.Has(i) {
+				p.conn.AllowFast(i)
+			}
+		}
+	}
+	if p.ext != nil {
+		h := ExtensionHandshake{V: clientVersion, P: t.session.Port(), Reqq: defaultReqq, MetadataSize: t.infoSize}
+		if tcp != nil {
+			h.YourIP = tcp.IP
+		}
+		p.ext.SendHandshake(h)
+	}
+	go func() {
+		for m := range p.conn.Messages() {
+			select {
+			case t.events <- peerEvent{p, m}:
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case t.events <- peerEvent{p: p}:
+		case <-ctx.Done():
+		}
+	}()
+}
+
+func (t *Torrent) removePeer(p *torrentPeer) {
+	p.conn.Close()
+	t.mu.Lock()
+	if t.peers[p.key] != p {
+		t.mu.Unlock()
+		return
+	}
+	delete(t.peers, p.key)
+	t.downloaded += p.conn.Downloaded()
+	t.uploaded += p.conn.Uploaded()
+	t.mu.Unlock()
+
+	t.choker.RemovePeer(p.key)
+	t.assembler.RemoveConn(p.key)
+	t.picker.PeerGone(p.key, p.conn.Bitfield())
+	if p.ext != nil {
+		p.ext.Close()
+	}
+}
+
+func (t *Torrent) handleEvent(e peerEvent) {
+	p := e.p
+	t.mu.Lock()
+	current := t.peers[p.key] == p
+	t.mu.Unlock()
+	if !current {
+		return
+	}
+	if e.m == nil {
+		t.removePeer(p)
+		return
+	}
+
+	switch e.m.ID {
+	case peer.Have:
+		t.picker.PeerHas(int(e.m.Index))
+	case peer.BitfieldMsg, peer.HaveAll:
+		t.picker.PeerHave(e.m.Bitfield)
+	case peer.Request:
+		t.serveRequest(p, e.m)
+	case peer.Piece:
+		t.receiveBlock(p, e.m)
+	case peer.Extended:
+		if p.ext == nil || p.ext.Handle(e.m) != nil {
+			t.removePeer(p)
+			return
+		}
+	}
+	t.updatePeer(p)
+}
+
+func (t *Torrent) serveRequest(p *torrentPeer, m *peer.Message) {
+	b := peer.Block{Index: m.Index, Begin: m.Begin, Length: m.Length}
+	if !t.picker.Has(int(m.Index)) {
+		p.conn.Reject(b)
+		return
+	}
+	block := make([]byte, m.Length)
+	if _, err := t.storage.ReadAt(block, int(m.Index), int64(m.Begin)); err != nil {
+		p.conn.Reject(b)
+		return
+	}
+	p.conn.SendPiece(m.Index, m.Begin, block)
+}
+
+func (t *Torrent) receiveBlock(p *torrentPeer, m *peer.Message) {
+	b := peer.Block{Index: m.Index, Begin: m.Begin, Length: uint32(len(m.Block))}
+	cancel, _ := t.picker.BlockReceived(p.key, b)
+	t.mu.Lock()
+	for _, key := range cancel {
+		if other := t.peers[key]; other != nil {
+			other.conn.Cancel(b)
+		}
+	}
+	t.mu.Unlock()
+
+	result, err := t.assembler.Block(p.key, m.Index, m.Begin, m.Block)
+	if err != nil {
+		return
+	}
+	switch result {
+	case PieceVerified:
+		t.pieceVerified(int(m.Index))
+		t.checkComplete()
+	case PieceFailed:
+		t.picker.PieceFailed(int(m.Index))
+		for _, other := range t.peerList() {
+			if t.assembler.Banned(other.key) {
+				t.removePeer(other)
+			}
+		}
+	}
+}
+
+func (t *Torrent) pieceVerified(index int) {
+	if t.picker.Has(index) {
+		return
+	}
+	t.picker.PieceVerified(index)
+	t.assembler.SetVerified(index)
+	t.storage.MarkComplete(index)
+	t.mu.Lock()
+	t.piecesDone++
+	t.left -= t.tfile.pieceSize(index)
+	t.mu.Unlock()
+}
+
+// checkComplete switches to seeding once every wanted piece is verified, and
+// makes the next tick announce the completion.
+func (t *Torrent) checkComplete() {
+	if !t.picker.Done() {
+		return
+	}
+	t.completeOnce.Do(func() {
+		close(t.completed)
+		t.choker.Seeding = true
+		t.nextAnnounce = time.Time{}
+	})
+}
+
+// updatePeer returns the peer's dropped requests to the picker, updates our
+// interest, fills its request pipeline, only with allowed fast pieces while it
+// chokes us, and rechokes early when a peer becomes interested while an
+// unchoke slot is free.
+func (t *Torrent) updatePeer(p *torrentPeer) {
+	for _, b := range p.conn.DroppedRequests() {
+		t.picker.BlockDropped(p.key, b)
+	}
+	has := p.conn.Bitfield()
+	p.conn.SetInterested(t.picker.Interesting(has))
+	if p.conn.CanRequest() {
+		n := p.conn.MaxOutstanding - len(p.conn.Outstanding())
+		for _, b := range t.picker.Pick(p.key, p.conn.Requestable(), n) {
+			if err := p.conn.Request(b); err != nil {
+				t.picker.BlockDropped(p.key, b)
+			}
+		}
+	}
+
+	interested := p.conn.State().PeerInterested
+	if interested && !p.interested && len(t.choker.Unchoked()) <= t.choker.Slots {
+		t.choker.Rechoke()
+	}
+	p.interested = interested
+}
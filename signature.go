@@ -0,0 +1,198 @@
+package btgo
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Signature is one entry of the BEP 35 signatures dictionary. Signatures sit
+// beside the info dictionary, so adding them never changes the infohash.
+// Signatures carrying a certificate are verified against the certificate's own
+// key when the torfile is parsed, which proves nothing about who the signer
+// is: a self-signed certificate can name anyone. VerifyCertificate checks the
+// certificate against trusted roots. Bare Ed25519 signatures need
+// VerifySignature with the signer's key.
+type Signature struct {
+	Signer      string
+	Certificate *x509.Certificate
+	Info        map[string]interface{}
+	Signature   []byte
+}
+
+func (t *Torfile) Signatures() []Signature {
+	return t.signatures
+}
+
+// Sign signs the info dictionary as signer and records the signature in the
+// torfile. cert may be nil for bare Ed25519 keys; info is optional extra data
+// covered by the signature.
+func (t *Torfile) Sign(signer string, key crypto.Signer, cert *x509.Certificate, info map[string]interface{}) (err error) {
+	sig := Signature{Signer: signer, Certificate: cert, Info: info}
+	if cert != nil {
+		if !samePublicKey(cert.PublicKey, key.Public()) {
+			err = errors.New("Certificate does not match signing key")
+			return
+		}
+	}
+	if sig.Signature, err = signMessage(key, sig.signedData(Bencode(t.info))); err != nil {
+		return
+	}
+
+	signatures := make([]Signature, 0, len(t.signatures)+1)
+	for _, s := range t.signatures {
+		if s.Signer != signer {
+			signatures = append(signatures, s)
+		}
+	}
+	signatures = append(signatures, sig)
+	sort.Slice(signatures, func(i, j int) bool { return signatures[i].Signer < signatures[j].Signer })
+	t.signatures = signatures
+
+	entries := make(map[string]interface{}, len(signatures))
+	for _, s := range signatures {
+		entries[s.Signer] = s.metainfo()
+	}
+	metainfo := make(map[string]interface{}, len(t.metainfo)+1)
+	for k, v := range t.metainfo {
+		metainfo[k] = v
+	}
+	metainfo["signatures"] = entries
+	t.metainfo = metainfo
+	return
+}
+
+// VerifySignature checks the signature made by signer against pub, which is
+// needed for signatures that do not embed a certificate.
+func (t *Torfile) VerifySignature(signer string, pub crypto.PublicKey) (err error) {
+	for _, s := range t.signatures {
+		if s.Signer == signer {
+			return verifyMessage(pub, s.signedData(Bencode(t.info)), s.Signature)
+		}
+	}
+	return fmt.Errorf("No signature from %s", signer)
+}
+
+// VerifyCertificate checks that the certificate embedded in signer's signature
+// chains to opts.Roots, or the system roots if nil, and returns the chains.
+// Only then can the certificate's subject be trusted as the signer.
+func (t *Torfile) VerifyCertificate(signer string, opts x509.VerifyOptions) (chains [][]*x509.Certificate, err error) {
+	for _, s := range t.signatures {
+		if s.Signer != signer {
+			continue
+		}
+		if s.Certificate == nil {
+			return nil, fmt.Errorf("Signature from %s has no certificate", signer)
+		}
+		return s.Certificate.Verify(opts)
+	}
+	return nil, fmt.Errorf("No signature from %s", signer)
+}
+
+// Bytes bencodes the torfile, including any signatures added with Sign.
+func (t *Torfile) Bytes() []byte {
+	return []byte(Bencode(t.metainfo))
+}
+
+func (s Signature) signedData(bencodedInfo string) []byte {
+	if s.Info == nil {
+		return []byte(bencodedInfo)
+	}
+	return []byte(bencodedInfo + Bencode(s.Info))
+}
+
+func (s Signature) metainfo() map[string]interface{} {
+	m := map[string]interface{}{"signature": s.Signature}
+	if s.Certificate != nil {
+		m["certificate"] = s.Certificate.Raw
+	}
+	if s.Info != nil {
+		m["info"] = s.Info
+	}
+	return m
+}
+
+func signaturesFromMetainfo(m map[string]interface{}, bencodedInfo string) (signatures []Signature, err error) {
+	if m["signatures"] == nil {
+		return
+	}
+	entries, ok := m["signatures"].(map[string]interface{})
+	if !ok {
+		err = errors.New("Unable to parse signatures in torfile")
+		return
+	}
+
+	for signer, e := range entries {
+		entry, ok := e.(map[string]interface{})
+		if !ok {
+			err = fmt.Errorf("Unable to parse signature from %s", signer)
+			return
+		}
+		sig := Signature{Signer: signer, Signature: bytesFromInterface(entry["signature"])}
+		if sig.Signature == nil {
+			err = fmt.Errorf("Missing signature from %s", signer)
+			return
+		}
+		if entry["info"] != nil {
+			if sig.Info, ok = entry["info"].(map[string]interface{}); !ok {
+				err = fmt.Errorf("Unable to parse signature info from %s", signer)
+				return
+			}
+		}
+		if der := bytesFromInterface(entry["certificate"]); der != nil {
+			if sig.Certificate, err = x509.ParseCertificate(der); err != nil {
+				return
+			}
+			if err = verifyMessage(sig.Certificate.PublicKey, sig.signedData(bencodedInfo), sig.Signature); err != nil {
+				err = fmt.Errorf("Invalid signature from %s: %s", signer, err)
+				return
+			}
+		}
+		signatures = append(signatures, sig)
+	}
+	sort.Slice(signatures, func(i, j int) bool { return signatures[i].Signer < signatures[j].Signer })
+	return
+}
+
+func signMessage(key crypto.Signer, message []byte) (sig []byte, err error) {
+	switch key.Public().(type) {
+	case ed25519.PublicKey:
+		return key.Sign(rand.Reader, message, crypto.Hash(0))
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		digest := sha256.Sum256(message)
+		return key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	return nil, fmt.Errorf("Unsupported signing key %T", key.Public())
+}
+
+func verifyMessage(pub crypto.PublicKey, message []byte, sig []byte) error {
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		if ed25519.Verify(k, message, sig) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(message)
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig)
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(message)
+		if ecdsa.VerifyASN1(k, digest[:], sig) {
+			return nil
+		}
+	default:
+		return fmt.Errorf("Unsupported public key %T", pub)
+	}
+	return errors.New("Signature verification failed")
+}
+
+func samePublicKey(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Equal(b)
+}
@@ -0,0 +1,112 @@
+package btgo
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestSignEd25519(t *testing.T) {
+	tfile := loadTestTorfile(t, "test/ubuntu.torrent")
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	if err := tfile.Sign("com.example.releases", priv, nil, map[string]interface{}{"comment": "nightly"}); err != nil {
+		t.Fatalf("Failed to sign torfile: %s", err)
+	}
+
+	signed, err := NewTorfile(tfile.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to parse signed torfile: %s", err)
+	}
+	if !bytes.Equal(signed.infoHash, tfile.infoHash) {
+		t.Errorf("Signing changed the infohash: %x", signed.infoHash)
+	}
+	sigs := signed.Signatures()
+	if len(sigs) != 1 || sigs[0].Signer != "com.example.releases" || sigs[0].Certificate != nil {
+		t.Fatalf("Wrong signatures: %v", sigs)
+	}
+	if err := signed.VerifySignature("com.example.releases", pub); err != nil {
+		t.Errorf("Failed to verify signature: %s", err)
+	}
+	if err := signed.VerifySignature("com.example.releases", otherPub); err == nil {
+		t.Error("Signature verified with the wrong key")
+	}
+	if err := signed.VerifySignature("com.example.other", pub); err == nil {
+		t.Error("Verified a signature that does not exist")
+	}
+}
+
+func TestSignX509(t *testing.T) {
+	tfile := loadTestTorfile(t, "test/backtrack.torrent")
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Example Publisher"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	if err := tfile.Sign("publisher", key, cert, nil); err != nil {
+		t.Fatalf("Failed to sign torfile: %s", err)
+	}
+	signed, err := NewTorfile(tfile.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to parse signed torfile: %s", err)
+	}
+	sigs := signed.Signatures()
+	if len(sigs) != 1 || sigs[0].Certificate == nil || sigs[0].Certificate.Subject.CommonName != "Example Publisher" {
+		t.Fatalf("Wrong signatures: %v", sigs)
+	}
+	if !bytes.Equal(signed.infoHash, tfile.infoHash) {
+		t.Errorf("Signing changed the infohash: %x", signed.infoHash)
+	}
+
+	if _, err := signed.VerifyCertificate("publisher", x509.VerifyOptions{Roots: x509.NewCertPool()}); err == nil {
+		t.Error("Expected untrusted self-signed certificate to fail verification")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	if _, err := signed.VerifyCertificate("publisher", x509.VerifyOptions{Roots: roots}); err != nil {
+		t.Errorf("Expected trusted certificate to verify, got %s", err)
+	}
+	if _, err := signed.VerifyCertificate("nobody", x509.VerifyOptions{Roots: roots}); err == nil {
+		t.Error("Expected missing signer to fail verification")
+	}
+
+	sigs[0].Signature[0] ^= 0xff
+	signed.metainfo["signatures"] = map[string]interface{}{"publisher": sigs[0].metainfo()}
+	if _, err := NewTorfile(signed.Bytes()); err == nil {
+		t.Error("Expected tampered signature to fail verification")
+	}
+
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	if err := tfile.Sign("publisher", otherKey, cert, nil); err == nil {
+		t.Error("Expected mismatched certificate and key to fail")
+	}
+}
+
+func loadTestTorfile(t *testing.T, file string) *Torfile {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Failed to open test file %s", file)
+	}
+	tfile, err := NewTorfile(content)
+	if err != nil {
+		t.Fatalf("Failed to parse test file %s: %s", file, err)
+	}
+	return tfile
+}
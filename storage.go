@@ -0,0 +1,104 @@
+package btgo
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/mopsled/btgo/peer"
+)
+
+// Storage holds a torfile's data, addressed by piece and offset within the
+// piece. MarkComplete is called once a piece has been verified.
+type Storage interface {
+	ReadAt(p []byte, piece int, offset int64) (int, error)
+	WriteAt(p []byte, piece int, offset int64) (int, error)
+	MarkComplete(piece int) error
+	Close() error
+}
+
+var ErrStorageClosed = errors.New("Storage is closed")
+
+// checkPieceRange validates a read or write of n bytes at offset in piece.
+func checkPieceRange(tfile *Torfile, piece int, offset int64, n int) error {
+	if piece < 0 || piece >= tfile.numPieces() {
+		return errors.New("Piece index out of range")
+	}
+	if offset < 0 || offset+int64(n) > tfile.pieceSize(piece) {
+		return errors.New("Offset out of range for piece")
+	}
+	return nil
+}
+
+// MemoryStorage keeps every piece in memory; unwritten data reads as zeros.
+type MemoryStorage struct {
+	tfile *Torfile
+
+	mu       sync.Mutex
+	pieces   map[int][]byte
+	complete peer.Bitfield
+	closed   bool
+}
+
+func NewMemoryStorage(tfile *Torfile) *MemoryStorage {
+	return &MemoryStorage{tfile: tfile, pieces: make(map[int][]byte), complete: peer.NewBitfield(tfile.numPieces())}
+}
+
+func (s *MemoryStorage) ReadAt(p []byte, piece int, offset int64) (n int, err error) {
+	if err = checkPieceRange(s.tfile, piece, offset, len(p)); err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, ErrStorageClosed
+	}
+	data := s.pieces[piece]
+	if data == nil {
+		for i := range p {
+			p[i] = 0
+		}
+		return len(p), nil
+	}
+	return copy(p, data[offset:]), nil
+}
+
+func (s *MemoryStorage) WriteAt(p []byte, piece int, offset int64) (n int, err error) {
+	if err = checkPieceRange(s.tfile, piece, offset, len(p)); err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, ErrStorageClosed
+	}
+	data := s.pieces[piece]
+	if data == nil {
+		data = make([]byte, s.tfile.pieceSize(piece))
+		s.pieces[piece] = data
+	}
+	return copy(data[offset:], p), nil
+}
+
+func (s *MemoryStorage) MarkComplete(piece int) error {
+	if err := checkPieceRange(s.tfile, piece, 0, 0); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.complete.Set(piece)
+	return nil
+}
+
+// Completed returns a copy of the pieces marked complete.
+func (s *MemoryStorage) Completed() peer.Bitfield {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append(peer.Bitfield(nil), s.complete...)
+}
+
+func (s *MemoryStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
@@ -0,0 +1,271 @@
+package btgo
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/mopsled/btgo/peer"
+)
+
+type Allocation int
+
+const (
+	// AllocateSparse sizes files without writing to them, leaving the
+	// filesystem to allocate blocks as pieces arrive.
+	AllocateSparse Allocation = iota
+	// AllocateFull writes every file out to its full length up front.
+	AllocateFull
+)
+
+const defaultMaxOpenFiles = 64
+
+// FileStorage maps pieces onto the torfile's files under a directory. Files
+// and their directories are created when the storage is opened, and at most
+// MaxOpenFiles handles are kept open, least recently used closed first.
+type FileStorage struct {
+	MaxOpenFiles int
+
+	tfile *Torfile
+	paths []string
+
+	mu       sync.Mutex
+	handles  map[int]*list.Element
+	lru      *list.List
+	complete peer.Bitfield
+	closed   bool
+}
+
+type fileHandle struct {
+	index int
+	file  *os.File
+	dirty bool
+}
+
+// fileSegment is the part of a read or write that falls in one file.
+type fileSegment struct {
+	file       int
+	offset     int64
+	start, end int
+}
+
+func NewFileStorage(tfile *Torfile, dir string, alloc Allocation) (s *FileStorage, err error) {
+	s = &FileStorage{
+		MaxOpenFiles: defaultMaxOpenFiles,
+		tfile:        tfile,
+		handles:      make(map[int]*list.Element),
+		lru:          list.New(),
+		complete:     peer.NewBitfield(tfile.numPieces()),
+	}
+	for _, f := range tfile.files {
+		var path string
+		if path, err = storagePath(dir, f.path); err != nil {
+			return nil, err
+		}
+		if err = allocateFile(path, f.length, alloc); err != nil {
+			return nil, err
+		}
+		s.paths = append(s.paths, path)
+	}
+	return
+}
+
+// storagePath joins a torfile path onto dir, refusing paths that would
+// escape it.
+func storagePath(dir, path string) (string, error) {
+	for _, element := range strings.Split(path, string(os.PathSeparator)) {
+		if element == "" || element == "." || element == ".." {
+			return "", errors.New("Unsafe file path in torrent: " + path)
+		}
+	}
+	return filepath.Join(dir, path), nil
+}
+
+func allocateFile(path string, length int64, alloc Allocation) (err error) {
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	info, err := f.Stat()
+	if err != nil || info.Size() >= length {
+		return
+	}
+
+	if alloc == AllocateSparse {
+		return f.Truncate(length)
+	}
+	zeros := make([]byte, 1<<16)
+	for offset := info.Size(); offset < length; offset += int64(len(zeros)) {
+		chunk := zeros
+		if remaining := length - offset; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		if _, err = f.WriteAt(chunk, offset); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *FileStorage) segments(piece int, offset int64, n int) (segments []fileSegment) {
+	start := int64(piece)*s.tfile.pieceLength + offset
+	end := start + int64(n)
+	var fileStart int64
+	for i, f := range s.tfile.files {
+		fileEnd := fileStart + f.length
+		if fileEnd > start && fileStart < end {
+			from, to := start, end
+			if fileStart > from {
+				from = fileStart
+			}
+			if fileEnd < to {
+				to = fileEnd
+			}
+			segments = append(segments, fileSegment{i, from - fileStart, int(from - start), int(to - start)})
+		}
+		fileStart = fileEnd
+	}
+	return
+}
+
+func (s *FileStorage) ReadAt(p []byte, piece int, offset int64) (n int, err error) {
+	if err = checkPieceRange(s.tfile, piece, offset, len(p)); err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, seg := range s.segments(piece, offset, len(p)) {
+		var h *fileHandle
+		if h, err = s.handle(seg.file); err != nil {
+			return
+		}
+		var read int
+		read, err = h.file.ReadAt(p[seg.start:seg.end], seg.offset)
+		n += read
+		if err == io.EOF && read == seg.end-seg.start {
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *FileStorage) WriteAt(p []byte, piece int, offset int64) (n int, err error) {
+	if err = checkPieceRange(s.tfile, piece, offset, len(p)); err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, seg := range s.segments(piece, offset, len(p)) {
+		var h *fileHandle
+		if h, err = s.handle(seg.file); err != nil {
+			return
+		}
+		var written int
+		written, err = h.file.WriteAt(p[seg.start:seg.end], seg.offset)
+		n += written
+		h.dirty = true
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// MarkComplete syncs the open files holding the piece so that a verified
+// piece survives a crash. Files closed since were synced by evict.
+func (s *FileStorage) MarkComplete(piece int) error {
+	if err := checkPieceRange(s.tfile, piece, 0, 0); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrStorageClosed
+	}
+	for _, seg := range s.segments(piece, 0, int(s.tfile.pieceSize(piece))) {
+		if e := s.handles[seg.file]; e != nil {
+			if h := e.Value.(*fileHandle); h.dirty {
+				if err := h.file.Sync(); err != nil {
+					return err
+				}
+				h.dirty = false
+			}
+		}
+	}
+	s.complete.Set(piece)
+	return nil
+}
+
+// Completed returns a copy of the pieces marked complete.
+func (s *FileStorage) Completed() peer.Bitfield {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append(peer.Bitfield(nil), s.complete...)
+}
+
+func (s *FileStorage) Close() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.lru.Len() > 0 {
+		if closeErr := s.evict(); err == nil {
+			err = closeErr
+		}
+	}
+	s.closed = true
+	return
+}
+
+// handle returns an open handle for the file, opening it and closing the
+// least recently used one if needed.
+func (s *FileStorage) handle(index int) (h *fileHandle, err error) {
+	if s.closed {
+		return nil, ErrStorageClosed
+	}
+	if e := s.handles[index]; e != nil {
+		s.lru.MoveToFront(e)
+		return e.Value.(*fileHandle), nil
+	}
+	for s.MaxOpenFiles > 0 && s.lru.Len() >= s.MaxOpenFiles {
+		if err = s.evict(); err != nil {
+			return
+		}
+	}
+	f, err := os.OpenFile(s.paths[index], os.O_RDWR, 0644)
+	if err != nil {
+		return
+	}
+	h = &fileHandle{index: index, file: f}
+	s.handles[index] = s.lru.PushFront(h)
+	return
+}
+
+// evict closes the least recently used handle, syncing it first if it was
+// written to: MarkComplete only syncs files that are still open.
+func (s *FileStorage) evict() (err error) {
+	e := s.lru.Back()
+	h := e.Value.(*fileHandle)
+	s.lru.Remove(e)
+	delete(s.handles, h.index)
+	if h.dirty {
+		err = h.file.Sync()
+	}
+	if closeErr := h.file.Close(); err == nil {
+		err = closeErr
+	}
+	return
+}
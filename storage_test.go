@@ -0,0 +1,127 @@
+package btgo
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// storageTorfile has three files spread over pieces of ten bytes.
+func storageTorfile() *Torfile {
+	sep := string(os.PathSeparator)
+	return &Torfile{
+		files: []File{
+			{"top" + sep + "a", 15},
+			{"top" + sep + "empty", 0},
+			{"top" + sep + "sub" + sep + "b", 12},
+			{"top" + sep + "c", 3},
+		},
+		pieceLength: 10,
+		pieces:      make([][]byte, 3),
+	}
+}
+
+func testStorageRoundTrip(t *testing.T, s Storage) {
+	data := []byte("abcdefghijklmnopqrstuvwxyz0123")
+	for piece := 0; piece < 3; piece++ {
+		if n, err := s.WriteAt(data[piece*10:piece*10+10], piece, 0); err != nil || n != 10 {
+			t.Fatalf("Unable to write piece %d: %d, %v", piece, n, err)
+		}
+	}
+
+	buf := make([]byte, 7)
+	if n, err := s.ReadAt(buf, 1, 2); err != nil || n != 7 || string(buf) != "mnopqrs" {
+		t.Errorf("Expected mnopqrs, got %q (%d, %v)", buf, n, err)
+	}
+	if _, err := s.ReadAt(buf, 2, 4); err == nil {
+		t.Error("Expected error reading past the end of a piece")
+	}
+	if _, err := s.WriteAt(buf, 3, 0); err == nil {
+		t.Error("Expected error writing to a missing piece")
+	}
+	if err := s.MarkComplete(1); err != nil {
+		t.Error(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, err := s.ReadAt(buf, 0, 0); err != ErrStorageClosed {
+		t.Errorf("Expected ErrStorageClosed, got %v", err)
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	s := NewMemoryStorage(storageTorfile())
+	buf := []byte("xxxx")
+	if _, err := s.ReadAt(buf, 0, 0); err != nil || !bytes.Equal(buf, make([]byte, 4)) {
+		t.Errorf("Expected unwritten data to read as zeros, got %q", buf)
+	}
+	testStorageRoundTrip(t, s)
+	if completed := s.Completed(); !completed.Has(1) || completed.Count() != 1 {
+		t.Errorf("Unexpected completed pieces %08b", completed)
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btgo-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileStorage(storageTorfile(), dir, AllocateSparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.MaxOpenFiles = 1
+	testStorageRoundTrip(t, s)
+
+	expected := map[string]string{
+		"top/a":     "abcdefghijklmno",
+		"top/empty": "",
+		"top/sub/b": "pqrstuvwxyz0",
+		"top/c":     "123",
+	}
+	for path, contents := range expected {
+		data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(path)))
+		if err != nil || string(data) != contents {
+			t.Errorf("Expected %s to hold %q, got %q (%v)", path, contents, data, err)
+		}
+	}
+}
+
+func TestFileStorageAllocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btgo-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, alloc := range []Allocation{AllocateSparse, AllocateFull} {
+		s, err := NewFileStorage(storageTorfile(), filepath.Join(dir, "alloc", string('0'+rune(alloc))), alloc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := []byte("xxxxx")
+		if _, err = s.ReadAt(buf, 2, 5); err != nil || !bytes.Equal(buf, make([]byte, 5)) {
+			t.Errorf("Expected preallocated zeros, got %q (%v)", buf, err)
+		}
+		s.Close()
+		info, err := os.Stat(filepath.Join(dir, "alloc", string('0'+rune(alloc)), "top", "sub", "b"))
+		if err != nil || info.Size() != 12 {
+			t.Errorf("Expected file of 12 bytes, got %v (%v)", info, err)
+		}
+	}
+}
+
+func TestFileStorageRejectsUnsafePaths(t *testing.T) {
+	sep := string(os.PathSeparator)
+	for _, path := range []string{"top" + sep + ".." + sep + ".." + sep + "etc", sep + "abs", "top" + sep + sep + "x"} {
+		tfile := &Torfile{files: []File{{path, 1}}, pieceLength: 1, pieces: make([][]byte, 1)}
+		if _, err := NewFileStorage(tfile, os.TempDir(), AllocateSparse); err == nil {
+			t.Errorf("Expected error for path %q", path)
+		}
+	}
+}
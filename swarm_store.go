@@ -0,0 +1,209 @@
+package btgo
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// SwarmStore holds the peers of every swarm a tracker serves, forgets peers
+// that stop announcing, and counts completed downloads for scrape.
+type SwarmStore interface {
+	Announce(infoHash []byte, peer PeerAddr, left int64, event AnnounceEvent, numWant int) ([]PeerAddr, ScrapeResult, error)
+	Scrape(infoHash []byte) (ScrapeResult, error)
+	InfoHashes() ([][]byte, error)
+	Expire() error
+	Close() error
+}
+
+type swarmPeer struct {
+	addr     PeerAddr
+	left     int64
+	lastSeen time.Time
+}
+
+type swarm struct {
+	peers     map[string]*swarmPeer
+	completed int
+}
+
+// MemorySwarmStore keeps the peers of every swarm in memory and forgets peers
+// that have not announced within the TTL.
+type MemorySwarmStore struct {
+	TTL time.Duration
+
+	mu     sync.Mutex
+	swarms map[string]*swarm
+	now    func() time.Time
+}
+
+func NewMemorySwarmStore(ttl time.Duration) *MemorySwarmStore {
+	return &MemorySwarmStore{TTL: ttl, swarms: make(map[string]*swarm), now: time.Now}
+}
+
+// Announce records the peer in the swarm and returns up to numWant other
+// peers, leaving out seeders when the announcing peer is itself a seeder.
+func (s *MemorySwarmStore) Announce(infoHash []byte, peer PeerAddr, left int64, event AnnounceEvent, numWant int) (peers []PeerAddr, counts ScrapeResult, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	sw := s.swarms[string(infoHash)]
+	if sw == nil {
+		sw = &swarm{peers: make(map[string]*swarmPeer)}
+		s.swarms[string(infoHash)] = sw
+	}
+	s.expire(sw, now)
+
+	key := swarmPeerKey(peer)
+	if s.completion(sw, key, event, now) {
+		sw.completed++
+	}
+	if event == EventStopped {
+		delete(sw.peers, key)
+	} else {
+		sw.peers[key] = &swarmPeer{peer, left, now}
+	}
+
+	candidates := make([]PeerAddr, 0, len(sw.peers))
+	for k, p := range sw.peers {
+		if k == key || left == 0 && p.left == 0 {
+			continue
+		}
+		candidates = append(candidates, p.addr)
+	}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	if numWant >= 0 && len(candidates) > numWant {
+		candidates = candidates[:numWant]
+	}
+
+	return candidates, s.counts(sw), nil
+}
+
+func (s *MemorySwarmStore) Scrape(infoHash []byte) (counts ScrapeResult, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sw := s.swarms[string(infoHash)]
+	if sw == nil {
+		return
+	}
+	s.expire(sw, s.now())
+	counts = s.counts(sw)
+	return
+}
+
+// InfoHashes lists the swarms the store knows about.
+func (s *MemorySwarmStore) InfoHashes() (infoHashes [][]byte, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for h := range s.swarms {
+		infoHashes = append(infoHashes, []byte(h))
+	}
+	return
+}
+
+// Expire forgets expired peers in every swarm, and swarms left with neither
+// peers nor completed downloads.
+func (s *MemorySwarmStore) Expire() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for h, sw := range s.swarms {
+		s.expire(sw, now)
+		if len(sw.peers) == 0 && sw.completed == 0 {
+			delete(s.swarms, h)
+		}
+	}
+	return nil
+}
+
+func (s *MemorySwarmStore) Close() error {
+	return nil
+}
+
+// restore puts back state replayed from disk, skipping already expired peers.
+func (s *MemorySwarmStore) restore(infoHash []byte, key string, peer *swarmPeer, completed int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sw := s.swarms[string(infoHash)]
+	if sw == nil {
+		sw = &swarm{peers: make(map[string]*swarmPeer)}
+		s.swarms[string(infoHash)] = sw
+	}
+	sw.completed += completed
+	if peer != nil && !s.expired(peer, s.now()) {
+		sw.peers[key] = peer
+	} else if peer == nil && key != "" {
+		delete(sw.peers, key)
+	}
+}
+
+// snapshot calls fn for every live peer and every swarm's completed count.
+func (s *MemorySwarmStore) snapshot(fn func(infoHash []byte, key string, peer *swarmPeer, completed int) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for h, sw := range s.swarms {
+		if err := fn([]byte(h), "", nil, sw.completed); err != nil {
+			return err
+		}
+		for k, p := range sw.peers {
+			if err := fn([]byte(h), k, p, 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// completes reports whether an announce would count as a completed download.
+func (s *MemorySwarmStore) completes(infoHash []byte, peer PeerAddr, event AnnounceEvent) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.completion(s.swarms[string(infoHash)], swarmPeerKey(peer), event, s.now())
+}
+
+// completion reports whether event completes a download: a completed event
+// from a peer the swarm does not already know as a seeder, so resent events
+// are counted once.
+func (s *MemorySwarmStore) completion(sw *swarm, key string, event AnnounceEvent, now time.Time) bool {
+	if event != EventCompleted {
+		return false
+	}
+	if sw == nil {
+		return true
+	}
+	p := sw.peers[key]
+	return p == nil || p.left > 0 || s.expired(p, now)
+}
+
+func (s *MemorySwarmStore) expire(sw *swarm, now time.Time) {
+	for k, p := range sw.peers {
+		if s.expired(p, now) {
+			delete(sw.peers, k)
+		}
+	}
+}
+
+func (s *MemorySwarmStore) expired(p *swarmPeer, now time.Time) bool {
+	return s.TTL > 0 && now.Sub(p.lastSeen) > s.TTL
+}
+
+func (s *MemorySwarmStore) counts(sw *swarm) (counts ScrapeResult) {
+	counts.Downloaded = sw.completed
+	for _, p := range sw.peers {
+		if p.left == 0 {
+			counts.Complete++
+		} else {
+			counts.Incomplete++
+		}
+	}
+	return
+}
+
+func swarmPeerKey(peer PeerAddr) string {
+	if len(peer.ID) > 0 {
+		return string(peer.ID)
+	}
+	return peer.String()
+}
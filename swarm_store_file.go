@@ -0,0 +1,222 @@
+package btgo
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const compactSwarmLogAfter = 4096
+
+var errSwarmStoreClosed = errors.New("Swarm store is closed")
+
+// FileSwarmStore is a MemorySwarmStore that survives restarts. Every change is
+// appended to a log file as a length-prefixed bencoded record; the log is
+// replayed on open and rewritten from the live state on open and on Expire,
+// or once enough records have piled up.
+type FileSwarmStore struct {
+	mem *MemorySwarmStore
+
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	records int
+	live    int
+}
+
+func OpenFileSwarmStore(path string, ttl time.Duration) (s *FileSwarmStore, err error) {
+	s = &FileSwarmStore{mem: NewMemorySwarmStore(ttl), path: path}
+	if err = s.replay(); err != nil {
+		return nil, err
+	}
+	if err = s.compact(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (s *FileSwarmStore) Announce(infoHash []byte, peer PeerAddr, left int64, event AnnounceEvent, numWant int) (peers []PeerAddr, counts ScrapeResult, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		err = errSwarmStoreClosed
+		return
+	}
+
+	// The record is logged before the memory store changes, so a failed write
+	// leaves both as they were.
+	record := map[string]interface{}{"h": infoHash, "k": swarmPeerKey(peer)}
+	if event == EventStopped {
+		record["del"] = 1
+	} else {
+		record["ip"] = []byte(peer.IP.To16())
+		record["port"] = peer.Port
+		record["id"] = peer.ID
+		record["left"] = left
+		record["seen"] = s.mem.now().UnixNano()
+	}
+	if s.mem.completes(infoHash, peer, event) {
+		record["done"] = 1
+	}
+	if err = s.append(record); err != nil {
+		return
+	}
+	if peers, counts, err = s.mem.Announce(infoHash, peer, left, event, numWant); err != nil {
+		return
+	}
+	if s.records > 2*s.live+compactSwarmLogAfter {
+		err = s.compact()
+	}
+	return
+}
+
+func (s *FileSwarmStore) Scrape(infoHash []byte) (ScrapeResult, error) {
+	return s.mem.Scrape(infoHash)
+}
+
+func (s *FileSwarmStore) InfoHashes() ([][]byte, error) {
+	return s.mem.InfoHashes()
+}
+
+func (s *FileSwarmStore) Expire() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return errSwarmStoreClosed
+	}
+	s.mem.Expire()
+	return s.compact()
+}
+
+func (s *FileSwarmStore) Close() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil {
+		err = s.file.Close()
+		s.file = nil
+	}
+	return
+}
+
+// append writes a record to the log, cutting off whatever part of it was
+// written if the write fails so later records still replay.
+func (s *FileSwarmStore) append(record map[string]interface{}) (err error) {
+	info, err := s.file.Stat()
+	if err != nil {
+		return
+	}
+	encoded := Bencode(record)
+	buf := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(encoded)), uint32(len(encoded)))
+	if _, err = s.file.Write(append(buf, encoded...)); err != nil {
+		s.file.Truncate(info.Size())
+		return
+	}
+	s.records++
+	return
+}
+
+// replay loads the log, stopping quietly at a truncated or corrupt record such
+// as one left by a crash mid-write.
+func (s *FileSwarmStore) replay() (err error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return
+	}
+
+	for len(data) >= 4 {
+		size := int(binary.BigEndian.Uint32(data))
+		if size > len(data)-4 {
+			break
+		}
+		buncoded, err := tryBuncode(data[4 : 4+size])
+		record, ok := buncoded.(map[string]interface{})
+		if err != nil || !ok {
+			break
+		}
+		s.restoreRecord(record)
+		data = data[4+size:]
+	}
+	return nil
+}
+
+func (s *FileSwarmStore) restoreRecord(record map[string]interface{}) {
+	infoHash := bytesFromInterface(record["h"])
+	key := string(bytesFromInterface(record["k"]))
+	completed := 0
+	if record["done"] != nil {
+		completed = 1
+	}
+	if n, ok := record["completed"].(*big.Int); ok {
+		completed = int(n.Int64())
+	}
+
+	var peer *swarmPeer
+	if record["del"] == nil && key != "" {
+		seen, _ := record["seen"].(*big.Int)
+		left, _ := record["left"].(*big.Int)
+		if seen == nil || left == nil {
+			return
+		}
+		peer = &swarmPeer{
+			addr:     PeerAddr{IP: net.IP(bytesFromInterface(record["ip"])), Port: intFromInterface(record["port"]), ID: bytesFromInterface(record["id"])},
+			left:     left.Int64(),
+			lastSeen: time.Unix(0, seen.Int64()),
+		}
+	}
+	s.mem.restore(infoHash, key, peer, completed)
+}
+
+// compact writes the live state to a new log and swaps it in atomically.
+func (s *FileSwarmStore) compact() (err error) {
+	tmp, err := os.Create(s.path + ".tmp")
+	if err != nil {
+		return
+	}
+	records := 0
+	err = s.mem.snapshot(func(infoHash []byte, key string, peer *swarmPeer, completed int) error {
+		record := map[string]interface{}{"h": infoHash}
+		if peer == nil {
+			record["completed"] = completed
+		} else {
+			record["k"] = key
+			record["ip"] = []byte(peer.addr.IP.To16())
+			record["port"] = peer.addr.Port
+			record["id"] = peer.addr.ID
+			record["left"] = peer.left
+			record["seen"] = peer.lastSeen.UnixNano()
+		}
+		encoded := Bencode(record)
+		records++
+		_, err := tmp.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(encoded))), encoded...))
+		return err
+	})
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(s.path+".tmp", s.path)
+	}
+	if err != nil {
+		os.Remove(s.path + ".tmp")
+		return
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	if s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return
+	}
+	s.records, s.live = records, records
+	return
+}
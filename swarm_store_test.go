@@ -0,0 +1,124 @@
+package btgo
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemorySwarmStore(t *testing.T) {
+	store := NewMemorySwarmStore(time.Minute)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	infoHash := []byte("01234567890123456789")
+
+	for i := 0; i < 10; i++ {
+		store.Announce(infoHash, PeerAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 6881}, int64(i), EventStarted, 0)
+	}
+	store.Announce(infoHash, PeerAddr{IP: net.ParseIP("2001:db8::1"), Port: 6881}, 10, EventStarted, 0)
+
+	peers, counts, _ := store.Announce(infoHash, PeerAddr{IP: net.IPv4(10, 0, 0, 0), Port: 6881}, 0, EventNone, 5)
+	if len(peers) != 5 || counts.Complete != 1 || counts.Incomplete != 10 {
+		t.Errorf("Wrong announce result: %v %+v", peers, counts)
+	}
+	v4, v6 := compactPeers(peers)
+	if len(v4)/6+len(v6)/18 != 5 {
+		t.Errorf("Wrong compact sizes: %d %d", len(v4), len(v6))
+	}
+
+	now = now.Add(2 * time.Minute)
+	store.Announce(infoHash, PeerAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}, 1, EventNone, 0)
+	if counts, _ := store.Scrape(infoHash); counts.Complete != 0 || counts.Incomplete != 1 {
+		t.Errorf("Expired peers were not forgotten: %+v", counts)
+	}
+
+	for i := 0; i < 2; i++ {
+		store.Announce(infoHash, PeerAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}, 0, EventCompleted, 0)
+	}
+	if counts, _ := store.Scrape(infoHash); counts.Downloaded != 1 {
+		t.Errorf("Expected a resent completed event to count once, got %d", counts.Downloaded)
+	}
+}
+
+func TestFileSwarmStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "swarms")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "swarms.db")
+
+	now := time.Now()
+	open := func() *FileSwarmStore {
+		store, err := OpenFileSwarmStore(path, time.Hour)
+		if err != nil {
+			t.Fatalf("Failed to open store: %s", err)
+		}
+		store.mem.now = func() time.Time { return now }
+		return store
+	}
+
+	var _ SwarmStore = (*FileSwarmStore)(nil)
+	store := open()
+	a, b := []byte("aaaaaaaaaaaaaaaaaaaa"), []byte("bbbbbbbbbbbbbbbbbbbb")
+	seed := PeerAddr{IP: net.ParseIP("10.0.0.1"), Port: 1, ID: []byte("-SEED-")}
+	leech := PeerAddr{IP: net.ParseIP("2001:db8::2"), Port: 2, ID: []byte("-LEECH-")}
+	gone := PeerAddr{IP: net.ParseIP("10.0.0.3"), Port: 3}
+	store.Announce(a, seed, 100, EventStarted, 0)
+	store.Announce(a, seed, 0, EventCompleted, 0)
+	store.Announce(a, leech, 50, EventStarted, 0)
+	store.Announce(a, gone, 50, EventStarted, 0)
+	store.Announce(a, gone, 50, EventStopped, 0)
+	store.Announce(b, gone, 0, EventCompleted, 0)
+	if err := store.Close(); err != nil {
+		t.Fatalf("Failed to close store: %s", err)
+	}
+
+	store = open()
+	if counts, _ := store.Scrape(a); counts.Complete != 1 || counts.Incomplete != 1 || counts.Downloaded != 1 {
+		t.Errorf("Wrong counts after restart: %+v", counts)
+	}
+	peers, _, err := store.Announce(a, gone, 10, EventStarted, 10)
+	if err != nil || len(peers) != 2 {
+		t.Fatalf("Wrong peers after restart: %v %v", peers, err)
+	}
+	for _, p := range peers {
+		if p.String() != "10.0.0.1:1" && p.String() != "[2001:db8::2]:2" {
+			t.Errorf("Unexpected peer after restart: %s", p)
+		}
+	}
+
+	now = now.Add(2 * time.Hour)
+	if err := store.Expire(); err != nil {
+		t.Fatalf("Expire failed: %s", err)
+	}
+	store.Close()
+	if err := store.Expire(); err == nil {
+		t.Error("Expected Expire after Close to fail")
+	}
+
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte{0, 0, 1, 0, 'd'})
+	f.Close()
+
+	store = open()
+	defer store.Close()
+	if counts, _ := store.Scrape(a); counts.Complete != 0 || counts.Incomplete != 0 || counts.Downloaded != 1 {
+		t.Errorf("Wrong counts after expiry: %+v", counts)
+	}
+	if counts, _ := store.Scrape(b); counts.Downloaded != 1 {
+		t.Errorf("Completed counter lost for swarm without peers: %+v", counts)
+	}
+
+	// A failed log write leaves the swarm as it was.
+	store.file.Close()
+	if _, _, err := store.Announce(a, leech, 0, EventCompleted, 0); err == nil {
+		t.Fatal("Expected announce to fail when the log cannot be written")
+	}
+	if counts, _ := store.Scrape(a); counts.Complete != 0 || counts.Downloaded != 1 {
+		t.Errorf("Failed announce changed the swarm: %+v", counts)
+	}
+}
@@ -4,26 +4,38 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"math/big"
 	"math/rand"
 	"os"
+
+	"golang.org/x/text/encoding"
 )
 
 type File struct {
 	path   string
-	length *big.Int
+	length int64
 }
 
 type Torfile struct {
 	files        []File
 	announceList [][]string
-	pieceLength  *big.Int
+	pieceLength  int64
 	pieces       [][]byte
 	infoHash     []byte
+	rootHash     []byte
+	signatures   []Signature
+	info         map[string]interface{}
+	metainfo     map[string]interface{}
 }
 
 func NewTorfile(file []byte) (tfile *Torfile, err error) {
+	return NewTorfileWithPolicy(file, ReplaceInvalidNames)
+}
+
+func NewTorfileWithPolicy(file []byte, policy NamePolicy) (tfile *Torfile, err error) {
 	buncoded := Buncode(file)
 	m, ok := buncoded.(map[string]interface{})
 	if !ok {
@@ -58,7 +70,7 @@ func NewTorfile(file []byte) (tfile *Torfile, err error) {
 			err = errors.New("Unable to parse outer announce list")
 			return
 		}
-	} else {
+	} else if m["announce"] != nil {
 		announce, ok := stringFromBytesInterface(m["announce"])
 		if !ok {
 			err = errors.New("Unable to parse announce section of torfile")
@@ -78,44 +90,134 @@ func NewTorfile(file []byte) (tfile *Torfile, err error) {
 	io.WriteString(h, bencodedInfo)
 	infoHash := h.Sum(nil)
 
-	pieceLength, ok := info["piece length"].(*big.Int)
-	if !ok {
-		err = errors.New("Unable to parse piece length")
+	pieceLength, err := int64FromInterface(info["piece length"], "piece length")
+	if err != nil {
+		return
+	}
+	if pieceLength <= 0 {
+		err = fmt.Errorf("Piece length %d is not positive", pieceLength)
 		return
 	}
 
-	pieceBytes, ok := info["pieces"].([]byte)
-	if !ok {
-		err = errors.New("Unable to parse piece hashes in torfile")
+	var pieces [][]byte
+	rootHash, isMerkle := info["root hash"].([]byte)
+	if isMerkle {
+		if len(rootHash) != sha1.Size {
+			err = errors.New("Unable to parse root hash in merkle torfile")
+			return
+		}
+	} else {
+		pieceBytes, ok := info["pieces"].([]byte)
+		if !ok {
+			err = errors.New("Unable to parse piece hashes in torfile")
+			return
+		}
+		hashes := len(pieceBytes) / 20
+		pieces = make([][]byte, hashes)
+		for i := 0; i < hashes; i += 1 {
+			pieces[i] = make([]byte, 20)
+			copy(pieces[i][:], pieceBytes[i*20:(i+1)*20])
+		}
+	}
+
+	enc, err := lookupEncoding(string(bytesFromInterface(m["encoding"])))
+	if err != nil {
+		return
+	}
+
+	files, err := filesFromInfo(info, enc, policy)
+	if err != nil {
 		return
 	}
-	hashes := len(pieceBytes) / 20
-	pieces := make([][]byte, hashes)
-	for i := 0; i < hashes; i += 1 {
-		pieces[i] = make([]byte, 20)
-		copy(pieces[i][:], pieceBytes[i*20:(i+1)*20])
+	total, err := sumFileLengths(files)
+	if err != nil {
+		return
+	}
+	if expected := (total + pieceLength - 1) / pieceLength; !isMerkle && expected != int64(len(pieces)) {
+		err = fmt.Errorf("Torfile has %d piece hashes for %d bytes, expected %d", len(pieces), total, expected)
+		return
 	}
 
-	files, err := filesFromInfo(info)
+	signatures, err := signaturesFromMetainfo(m, bencodedInfo)
 	if err != nil {
 		return
 	}
 
-	tfile = &Torfile{files, announceList, pieceLength, pieces, infoHash}
+	tfile = &Torfile{
+		files:        files,
+		announceList: announceList,
+		pieceLength:  pieceLength,
+		pieces:       pieces,
+		infoHash:     infoHash,
+		rootHash:     rootHash,
+		signatures:   signatures,
+		info:         info,
+		metainfo:     m,
+	}
 	return
 }
 
-func filesFromInfo(info map[string]interface{}) (files []File, err error) {
-	name, ok := stringFromBytesInterface(info["name"])
+// Private reports whether the info dictionary sets private=1, in which case
+// peers may only be found through the torfile's trackers.
+func (t *Torfile) Private() bool {
+	return intFromInterface(t.info["private"]) == 1
+}
+
+func (t *Torfile) numPieces() int {
+	if t.rootHash == nil {
+		return len(t.pieces)
+	}
+	total, ok := t.totalLength()
+	if !ok || t.pieceLength <= 0 {
+		return 0
+	}
+	return int((total + t.pieceLength - 1) / t.pieceLength)
+}
+
+// pieceSize is the length of the given piece, which is shorter than
+// pieceLength only for the last piece.
+func (t *Torfile) pieceSize(index int) int64 {
+	total, _ := t.totalLength()
+	if end := int64(index+1) * t.pieceLength; end > total {
+		return total - int64(index)*t.pieceLength
+	}
+	return t.pieceLength
+}
+
+func (t *Torfile) totalLength() (total int64, ok bool) {
+	total, err := sumFileLengths(t.files)
+	return total, err == nil
+}
+
+// sumFileLengths adds up the file lengths, failing if the sum overflows.
+func sumFileLengths(files []File) (total int64, err error) {
+	for _, f := range files {
+		if total > math.MaxInt64-f.length {
+			return 0, errors.New("Total length of files in torfile overflows")
+		}
+		total += f.length
+	}
+	return
+}
+
+func filesFromInfo(info map[string]interface{}, enc encoding.Encoding, policy NamePolicy) (files []File, err error) {
+	nameBytes, ok := info["name"].([]byte)
 	if !ok {
 		err = errors.New("Unable to parse path for single-file torrent")
 		return
 	}
+	name, err := decodeName(nameBytes, bytesFromInterface(info["name.utf-8"]), enc, policy)
+	if err != nil {
+		return
+	}
 
 	if info["files"] == nil {
-		length, ok := info["length"].(*big.Int)
-		if !ok {
-			err = errors.New("Unable to parse length for single-file torrent")
+		var length int64
+		if length, err = int64FromInterface(info["length"], "length for single-file torrent"); err != nil {
+			return
+		}
+		if length < 0 {
+			err = errors.New("Negative length for single-file torrent")
 			return
 		}
 		files = []File{File{name, length}}
@@ -134,9 +236,13 @@ func filesFromInfo(info map[string]interface{}) (files []File, err error) {
 				return
 			}
 
-			length, ok := fileInfo["length"].(*big.Int)
-			if !ok {
-				err = errors.New("Unable to parse file lenfth in multiple-file torrent")
+			var length int64
+			if length, err = int64FromInterface(fileInfo["length"], "file length in multiple-file torrent"); err != nil {
+				return
+			}
+			if length < 0 {
+				err = errors.New("Negative file length in multiple-file torrent")
+				return
 			}
 
 			pathInterfaces, ok := fileInfo["path"].([]interface{})
@@ -144,6 +250,11 @@ func filesFromInfo(info map[string]interface{}) (files []File, err error) {
 				err = errors.New("Unable to parse file path for multiple-file torrent")
 				return
 			}
+			utf8PathInterfaces, _ := fileInfo["path.utf-8"].([]interface{})
+			if len(utf8PathInterfaces) != len(pathInterfaces) {
+				utf8PathInterfaces = nil
+			}
+
 			var pathBuffer bytes.Buffer
 			pathBuffer.WriteString(name)
 			pathBuffer.WriteRune(os.PathSeparator)
@@ -153,7 +264,15 @@ func filesFromInfo(info map[string]interface{}) (files []File, err error) {
 					err = errors.New("Unable to parse file path piece for multiple-file torrent")
 					return
 				}
-				pathBuffer.Write(pathPiece)
+				var utf8PathPiece []byte
+				if utf8PathInterfaces != nil {
+					utf8PathPiece = bytesFromInterface(utf8PathInterfaces[in])
+				}
+				var decoded string
+				if decoded, err = decodeName(pathPiece, utf8PathPiece, enc, policy); err != nil {
+					return
+				}
+				pathBuffer.WriteString(decoded)
 				if in != len(pathInterfaces)-1 {
 					pathBuffer.WriteRune(os.PathSeparator)
 				}
@@ -174,6 +293,25 @@ func stringFromBytesInterface(i interface{}) (s string, ok bool) {
 	return
 }
 
+func int64FromInterface(i interface{}, what string) (n int64, err error) {
+	b, ok := i.(*big.Int)
+	if !ok {
+		err = fmt.Errorf("Unable to parse %s", what)
+		return
+	}
+	if !b.IsInt64() {
+		err = fmt.Errorf("Value %s out of range for %s", b, what)
+		return
+	}
+	n = b.Int64()
+	return
+}
+
+func bytesFromInterface(i interface{}) []byte {
+	b, _ := i.([]byte)
+	return b
+}
+
 func shuffleStrings(strings []string) {
 	for i := range strings {
 		j := rand.Intn(i + 1)
@@ -18,6 +18,49 @@ func TestNewTorfile(t *testing.T) {
 	testStackExchangeTorrent(t)
 }
 
+func TestTorfileLengthOverflow(t *testing.T) {
+	info := map[string]interface{}{"name": "big", "piece length": 16384, "pieces": string(make([]byte, 20))}
+	for _, length := range []string{"9223372036854775808", "-9223372036854775809"} {
+		n := new(big.Int)
+		n.SetString(length, 10)
+		info["length"] = n
+		if _, err := NewTorfile([]byte(Bencode(map[string]interface{}{"info": info}))); err == nil {
+			t.Errorf("Expected length %s to overflow", length)
+		}
+	}
+
+	info["length"], info["piece length"] = int64(1)<<40, int64(1)<<40
+	tfile, err := NewTorfile([]byte(Bencode(map[string]interface{}{"info": info})))
+	if err != nil {
+		t.Fatalf("Failed to parse large torrent: %s", err)
+	}
+	if tfile.files[0].length != 1<<40 {
+		t.Errorf("Wrong length for large torrent: %d", tfile.files[0].length)
+	}
+}
+
+func TestTorfileRejectsBadLengths(t *testing.T) {
+	cases := []struct {
+		what string
+		info map[string]interface{}
+	}{
+		{"negative length", map[string]interface{}{"name": "x", "length": -1, "piece length": 16384, "pieces": string(make([]byte, 20))}},
+		{"negative file length", map[string]interface{}{"name": "x", "piece length": 16384, "pieces": string(make([]byte, 20)), "files": genSlice(
+			map[string]interface{}{"length": 20000, "path": genSlice("a")},
+			map[string]interface{}{"length": -10000, "path": genSlice("b")},
+		)}},
+		{"zero piece length", map[string]interface{}{"name": "x", "length": 1, "piece length": 0, "pieces": string(make([]byte, 20))}},
+		{"negative piece length", map[string]interface{}{"name": "x", "length": 1, "piece length": -16384, "pieces": string(make([]byte, 20))}},
+		{"extra hashes", map[string]interface{}{"name": "x", "length": 20000, "piece length": 16384, "pieces": string(make([]byte, 60))}},
+		{"missing hashes", map[string]interface{}{"name": "x", "length": 40000, "piece length": 16384, "pieces": string(make([]byte, 40))}},
+	}
+	for _, c := range cases {
+		if _, err := NewTorfile([]byte(Bencode(map[string]interface{}{"info": c.info}))); err == nil {
+			t.Errorf("Expected torfile with %s to be rejected", c.what)
+		}
+	}
+}
+
 func testUbuntuTorrent(t *testing.T) {
 	file := "test/ubuntu.torrent"
 	content, err := ioutil.ReadFile(file)
@@ -34,8 +77,7 @@ func testUbuntuTorrent(t *testing.T) {
 		t.Errorf("Wrong announce list for %s: %s", file, tfile.announceList)
 	}
 
-	expected := big.NewInt(524288)
-	if tfile.pieceLength.Cmp(expected) != 0 {
+	if tfile.pieceLength != 524288 {
 		t.Errorf("Wrong pieceLength for %s: %d", file, tfile.pieceLength)
 	}
 
@@ -46,12 +88,11 @@ func testUbuntuTorrent(t *testing.T) {
 	if firstFile.path != "ubuntu-12.10-desktop-amd64.iso" {
 		t.Errorf("Wrong title for file in %s: %s", file, firstFile.path)
 	}
-	expected = big.NewInt(800063488)
-	if firstFile.length.Cmp(expected) != 0 {
+	if firstFile.length != 800063488 {
 		t.Errorf("Wrong length for file in %s: %d", file, tfile.pieceLength)
 	}
 
-	if len(tfile.pieces) != int(math.Ceil(float64(firstFile.length.Int64())/float64(tfile.pieceLength.Int64()))) {
+	if len(tfile.pieces) != int(math.Ceil(float64(firstFile.length)/float64(tfile.pieceLength))) {
 		t.Errorf("Wrong size of piece slice for %s: %d", file, len(tfile.pieces))
 	}
 
@@ -77,8 +118,7 @@ func testBacktrackTorrent(t *testing.T) {
 		t.Errorf("Wrong announce list for %s: %s", file, tfile.announceList)
 	}
 
-	expected := big.NewInt(262144)
-	if tfile.pieceLength.Cmp(expected) != 0 {
+	if tfile.pieceLength != 262144 {
 		t.Errorf("Wrong pieceLength for %s: %d", file, tfile.pieceLength)
 	}
 
@@ -86,13 +126,10 @@ func testBacktrackTorrent(t *testing.T) {
 		t.Fatalf("Wrong number of files for %s: %d", file, len(tfile.files))
 	}
 
-	expected = big.NewInt(33)
-	if tfile.files[0].path != "BT5R3-GNOME-64/BT5R3-GNOME-64.txt" || tfile.files[0].length.Cmp(expected) != 0 {
+	if tfile.files[0].path != "BT5R3-GNOME-64/BT5R3-GNOME-64.txt" || tfile.files[0].length != 33 {
 		t.Errorf("Wrong file information for %s: (%s, %d)", file, tfile.files[0].path, tfile.files[0].length)
 	}
-	expected = new(big.Int)
-	expected.SetString("3306489856", 10)
-	if tfile.files[1].path != "BT5R3-GNOME-64/BT5R3-GNOME-64.iso" || tfile.files[1].length.Cmp(expected) != 0 {
+	if tfile.files[1].path != "BT5R3-GNOME-64/BT5R3-GNOME-64.iso" || tfile.files[1].length != 3306489856 {
 		t.Errorf("Wrong file information for %s: (%s, %d)", file, tfile.files[1].path, tfile.files[1].length)
 	}
 }
@@ -113,8 +150,7 @@ func testMultitracksTorrent(t *testing.T) {
 		t.Errorf("Wrong announce list for %s: %s", file, tfile.announceList)
 	}
 
-	expected := big.NewInt(262144)
-	if tfile.pieceLength.Cmp(expected) != 0 {
+	if tfile.pieceLength != 262144 {
 		t.Errorf("Wrong pieceLength for %s: %d", file, tfile.pieceLength)
 	}
 
@@ -122,28 +158,22 @@ func testMultitracksTorrent(t *testing.T) {
 		t.Fatalf("Wrong number of files for %s: %d", file, len(tfile.files))
 	}
 
-	expected = big.NewInt(753049736)
-	if tfile.files[0].path != "Flembaz - Floppy Disk feat Stylver_multitracks/Content/Flembaz - 10 - Floppy Disk feat Stylver_multitracks/Content/10 - Floppy Disk (feat. Stylver) [Multitracks].rar" || tfile.files[0].length.Cmp(expected) != 0 {
+	if tfile.files[0].path != "Flembaz - Floppy Disk feat Stylver_multitracks/Content/Flembaz - 10 - Floppy Disk feat Stylver_multitracks/Content/10 - Floppy Disk (feat. Stylver) [Multitracks].rar" || tfile.files[0].length != 753049736 {
 		t.Errorf("Wrong file information for %s: (%s, %d)", file, tfile.files[0].path, tfile.files[0].length)
 	}
-	expected = big.NewInt(980)
-	if tfile.files[1].path != "Flembaz - Floppy Disk feat Stylver_multitracks/Content/Flembaz - 10 - Floppy Disk feat Stylver_multitracks/Description.txt" || tfile.files[1].length.Cmp(expected) != 0 {
+	if tfile.files[1].path != "Flembaz - Floppy Disk feat Stylver_multitracks/Content/Flembaz - 10 - Floppy Disk feat Stylver_multitracks/Description.txt" || tfile.files[1].length != 980 {
 		t.Errorf("Wrong file information for %s: (%s, %d)", file, tfile.files[1].path, tfile.files[1].length)
 	}
-	expected = big.NewInt(45)
-	if tfile.files[2].path != "Flembaz - Floppy Disk feat Stylver_multitracks/Content/Flembaz - 10 - Floppy Disk feat Stylver_multitracks/License.txt" || tfile.files[2].length.Cmp(expected) != 0 {
+	if tfile.files[2].path != "Flembaz - Floppy Disk feat Stylver_multitracks/Content/Flembaz - 10 - Floppy Disk feat Stylver_multitracks/License.txt" || tfile.files[2].length != 45 {
 		t.Errorf("Wrong file information for %s: (%s, %d)", file, tfile.files[2].path, tfile.files[2].length)
 	}
-	expected = big.NewInt(57987)
-	if tfile.files[3].path != "Flembaz - Floppy Disk feat Stylver_multitracks/Content/flembaz - 10 - floppy disk feat stylver_multitracks.torrent" || tfile.files[3].length.Cmp(expected) != 0 {
+	if tfile.files[3].path != "Flembaz - Floppy Disk feat Stylver_multitracks/Content/flembaz - 10 - floppy disk feat stylver_multitracks.torrent" || tfile.files[3].length != 57987 {
 		t.Errorf("Wrong file information for %s: (%s, %d)", file, tfile.files[3].path, tfile.files[3].length)
 	}
-	expected = big.NewInt(1170)
-	if tfile.files[4].path != "Flembaz - Floppy Disk feat Stylver_multitracks/Description.txt" || tfile.files[4].length.Cmp(expected) != 0 {
+	if tfile.files[4].path != "Flembaz - Floppy Disk feat Stylver_multitracks/Description.txt" || tfile.files[4].length != 1170 {
 		t.Errorf("Wrong file information for %s: (%s, %d)", file, tfile.files[4].path, tfile.files[4].length)
 	}
-	expected = big.NewInt(45)
-	if tfile.files[5].path != "Flembaz - Floppy Disk feat Stylver_multitracks/License.txt" || tfile.files[5].length.Cmp(expected) != 0 {
+	if tfile.files[5].path != "Flembaz - Floppy Disk feat Stylver_multitracks/License.txt" || tfile.files[5].length != 45 {
 		t.Errorf("Wrong file information for %s: (%s, %d)", file, tfile.files[5].path, tfile.files[5].length)
 	}
 }
@@ -164,24 +194,20 @@ func testStackExchangeTorrent(t *testing.T) {
 		t.Errorf("Wrong announce list for %s: %s", file, tfile.announceList)
 	}
 
-	expected := big.NewInt(8388608)
-	if tfile.pieceLength.Cmp(expected) != 0 {
+	if tfile.pieceLength != 8388608 {
 		t.Errorf("Wrong pieceLength for %s: %d", file, tfile.pieceLength)
 	}
 
 	if len(tfile.files) != 91 {
 		t.Fatalf("Wrong number of files for %s: %d", file, len(tfile.files))
 	}
-	expected = big.NewInt(21122632)
-	if tfile.files[0].path != "Stack Exchange Data Dump - Mar 2013/Content/android.stackexchange.com.7z" || tfile.files[0].length.Cmp(expected) != 0 {
+	if tfile.files[0].path != "Stack Exchange Data Dump - Mar 2013/Content/android.stackexchange.com.7z" || tfile.files[0].length != 21122632 {
 		t.Errorf("Wrong file information for %s: (%s, %d)", file, tfile.files[0].path, tfile.files[0].length)
 	}
-	expected = big.NewInt(1089277)
-	if tfile.files[50].path != "Stack Exchange Data Dump - Mar 2013/Content/meta.ux.stackexchange.com.7z" || tfile.files[50].length.Cmp(expected) != 0 {
+	if tfile.files[50].path != "Stack Exchange Data Dump - Mar 2013/Content/meta.ux.stackexchange.com.7z" || tfile.files[50].length != 1089277 {
 		t.Errorf("Wrong file information for %s: (%s, %d)", file, tfile.files[50].path, tfile.files[50].length)
 	}
-	expected = big.NewInt(48)
-	if tfile.files[90].path != "Stack Exchange Data Dump - Mar 2013/License.txt" || tfile.files[90].length.Cmp(expected) != 0 {
+	if tfile.files[90].path != "Stack Exchange Data Dump - Mar 2013/License.txt" || tfile.files[90].length != 48 {
 		t.Errorf("Wrong file information for %s: (%s, %d)", file, tfile.files[90].path, tfile.files[90].length)
 	}
 }
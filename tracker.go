@@ -0,0 +1,135 @@
+package btgo
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// AnnounceEvent values match the event numbers of the UDP tracker protocol.
+type AnnounceEvent int
+
+const (
+	EventNone AnnounceEvent = iota
+	EventCompleted
+	EventStarted
+	EventStopped
+)
+
+func (e AnnounceEvent) String() string {
+	switch e {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	}
+	return ""
+}
+
+type AnnounceRequest struct {
+	InfoHash   []byte
+	PeerID     []byte
+	Port       int
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      AnnounceEvent
+	NumWant    int // zero or negative asks for the tracker's default
+	Key        uint32
+	TrackerID  string
+}
+
+type AnnounceResponse struct {
+	Interval       time.Duration
+	MinInterval    time.Duration
+	TrackerID      string
+	Complete       int
+	Incomplete     int
+	Peers          []PeerAddr
+	WarningMessage string
+}
+
+type ScrapeResult struct {
+	Complete   int
+	Downloaded int
+	Incomplete int
+}
+
+type PeerAddr struct {
+	IP   net.IP
+	Port int
+	ID   []byte
+}
+
+func (p PeerAddr) String() string {
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(p.Port))
+}
+
+// TrackerError is a failure reported by the tracker itself, as opposed to a
+// transport or decoding error.
+type TrackerError struct {
+	Reason string
+}
+
+func (e *TrackerError) Error() string {
+	return fmt.Sprintf("Tracker failure: %s", e.Reason)
+}
+
+type Tracker interface {
+	Announce(ctx context.Context, req AnnounceRequest) (*AnnounceResponse, error)
+}
+
+type Scraper interface {
+	Scrape(ctx context.Context, infoHashes [][]byte) (map[string]ScrapeResult, error)
+}
+
+// Scrape asks the tracker at announce for counts without announcing. Results
+// are keyed by the raw 20-byte infohash.
+func Scrape(ctx context.Context, announce string, infoHashes [][]byte) (results map[string]ScrapeResult, err error) {
+	tracker, err := NewTrackerForURL(announce)
+	if err != nil {
+		return
+	}
+	scraper, ok := tracker.(Scraper)
+	if !ok {
+		err = ErrScrapeUnsupported
+		return
+	}
+	return scraper.Scrape(ctx, infoHashes)
+}
+
+func parseCompactPeers(b []byte, ipLen int) (peers []PeerAddr, err error) {
+	size := ipLen + 2
+	if len(b)%size != 0 {
+		err = fmt.Errorf("Compact peer list of %d bytes is not a multiple of %d", len(b), size)
+		return
+	}
+	peers = make([]PeerAddr, 0, len(b)/size)
+	for i := 0; i < len(b); i += size {
+		ip := make(net.IP, ipLen)
+		copy(ip, b[i:i+ipLen])
+		peers = append(peers, PeerAddr{IP: ip, Port: int(binary.BigEndian.Uint16(b[i+ipLen:]))})
+	}
+	return
+}
+
+// compactPeers packs peers into the IPv4 and IPv6 compact formats, skipping
+// peers of the other family.
+func compactPeers(peers []PeerAddr) (v4 []byte, v6 []byte) {
+	v4, v6 = []byte{}, []byte{}
+	for _, p := range peers {
+		port := make([]byte, 2)
+		binary.BigEndian.PutUint16(port, uint16(p.Port))
+		if ip := p.IP.To4(); ip != nil {
+			v4 = append(append(v4, ip...), port...)
+		} else if ip := p.IP.To16(); ip != nil {
+			v6 = append(append(v6, ip...), port...)
+		}
+	}
+	return
+}
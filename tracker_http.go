@@ -0,0 +1,242 @@
+package btgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	httpMaxScrapeHashes    = 50
+	maxHTTPTrackerResponse = 4 << 20
+)
+
+var ErrScrapeUnsupported = errors.New("Tracker does not support scrape")
+
+type HTTPTracker struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewHTTPTracker(announce string) *HTTPTracker {
+	return &HTTPTracker{URL: announce, Client: http.DefaultClient}
+}
+
+func (t *HTTPTracker) Announce(ctx context.Context, req AnnounceRequest) (resp *AnnounceResponse, err error) {
+	params := [][2]string{
+		{"info_hash", string(req.InfoHash)},
+		{"peer_id", string(req.PeerID)},
+		{"port", strconv.Itoa(req.Port)},
+		{"uploaded", strconv.FormatInt(req.Uploaded, 10)},
+		{"downloaded", strconv.FormatInt(req.Downloaded, 10)},
+		{"left", strconv.FormatInt(req.Left, 10)},
+		{"compact", "1"},
+		{"key", strconv.FormatUint(uint64(req.Key), 16)},
+	}
+	if req.Event != EventNone {
+		params = append(params, [2]string{"event", req.Event.String()})
+	}
+	if req.NumWant > 0 {
+		params = append(params, [2]string{"numwant", strconv.Itoa(req.NumWant)})
+	}
+	if req.TrackerID != "" {
+		params = append(params, [2]string{"trackerid", req.TrackerID})
+	}
+
+	m, err := t.get(ctx, t.URL, params)
+	if err != nil {
+		return
+	}
+	return announceResponseFromDict(m)
+}
+
+// Scrape fetches counts for infoHashes from the tracker's scrape URL, asking
+// for several infohashes per request.
+func (t *HTTPTracker) Scrape(ctx context.Context, infoHashes [][]byte) (results map[string]ScrapeResult, err error) {
+	scrape, err := ScrapeURL(t.URL)
+	if err != nil {
+		return
+	}
+
+	results = make(map[string]ScrapeResult, len(infoHashes))
+	for begin := 0; begin < len(infoHashes); begin += httpMaxScrapeHashes {
+		end := begin + httpMaxScrapeHashes
+		if end > len(infoHashes) {
+			end = len(infoHashes)
+		}
+		params := make([][2]string, 0, end-begin)
+		for _, h := range infoHashes[begin:end] {
+			params = append(params, [2]string{"info_hash", string(h)})
+		}
+
+		var m map[string]interface{}
+		if m, err = t.get(ctx, scrape, params); err != nil {
+			return nil, err
+		}
+		files, ok := m["files"].(map[string]interface{})
+		if !ok {
+			return nil, errors.New("Unable to parse files in scrape response")
+		}
+		for hash, e := range files {
+			d, ok := e.(map[string]interface{})
+			if !ok {
+				return nil, errors.New("Unable to parse file in scrape response")
+			}
+			results[hash] = ScrapeResult{
+				Complete:   intFromInterface(d["complete"]),
+				Downloaded: intFromInterface(d["downloaded"]),
+				Incomplete: intFromInterface(d["incomplete"]),
+			}
+		}
+	}
+	return
+}
+
+func (t *HTTPTracker) get(ctx context.Context, base string, params [][2]string) (m map[string]interface{}, err error) {
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", appendQuery(base, params), nil)
+	if err != nil {
+		return
+	}
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return
+	}
+	defer httpResp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(httpResp.Body, maxHTTPTrackerResponse+1))
+	if err != nil {
+		return
+	}
+	if len(body) > maxHTTPTrackerResponse {
+		err = errors.New("Tracker response is too large")
+		return
+	}
+
+	buncoded, err := tryBuncode(body)
+	m, _ = buncoded.(map[string]interface{})
+	if reason, ok := m["failure reason"].([]byte); ok {
+		return nil, &TrackerError{string(reason)}
+	}
+	if httpResp.StatusCode < 200 || httpResp.StatusCode > 299 {
+		return nil, fmt.Errorf("Tracker responded with %s", httpResp.Status)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		err = errors.New("Unable to parse tracker response")
+	}
+	return
+}
+
+func announceResponseFromDict(m map[string]interface{}) (resp *AnnounceResponse, err error) {
+	resp = &AnnounceResponse{
+		Interval:       time.Duration(intFromInterface(m["interval"])) * time.Second,
+		MinInterval:    time.Duration(intFromInterface(m["min interval"])) * time.Second,
+		TrackerID:      string(bytesFromInterface(m["tracker id"])),
+		Complete:       intFromInterface(m["complete"]),
+		Incomplete:     intFromInterface(m["incomplete"]),
+		WarningMessage: string(bytesFromInterface(m["warning message"])),
+	}
+
+	switch peers := m["peers"].(type) {
+	case []byte:
+		if resp.Peers, err = parseCompactPeers(peers, net.IPv4len); err != nil {
+			return nil, err
+		}
+	case []interface{}:
+		for _, e := range peers {
+			d, ok := e.(map[string]interface{})
+			if !ok {
+				return nil, errors.New("Unable to parse peer in tracker response")
+			}
+			ip := net.ParseIP(string(bytesFromInterface(d["ip"])))
+			if ip == nil {
+				continue
+			}
+			resp.Peers = append(resp.Peers, PeerAddr{IP: ip, Port: intFromInterface(d["port"]), ID: bytesFromInterface(d["peer id"])})
+		}
+	}
+	if peers6, ok := m["peers6"].([]byte); ok {
+		v6, err := parseCompactPeers(peers6, net.IPv6len)
+		if err != nil {
+			return nil, err
+		}
+		resp.Peers = append(resp.Peers, v6...)
+	}
+	return
+}
+
+// ScrapeURL derives the scrape URL from an announce URL: UDP trackers scrape
+// at the same address, and HTTP trackers whose last path element starts with
+// "announce" scrape where that word is replaced by "scrape".
+func ScrapeURL(announce string) (scrape string, err error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return
+	}
+	if u.Scheme == "udp" {
+		scrape = announce
+		return
+	}
+	slash := strings.LastIndex(u.Path, "/")
+	if slash < 0 || !strings.HasPrefix(u.Path[slash+1:], "announce") {
+		err = ErrScrapeUnsupported
+		return
+	}
+	u.Path = u.Path[:slash+1] + "scrape" + strings.TrimPrefix(u.Path[slash+1:], "announce")
+	u.RawPath = ""
+	scrape = u.String()
+	return
+}
+
+// appendQuery adds params to base, which may already carry a query such as a
+// passkey. Values are escaped byte by byte so binary hashes survive intact.
+func appendQuery(base string, params [][2]string) string {
+	var b strings.Builder
+	b.WriteString(base)
+	sep := "?"
+	if strings.Contains(base, "?") {
+		sep = "&"
+	}
+	for _, p := range params {
+		b.WriteString(sep)
+		b.WriteString(p[0])
+		b.WriteByte('=')
+		b.WriteString(escapeBytes(p[1]))
+		sep = "&"
+	}
+	return b.String()
+}
+
+func escapeBytes(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func intFromInterface(i interface{}) int {
+	if b, ok := i.(*big.Int); ok && b.IsInt64() {
+		return int(b.Int64())
+	}
+	return 0
+}
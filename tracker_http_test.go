@@ -0,0 +1,189 @@
+package btgo
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPTrackerAnnounce(t *testing.T) {
+	infoHash := []byte("\x00 +&?=\xff\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d")
+	peerID := []byte("-BG0001-abcdefghijkl")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("passkey") != "secret" {
+			t.Errorf("Lost existing query: %s", r.URL.RawQuery)
+		}
+		if !bytes.Equal([]byte(q.Get("info_hash")), infoHash) || !bytes.Equal([]byte(q.Get("peer_id")), peerID) {
+			t.Errorf("Wrong hashes in query: %s", r.URL.RawQuery)
+		}
+		expected := map[string]string{"port": "6881", "uploaded": "10", "downloaded": "20", "left": "30", "event": "started", "compact": "1", "numwant": "50", "key": "beef", "trackerid": "tid"}
+		for k, v := range expected {
+			if q.Get(k) != v {
+				t.Errorf("Wrong %s in query: %q", k, q.Get(k))
+			}
+		}
+
+		v4, v6 := compactPeers([]PeerAddr{{IP: net.ParseIP("10.0.0.1"), Port: 6881}, {IP: net.ParseIP("::1"), Port: 51413}})
+		w.Write([]byte(Bencode(map[string]interface{}{
+			"interval":        1800,
+			"min interval":    900,
+			"tracker id":      "tid2",
+			"complete":        5,
+			"incomplete":      7,
+			"warning message": "be nice",
+			"peers":           v4,
+			"peers6":          v6,
+		})))
+	}))
+	defer server.Close()
+
+	tracker := NewHTTPTracker(server.URL + "/announce?passkey=secret")
+	resp, err := tracker.Announce(context.Background(), AnnounceRequest{
+		InfoHash: infoHash, PeerID: peerID, Port: 6881,
+		Uploaded: 10, Downloaded: 20, Left: 30,
+		Event: EventStarted, NumWant: 50, Key: 0xbeef, TrackerID: "tid",
+	})
+	if err != nil {
+		t.Fatalf("Announce failed: %s", err)
+	}
+	if resp.Interval != 30*time.Minute || resp.MinInterval != 15*time.Minute || resp.TrackerID != "tid2" {
+		t.Errorf("Wrong intervals in response: %+v", resp)
+	}
+	if resp.Complete != 5 || resp.Incomplete != 7 || resp.WarningMessage != "be nice" {
+		t.Errorf("Wrong counts in response: %+v", resp)
+	}
+	if len(resp.Peers) != 2 || resp.Peers[0].String() != "10.0.0.1:6881" || resp.Peers[1].String() != "[::1]:51413" {
+		t.Errorf("Wrong peers in response: %v", resp.Peers)
+	}
+}
+
+func TestHTTPTrackerDictionaryPeers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if q := r.URL.Query(); q.Get("event") != "" || q["numwant"] != nil {
+			t.Errorf("Unexpected event or numwant for regular announce: %s", r.URL.RawQuery)
+		}
+		w.Write([]byte(Bencode(map[string]interface{}{
+			"interval": 60,
+			"peers": genSlice(
+				map[string]interface{}{"peer id": "-XX0001-000000000000", "ip": "192.168.1.2", "port": 1234},
+				map[string]interface{}{"peer id": "-XX0001-111111111111", "ip": "2001:db8::2", "port": 5678},
+			),
+		})))
+	}))
+	defer server.Close()
+
+	resp, err := NewHTTPTracker(server.URL).Announce(context.Background(), AnnounceRequest{})
+	if err != nil {
+		t.Fatalf("Announce failed: %s", err)
+	}
+	if len(resp.Peers) != 2 || resp.Peers[0].String() != "192.168.1.2:1234" || string(resp.Peers[1].ID) != "-XX0001-111111111111" {
+		t.Errorf("Wrong peers in response: %v", resp.Peers)
+	}
+}
+
+func TestHTTPTrackerFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(Bencode(map[string]interface{}{"failure reason": "unregistered torrent"})))
+	}))
+	defer server.Close()
+
+	_, err := NewHTTPTracker(server.URL).Announce(context.Background(), AnnounceRequest{})
+	if terr, ok := err.(*TrackerError); !ok || terr.Reason != "unregistered torrent" {
+		t.Errorf("Expected tracker failure, got %v", err)
+	}
+
+	garbage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not a tracker", http.StatusNotFound)
+	}))
+	defer garbage.Close()
+	if _, err := NewHTTPTracker(garbage.URL).Announce(context.Background(), AnnounceRequest{}); err == nil {
+		t.Error("Expected garbage response to fail")
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(Bencode(map[string]interface{}{"interval": 1800, "peers": ""})))
+	}))
+	defer failing.Close()
+	if _, err := NewHTTPTracker(failing.URL).Announce(context.Background(), AnnounceRequest{}); err == nil {
+		t.Error("Expected error status to fail despite a valid body")
+	}
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(Bencode(map[string]interface{}{"failure reason": "banned"})))
+	}))
+	defer rejecting.Close()
+	if _, err := NewHTTPTracker(rejecting.URL).Announce(context.Background(), AnnounceRequest{}); err == nil || err.(*TrackerError).Reason != "banned" {
+		t.Errorf("Expected failure reason with error status, got %v", err)
+	}
+
+	huge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(Bencode(map[string]interface{}{"interval": 1800, "peers": make([]byte, maxHTTPTrackerResponse)})))
+	}))
+	defer huge.Close()
+	if _, err := NewHTTPTracker(huge.URL).Announce(context.Background(), AnnounceRequest{}); err == nil {
+		t.Error("Expected oversized response to fail")
+	}
+}
+
+func TestScrapeURL(t *testing.T) {
+	cases := map[string]string{
+		"http://example.com/announce":            "http://example.com/scrape",
+		"http://example.com/x/announce":          "http://example.com/x/scrape",
+		"http://example.com/announce.php":        "http://example.com/scrape.php",
+		"http://example.com/announce?x2%0644":    "http://example.com/scrape?x2%0644",
+		"http://example.com/announce?passkey=ab": "http://example.com/scrape?passkey=ab",
+		"udp://example.com:80":                   "udp://example.com:80",
+		"http://example.com/a":                   "",
+		"http://example.com/announce/x":          "",
+	}
+	for announce, expected := range cases {
+		scrape, err := ScrapeURL(announce)
+		if expected == "" && err != ErrScrapeUnsupported {
+			t.Errorf("Expected %s to be unscrapable, got %s", announce, scrape)
+		} else if expected != "" && scrape != expected {
+			t.Errorf("Wrong scrape URL for %s: %s (%v)", announce, scrape, err)
+		}
+	}
+}
+
+func TestHTTPTrackerScrape(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/scrape" {
+			t.Errorf("Wrong scrape path: %s", r.URL.Path)
+		}
+		files := make(map[string]interface{})
+		for _, h := range r.URL.Query()["info_hash"] {
+			files[h] = map[string]interface{}{"complete": int(h[0]), "downloaded": 3, "incomplete": int(h[1])}
+		}
+		w.Write([]byte(Bencode(map[string]interface{}{"files": files})))
+	}))
+	defer server.Close()
+
+	var hashes [][]byte
+	for i := 0; i < 60; i++ {
+		hashes = append(hashes, append([]byte{byte(i), byte(255 - i)}, make([]byte, 18)...))
+	}
+	results, err := Scrape(context.Background(), server.URL+"/announce", hashes)
+	if err != nil {
+		t.Fatalf("Scrape failed: %s", err)
+	}
+	if requests != 2 || len(results) != 60 {
+		t.Errorf("Wrong number of requests or results: %d, %d", requests, len(results))
+	}
+	if r := results[string(hashes[55])]; r.Complete != 55 || r.Downloaded != 3 || r.Incomplete != 200 {
+		t.Errorf("Wrong scrape result: %+v", r)
+	}
+
+	if _, err := NewHTTPTracker(server.URL+"/tracker").Scrape(context.Background(), hashes); err != ErrScrapeUnsupported {
+		t.Errorf("Expected unscrapable tracker, got %v", err)
+	}
+}
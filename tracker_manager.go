@@ -0,0 +1,264 @@
+package btgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAnnounceInterval = 30 * time.Minute
+	failedAnnounceRetry     = time.Minute
+)
+
+var (
+	ErrNoTrackers       = errors.New("Torfile has no trackers")
+	ErrAnnounceTooSoon  = errors.New("Announce would violate tracker min interval")
+	ErrNoTrackerReached = errors.New("No tracker responded")
+)
+
+type TrackerStatus struct {
+	URL          string
+	Tier         int
+	LastAnnounce time.Time
+	Interval     time.Duration
+	MinInterval  time.Duration
+	Seeders      int
+	Leechers     int
+	LastError    error
+}
+
+// trackerEntry is one tracker of a tier, with the events it has accepted so
+// each tracker sees started before completed and stopped even across
+// failovers.
+type trackerEntry struct {
+	tracker    Tracker
+	trackerID  string
+	status     TrackerStatus
+	started    bool
+	wasLeecher bool
+	completed  bool
+}
+
+// event picks the event of the next regular announce to e.
+func (e *trackerEntry) event(left int64) AnnounceEvent {
+	switch {
+	case !e.started:
+		return EventStarted
+	case left == 0 && e.wasLeecher && !e.completed:
+		return EventCompleted
+	}
+	return EventNone
+}
+
+// TrackerManager announces to the tiers of a torfile as described in BEP 12:
+// tiers are tried in order, trackers within a tier in their shuffled order,
+// and the first tracker to respond is moved to the front of its tier. It
+// chooses the started, completed and stopped events itself, for each tracker.
+type TrackerManager struct {
+	newTracker func(announce string) (Tracker, error)
+	now        func() time.Time
+
+	announceMu sync.Mutex
+	mu         sync.Mutex
+	tiers      [][]*trackerEntry
+	next       time.Time
+}
+
+func NewTrackerManager(tfile *Torfile) *TrackerManager {
+	m := &TrackerManager{newTracker: NewTrackerForURL, now: time.Now}
+	for i, tier := range tfile.announceList {
+		entries := make([]*trackerEntry, len(tier))
+		for j, announce := range tier {
+			entries[j] = &trackerEntry{status: TrackerStatus{URL: announce, Tier: i}}
+		}
+		m.tiers = append(m.tiers, entries)
+	}
+	return m
+}
+
+func NewTrackerForURL(announce string) (Tracker, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return NewHTTPTracker(announce), nil
+	case "udp":
+		return NewUDPTracker(announce)
+	}
+	return nil, fmt.Errorf("Unsupported tracker URL: %s", announce)
+}
+
+// Announce reports progress to the first tracker that responds. req.Event is
+// ignored: a tracker's first announce is started, its first announce with
+// nothing left after leeching is completed, and the rest are regular
+// announces. If the preferred tracker's min interval has not passed yet it
+// returns ErrAnnounceTooSoon rather than failing over.
+func (m *TrackerManager) Announce(ctx context.Context, req AnnounceRequest) (resp *AnnounceResponse, err error) {
+	m.announceMu.Lock()
+	defer m.announceMu.Unlock()
+
+	tiers := m.snapshot()
+	if len(tiers) == 0 {
+		return nil, ErrNoTrackers
+	}
+
+	err = ErrNoTrackerReached
+	for ti, tier := range tiers {
+		for _, e := range tier {
+			now := m.now()
+			m.mu.Lock()
+			r := req
+			r.Event = e.event(req.Left)
+			r.TrackerID = e.trackerID
+			tooSoon := r.Event == EventNone && !e.status.LastAnnounce.IsZero() && now.Before(e.status.LastAnnounce.Add(e.status.MinInterval))
+			tracker := e.tracker
+			m.mu.Unlock()
+			if tooSoon {
+				return nil, ErrAnnounceTooSoon
+			}
+
+			if tracker == nil {
+				if tracker, err = m.newTracker(e.status.URL); err != nil {
+					m.recordFailure(e, err)
+					continue
+				}
+			}
+			resp, err = tracker.Announce(ctx, r)
+			if err != nil {
+				m.mu.Lock()
+				e.tracker = tracker
+				m.mu.Unlock()
+				m.recordFailure(e, err)
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				continue
+			}
+
+			m.recordSuccess(ti, e, tracker, r, resp, now)
+			return
+		}
+	}
+
+	m.mu.Lock()
+	m.next = m.now().Add(failedAnnounceRetry)
+	m.mu.Unlock()
+	return nil, err
+}
+
+// Stop sends the stopped event to every tracker that accepted a started
+// event, returning the first error.
+func (m *TrackerManager) Stop(ctx context.Context, req AnnounceRequest) (err error) {
+	m.announceMu.Lock()
+	defer m.announceMu.Unlock()
+
+	for ti, tier := range m.snapshot() {
+		for _, e := range tier {
+			m.mu.Lock()
+			r := req
+			r.Event = EventStopped
+			r.TrackerID = e.trackerID
+			started, tracker := e.started, e.tracker
+			m.mu.Unlock()
+			if !started || tracker == nil {
+				continue
+			}
+
+			now := m.now()
+			resp, announceErr := tracker.Announce(ctx, r)
+			if announceErr != nil {
+				m.recordFailure(e, announceErr)
+				if err == nil {
+					err = announceErr
+				}
+				continue
+			}
+			m.recordSuccess(ti, e, tracker, r, resp, now)
+		}
+	}
+	return
+}
+
+// NextAnnounce is when the next regular announce is due, according to the
+// interval of the tracker that last responded.
+func (m *TrackerManager) NextAnnounce() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.next
+}
+
+func (m *TrackerManager) Status() (statuses []TrackerStatus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, tier := range m.tiers {
+		for _, e := range tier {
+			statuses = append(statuses, e.status)
+		}
+	}
+	return
+}
+
+// snapshot copies the tiers so they can be walked while recordSuccess
+// reorders them.
+func (m *TrackerManager) snapshot() [][]*trackerEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tiers := make([][]*trackerEntry, len(m.tiers))
+	for i, tier := range m.tiers {
+		tiers[i] = append([]*trackerEntry(nil), tier...)
+	}
+	return tiers
+}
+
+func (m *TrackerManager) recordFailure(e *trackerEntry, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e.status.LastError = err
+}
+
+func (m *TrackerManager) recordSuccess(tier int, e *trackerEntry, tracker Tracker, req AnnounceRequest, resp *AnnounceResponse, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e.tracker = tracker
+	if resp.TrackerID != "" {
+		e.trackerID = resp.TrackerID
+	}
+	e.status.LastAnnounce = now
+	e.status.LastError = nil
+	e.status.Interval = resp.Interval
+	if e.status.Interval <= 0 {
+		e.status.Interval = defaultAnnounceInterval
+	}
+	e.status.MinInterval = resp.MinInterval
+	e.status.Seeders = resp.Complete
+	e.status.Leechers = resp.Incomplete
+
+	entries := m.tiers[tier]
+	for i, other := range entries {
+		if other == e {
+			copy(entries[1:i+1], entries[:i])
+			entries[0] = e
+			break
+		}
+	}
+
+	switch req.Event {
+	case EventStarted:
+		e.started, e.wasLeecher = true, req.Left > 0
+	case EventCompleted:
+		e.completed = true
+	case EventStopped:
+		e.started, e.completed = false, false
+	}
+	if req.Left > 0 {
+		e.wasLeecher = true
+	}
+	m.next = now.Add(e.status.Interval)
+}
@@ -0,0 +1,166 @@
+package btgo
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeTracker struct {
+	url      string
+	mu       *sync.Mutex
+	failing  map[string]bool
+	requests *[]AnnounceRequest
+	hits     *[]string
+}
+
+func (t *fakeTracker) Announce(ctx context.Context, req AnnounceRequest) (*AnnounceResponse, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	*t.hits = append(*t.hits, t.url)
+	if t.failing[t.url] {
+		return nil, errors.New("unreachable")
+	}
+	*t.requests = append(*t.requests, req)
+	return &AnnounceResponse{Interval: 10 * time.Minute, MinInterval: 5 * time.Minute, TrackerID: "id-" + t.url, Complete: 4, Incomplete: 2}, nil
+}
+
+func newFakeTrackerManager(tiers [][]string, failing map[string]bool) (m *TrackerManager, clock *time.Time, requests *[]AnnounceRequest, hits *[]string) {
+	m = NewTrackerManager(&Torfile{announceList: tiers})
+	now := time.Date(2013, 4, 1, 0, 0, 0, 0, time.UTC)
+	clock, requests, hits = &now, &[]AnnounceRequest{}, &[]string{}
+	mu := &sync.Mutex{}
+	m.now = func() time.Time { return *clock }
+	m.newTracker = func(announce string) (Tracker, error) {
+		return &fakeTracker{announce, mu, failing, requests, hits}, nil
+	}
+	return
+}
+
+func TestTrackerManagerTiers(t *testing.T) {
+	failing := map[string]bool{"a1": true, "a2": true, "b1": true}
+	m, _, _, hits := newFakeTrackerManager([][]string{{"a1", "a2"}, {"b1", "b2", "b3"}}, failing)
+
+	if _, err := m.Announce(context.Background(), AnnounceRequest{Left: 10}); err != nil {
+		t.Fatalf("Announce failed: %s", err)
+	}
+	if !sameSlice(*hits, []string{"a1", "a2", "b1", "b2"}) {
+		t.Errorf("Wrong tracker order: %v", *hits)
+	}
+	if m.tiers[1][0].status.URL != "b2" || m.tiers[1][1].status.URL != "b1" || m.tiers[1][2].status.URL != "b3" {
+		t.Errorf("Responsive tracker was not promoted: %v", m.Status())
+	}
+
+	statuses := m.Status()
+	if statuses[0].LastError == nil || statuses[2].Seeders != 4 || statuses[2].Leechers != 2 || statuses[2].Tier != 1 {
+		t.Errorf("Wrong statuses: %+v", statuses)
+	}
+
+	*hits = nil
+	delete(failing, "a1")
+	if _, err := m.Announce(context.Background(), AnnounceRequest{Left: 10, Event: EventStopped}); err != nil {
+		t.Fatalf("Announce failed: %s", err)
+	}
+	if !sameSlice(*hits, []string{"a1"}) || m.tiers[0][0].status.URL != "a1" {
+		t.Errorf("Expected first tier to be retried first: %v", *hits)
+	}
+
+	failing["a1"], failing["b2"] = true, true
+	m, _, _, _ = newFakeTrackerManager([][]string{{"a1"}, {"b2"}}, failing)
+	if _, err := m.Announce(context.Background(), AnnounceRequest{}); err == nil {
+		t.Error("Expected announce to fail when no tracker responds")
+	}
+	if _, err := NewTrackerManager(&Torfile{}).Announce(context.Background(), AnnounceRequest{}); err != ErrNoTrackers {
+		t.Errorf("Expected ErrNoTrackers, got %v", err)
+	}
+}
+
+func TestTrackerManagerEvents(t *testing.T) {
+	m, clock, requests, _ := newFakeTrackerManager([][]string{{"a"}}, nil)
+	ctx := context.Background()
+
+	announce := func(left int64) {
+		if _, err := m.Announce(ctx, AnnounceRequest{Left: left, Event: EventStopped}); err != nil {
+			t.Fatalf("Announce failed: %s", err)
+		}
+	}
+	announce(100)
+	if m.NextAnnounce() != clock.Add(10*time.Minute) {
+		t.Errorf("Wrong next announce: %s", m.NextAnnounce())
+	}
+
+	*clock = clock.Add(time.Minute)
+	if _, err := m.Announce(ctx, AnnounceRequest{Left: 50}); err != ErrAnnounceTooSoon {
+		t.Errorf("Expected min interval to be honoured, got %v", err)
+	}
+
+	*clock = clock.Add(5 * time.Minute)
+	announce(50)
+	*clock = clock.Add(10 * time.Minute)
+	announce(0)
+	*clock = clock.Add(10 * time.Minute)
+	announce(0)
+	if err := m.Stop(ctx, AnnounceRequest{}); err != nil {
+		t.Fatalf("Stop failed: %s", err)
+	}
+
+	events := make([]AnnounceEvent, len(*requests))
+	for i, r := range *requests {
+		events[i] = r.Event
+	}
+	if !sameSlice(events, []AnnounceEvent{EventStarted, EventNone, EventCompleted, EventNone, EventStopped}) {
+		t.Errorf("Wrong event sequence: %v", events)
+	}
+	if (*requests)[0].TrackerID != "" || (*requests)[1].TrackerID != "id-a" {
+		t.Errorf("Tracker ID was not sent back")
+	}
+
+	m, clock, requests, _ = newFakeTrackerManager([][]string{{"a"}}, nil)
+	if err := m.Stop(ctx, AnnounceRequest{}); err != nil || len(*requests) != 0 {
+		t.Errorf("Stop before start should not announce: %v", err)
+	}
+	announce(0)
+	*clock = clock.Add(time.Hour)
+	announce(0)
+	if (*requests)[1].Event != EventNone {
+		t.Errorf("Seeding from the start should not send completed: %v", (*requests)[1].Event)
+	}
+}
+
+func TestTrackerManagerFailover(t *testing.T) {
+	failing := map[string]bool{}
+	m, clock, requests, hits := newFakeTrackerManager([][]string{{"a", "b"}}, failing)
+	ctx := context.Background()
+
+	if _, err := m.Announce(ctx, AnnounceRequest{Left: 100}); err != nil {
+		t.Fatalf("Announce failed: %s", err)
+	}
+	failing["a"] = true
+	*clock = clock.Add(10 * time.Minute)
+	if _, err := m.Announce(ctx, AnnounceRequest{Left: 50}); err != nil {
+		t.Fatalf("Announce failed: %s", err)
+	}
+	delete(failing, "a")
+
+	*hits = nil
+	*clock = clock.Add(time.Minute)
+	if _, err := m.Announce(ctx, AnnounceRequest{Left: 50}); err != ErrAnnounceTooSoon {
+		t.Errorf("Expected ErrAnnounceTooSoon, got %v", err)
+	}
+	if len(*hits) != 0 {
+		t.Errorf("Expected no failover while the preferred tracker is too soon: %v", *hits)
+	}
+
+	if err := m.Stop(ctx, AnnounceRequest{Left: 50}); err != nil {
+		t.Fatalf("Stop failed: %s", err)
+	}
+	var got []string
+	for _, r := range *requests {
+		got = append(got, r.TrackerID+":"+r.Event.String())
+	}
+	if !sameSlice(got, []string{":started", ":started", "id-b:stopped", "id-a:stopped"}) {
+		t.Errorf("Wrong announces: %v", got)
+	}
+}
@@ -0,0 +1,226 @@
+package btgo
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultServerNumWant = 50
+	maxServerNumWant     = 200
+)
+
+// TrackerServer is an http.Handler serving /announce and /scrape under any
+// prefix. It keeps swarms in Store, in memory unless replaced, and once Allow
+// has been called only tracks the allowed infohashes. Users registered with
+// AddUser announce with their passkey as a passkey query parameter, or with
+// PasskeyInPath as the path element before /announce, and private torfiles
+// accept only announces from registered users. Expired peers and user
+// sessions are swept at most once an Interval, as announces come in.
+type TrackerServer struct {
+	Interval      time.Duration
+	MinInterval   time.Duration
+	Store         SwarmStore
+	PasskeyInPath bool
+
+	now func() time.Time
+
+	mu         sync.RWMutex
+	lastExpire time.Time
+	allowed    map[string]bool
+	private    map[string]bool
+	users      map[string]*UserStats
+	sessions   map[string]*userSession
+}
+
+func NewTrackerServer() *TrackerServer {
+	return &TrackerServer{
+		Interval:    defaultAnnounceInterval,
+		MinInterval: defaultAnnounceInterval / 2,
+		Store:       NewMemorySwarmStore(2 * defaultAnnounceInterval),
+		now:         time.Now,
+	}
+}
+
+// Allow adds the torfiles' infohashes to the allow-list, remembering which
+// of them are private.
+func (s *TrackerServer) Allow(tfiles ...*Torfile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.allowed == nil {
+		s.allowed = make(map[string]bool)
+		s.private = make(map[string]bool)
+	}
+	for _, tfile := range tfiles {
+		s.allowed[string(tfile.infoHash)] = true
+		s.private[string(tfile.infoHash)] = tfile.Private()
+	}
+}
+
+func (s *TrackerServer) isAllowed(infoHash []byte) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.allowed == nil || s.allowed[string(infoHash)]
+}
+
+func (s *TrackerServer) isPrivate(infoHash []byte) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.private[string(infoHash)]
+}
+
+func (s *TrackerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var resp map[string]interface{}
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/announce"):
+		resp = s.serveAnnounce(r)
+	case strings.HasSuffix(r.URL.Path, "/scrape"):
+		resp = s.serveScrape(r)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(Bencode(resp)))
+}
+
+func (s *TrackerServer) serveAnnounce(r *http.Request) map[string]interface{} {
+	q := r.URL.Query()
+	infoHash, peerID := []byte(q.Get("info_hash")), []byte(q.Get("peer_id"))
+	if len(infoHash) != 20 || len(peerID) != 20 {
+		return trackerFailure("invalid info_hash or peer_id")
+	}
+	if !s.isAllowed(infoHash) {
+		return trackerFailure("unregistered torrent")
+	}
+	passkey, failure := s.authorize(r, infoHash)
+	if failure != nil {
+		return failure
+	}
+	port, err := strconv.Atoi(q.Get("port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return trackerFailure("invalid port")
+	}
+	left, err := strconv.ParseInt(q.Get("left"), 10, 64)
+	if err != nil || left < 0 {
+		return trackerFailure("invalid left")
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	if err != nil || ip == nil {
+		return trackerFailure("unable to determine peer address")
+	}
+
+	numWant := defaultServerNumWant
+	if n, err := strconv.Atoi(q.Get("numwant")); err == nil && n >= 0 {
+		numWant = n
+	}
+	if numWant > maxServerNumWant {
+		numWant = maxServerNumWant
+	}
+	event := parseAnnounceEvent(q.Get("event"))
+
+	peers, counts, err := s.announce(infoHash, PeerAddr{ip, port, peerID}, left, event, numWant)
+	if err != nil {
+		return trackerFailure("internal error")
+	}
+	if passkey != "" {
+		uploaded, _ := strconv.ParseInt(q.Get("uploaded"), 10, 64)
+		downloaded, _ := strconv.ParseInt(q.Get("downloaded"), 10, 64)
+		s.account(passkey, infoHash, peerID, uploaded, downloaded, event)
+	}
+	resp := map[string]interface{}{
+		"interval":     int64(s.Interval / time.Second),
+		"min interval": int64(s.MinInterval / time.Second),
+		"complete":     counts.Complete,
+		"incomplete":   counts.Incomplete,
+	}
+	if q.Get("compact") == "0" {
+		list := make([]interface{}, len(peers))
+		for i, p := range peers {
+			list[i] = map[string]interface{}{"peer id": p.ID, "ip": p.IP.String(), "port": p.Port}
+		}
+		resp["peers"] = list
+	} else {
+		resp["peers"], resp["peers6"] = compactPeers(peers)
+	}
+	return resp
+}
+
+func (s *TrackerServer) serveScrape(r *http.Request) map[string]interface{} {
+	passkey := s.requestPasskey(r)
+	if passkey != "" && !s.knownUser(passkey) {
+		return trackerFailure("unknown passkey")
+	}
+	var infoHashes [][]byte
+	for _, h := range r.URL.Query()["info_hash"] {
+		infoHashes = append(infoHashes, []byte(h))
+	}
+	if len(infoHashes) == 0 {
+		var err error
+		if infoHashes, err = s.Store.InfoHashes(); err != nil {
+			return trackerFailure("internal error")
+		}
+	}
+
+	files := make(map[string]interface{})
+	for _, h := range infoHashes {
+		if !s.isAllowed(h) || passkey == "" && s.isPrivate(h) {
+			continue
+		}
+		counts, err := s.Store.Scrape(h)
+		if err != nil {
+			return trackerFailure("internal error")
+		}
+		files[string(h)] = map[string]interface{}{
+			"complete":   counts.Complete,
+			"downloaded": counts.Downloaded,
+			"incomplete": counts.Incomplete,
+		}
+	}
+	return map[string]interface{}{"files": files}
+}
+
+// announce records an announce in Store, first sweeping it of expired peers
+// and user sessions if the last sweep was an Interval ago.
+func (s *TrackerServer) announce(infoHash []byte, peer PeerAddr, left int64, event AnnounceEvent, numWant int) ([]PeerAddr, ScrapeResult, error) {
+	if err := s.expire(); err != nil {
+		return nil, ScrapeResult{}, err
+	}
+	return s.Store.Announce(infoHash, peer, left, event, numWant)
+}
+
+func (s *TrackerServer) expire() error {
+	now := s.now()
+	s.mu.Lock()
+	due := now.Sub(s.lastExpire) >= s.Interval
+	if due {
+		s.lastExpire = now
+		s.expireSessions(now)
+	}
+	s.mu.Unlock()
+	if !due {
+		return nil
+	}
+	return s.Store.Expire()
+}
+
+func parseAnnounceEvent(event string) AnnounceEvent {
+	switch event {
+	case "started":
+		return EventStarted
+	case "completed":
+		return EventCompleted
+	case "stopped":
+		return EventStopped
+	}
+	return EventNone
+}
+
+func trackerFailure(reason string) map[string]interface{} {
+	return map[string]interface{}{"failure reason": reason}
+}
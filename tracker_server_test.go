@@ -0,0 +1,201 @@
+package btgo
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTrackerServerAnnounce(t *testing.T) {
+	ts := NewTrackerServer()
+	server := httptest.NewServer(ts)
+	defer server.Close()
+	tracker := NewHTTPTracker(server.URL + "/announce")
+	ctx := context.Background()
+
+	infoHash := bytes.Repeat([]byte{7}, 20)
+	seeder := AnnounceRequest{InfoHash: infoHash, PeerID: bytes.Repeat([]byte{'s'}, 20), Port: 1001, Left: 0, Event: EventStarted, NumWant: -1}
+	leecher := AnnounceRequest{InfoHash: infoHash, PeerID: bytes.Repeat([]byte{'l'}, 20), Port: 1002, Left: 500, Event: EventStarted, NumWant: -1}
+
+	resp, err := tracker.Announce(ctx, seeder)
+	if err != nil {
+		t.Fatalf("Seeder announce failed: %s", err)
+	}
+	if len(resp.Peers) != 0 || resp.Complete != 1 || resp.Interval != defaultAnnounceInterval {
+		t.Errorf("Wrong response to first announce: %+v", resp)
+	}
+
+	resp, err = tracker.Announce(ctx, leecher)
+	if err != nil {
+		t.Fatalf("Leecher announce failed: %s", err)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "127.0.0.1:1001" || resp.Complete != 1 || resp.Incomplete != 1 {
+		t.Errorf("Wrong response to leecher announce: %+v", resp)
+	}
+
+	leecher.Left, leecher.Event = 0, EventCompleted
+	if _, err = tracker.Announce(ctx, leecher); err != nil {
+		t.Fatalf("Completed announce failed: %s", err)
+	}
+	seeder.Event = EventStopped
+	if _, err = tracker.Announce(ctx, seeder); err != nil {
+		t.Fatalf("Stopped announce failed: %s", err)
+	}
+
+	results, err := tracker.Scrape(ctx, [][]byte{infoHash})
+	if err != nil {
+		t.Fatalf("Scrape failed: %s", err)
+	}
+	if r := results[string(infoHash)]; r.Complete != 1 || r.Incomplete != 0 || r.Downloaded != 1 {
+		t.Errorf("Wrong scrape result: %+v", r)
+	}
+}
+
+func TestTrackerServerAllowList(t *testing.T) {
+	ts := NewTrackerServer()
+	allowed := loadTestTorfile(t, "test/ubuntu.torrent")
+	ts.Allow(allowed)
+	server := httptest.NewServer(ts)
+	defer server.Close()
+	tracker := NewHTTPTracker(server.URL + "/tracker/announce")
+
+	req := AnnounceRequest{InfoHash: bytes.Repeat([]byte{1}, 20), PeerID: bytes.Repeat([]byte{2}, 20), Port: 6881, NumWant: -1}
+	if _, err := tracker.Announce(context.Background(), req); err == nil || err.(*TrackerError).Reason != "unregistered torrent" {
+		t.Errorf("Expected unregistered torrent failure, got %v", err)
+	}
+	req.InfoHash = allowed.infoHash
+	if _, err := tracker.Announce(context.Background(), req); err != nil {
+		t.Errorf("Allowed torrent was rejected: %s", err)
+	}
+	req.Port = 0
+	if _, err := tracker.Announce(context.Background(), req); err == nil {
+		t.Error("Expected invalid port to be rejected")
+	}
+}
+
+func TestTrackerServerPasskeys(t *testing.T) {
+	ts := NewTrackerServer()
+	ts.PasskeyInPath = true
+	info := map[string]interface{}{"name": "secret.bin", "length": 1, "piece length": 16384, "pieces": string(make([]byte, 20)), "private": 1}
+	private, err := NewTorfile([]byte(Bencode(map[string]interface{}{"announce": "http://example.com/announce", "info": info})))
+	if err != nil || !private.Private() {
+		t.Fatalf("Failed to parse private torrent: %v", err)
+	}
+	public := loadTestTorfile(t, "test/ubuntu.torrent")
+	if public.Private() {
+		t.Error("Public torrent reported as private")
+	}
+	ts.Allow(private, public)
+	ts.AddUser("alice")
+	server := httptest.NewServer(ts)
+	defer server.Close()
+	ctx := context.Background()
+
+	announce := func(url string, infoHash []byte, peerID byte, uploaded, downloaded int64, event AnnounceEvent) error {
+		_, err := NewHTTPTracker(server.URL+url).Announce(ctx, AnnounceRequest{
+			InfoHash: infoHash, PeerID: bytes.Repeat([]byte{peerID}, 20), Port: 6881,
+			Uploaded: uploaded, Downloaded: downloaded, Left: 1, Event: event, NumWant: -1,
+		})
+		return err
+	}
+	failure := func(err error) string {
+		if terr, ok := err.(*TrackerError); ok {
+			return terr.Reason
+		}
+		return ""
+	}
+
+	if reason := failure(announce("/announce", private.infoHash, 'a', 0, 0, EventStarted)); reason != "passkey required" {
+		t.Errorf("Expected private torrent to require a passkey, got %q", reason)
+	}
+	if reason := failure(announce("/announce?passkey=mallory", public.infoHash, 'a', 0, 0, EventStarted)); reason != "unknown passkey" {
+		t.Errorf("Expected unknown passkey to be rejected, got %q", reason)
+	}
+	if err := announce("/announce", public.infoHash, 'a', 0, 0, EventStarted); err != nil {
+		t.Errorf("Public torrent rejected anonymous announce: %s", err)
+	}
+
+	steps := []struct {
+		url                  string
+		peerID               byte
+		uploaded, downloaded int64
+		event                AnnounceEvent
+	}{
+		{"/alice/announce", 'a', 100, 50, EventStarted},
+		{"/alice/announce", 'a', 300, 80, EventNone},
+		{"/announce?passkey=alice", 'a', 20, 5, EventNone},
+		{"/alice/announce", 'b', 1000, 0, EventNone},
+		{"/alice/announce", 'a', 40, 5, EventStopped},
+		{"/alice/announce", 'a', 10, 10, EventStarted},
+	}
+	for _, step := range steps {
+		if err := announce(step.url, private.infoHash, step.peerID, step.uploaded, step.downloaded, step.event); err != nil {
+			t.Fatalf("Announce to %s failed: %s", step.url, err)
+		}
+	}
+	stats, ok := ts.UserStats("alice")
+	if !ok || stats.Uploaded != 300+20+1000+20+10 || stats.Downloaded != 80+5+0+0+10 {
+		t.Errorf("Wrong user stats: %+v", stats)
+	}
+
+	ts.RemoveUser("alice")
+	if reason := failure(announce("/alice/announce", private.infoHash, 'a', 0, 0, EventNone)); reason != "unknown passkey" {
+		t.Errorf("Expected removed user to be rejected, got %q", reason)
+	}
+}
+
+func TestTrackerServerExpiresPeers(t *testing.T) {
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+	ts := NewTrackerServer()
+	ts.now = clock
+	store := NewMemorySwarmStore(2 * ts.Interval)
+	store.now = clock
+	ts.Store = store
+	server := httptest.NewServer(ts)
+	defer server.Close()
+	tracker := NewHTTPTracker(server.URL + "/announce")
+	ctx := context.Background()
+
+	gone := bytes.Repeat([]byte{1}, 20)
+	req := AnnounceRequest{InfoHash: gone, PeerID: bytes.Repeat([]byte{'a'}, 20), Port: 6881, Left: 1, Event: EventStarted, NumWant: -1}
+	if _, err := tracker.Announce(ctx, req); err != nil {
+		t.Fatalf("Announce failed: %s", err)
+	}
+
+	now = now.Add(3 * ts.Interval)
+	req.InfoHash = bytes.Repeat([]byte{2}, 20)
+	if _, err := tracker.Announce(ctx, req); err != nil {
+		t.Fatalf("Announce failed: %s", err)
+	}
+	infoHashes, _ := store.InfoHashes()
+	if len(infoHashes) != 1 || !bytes.Equal(infoHashes[0], req.InfoHash) {
+		t.Errorf("Expected only the live swarm to be left, got %d swarms", len(infoHashes))
+	}
+}
+
+func TestTrackerServerExpiresSessions(t *testing.T) {
+	now := time.Unix(1000, 0)
+	ts := NewTrackerServer()
+	ts.now = func() time.Time { return now }
+	ts.AddUser("alice")
+	server := httptest.NewServer(ts)
+	defer server.Close()
+	ctx := context.Background()
+
+	for i := byte(0); i < 3; i++ {
+		req := AnnounceRequest{InfoHash: bytes.Repeat([]byte{i}, 20), PeerID: bytes.Repeat([]byte{'a'}, 20), Port: 6881, Left: 1, NumWant: -1}
+		if _, err := NewHTTPTracker(server.URL+"/announce?passkey=alice").Announce(ctx, req); err != nil {
+			t.Fatalf("Announce failed: %s", err)
+		}
+		now = now.Add(3 * ts.Interval)
+	}
+	ts.mu.RLock()
+	sessions := len(ts.sessions)
+	ts.mu.RUnlock()
+	if sessions != 1 {
+		t.Errorf("Expected 1 session left, got %d", sessions)
+	}
+}
@@ -0,0 +1,254 @@
+package btgo
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	udpConnectionIDLifetime = time.Minute
+	udpMaxScrapeHashes      = 74
+)
+
+// UDPTracker speaks BEP 15. Requests are retransmitted after Timeout·2^n for
+// n up to MaxRetries; the defaults give the protocol's 15·2^n seconds with
+// n capped at 8.
+type UDPTracker struct {
+	URL        string
+	Timeout    time.Duration
+	MaxRetries int
+
+	host         string
+	now          func() time.Time
+	mu           sync.Mutex
+	connectionID uint64
+	connectedAt  time.Time
+}
+
+func NewUDPTracker(announce string) (t *UDPTracker, err error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return
+	}
+	if u.Scheme != "udp" || u.Port() == "" {
+		err = fmt.Errorf("Not a UDP tracker URL: %s", announce)
+		return
+	}
+	t = &UDPTracker{URL: announce, Timeout: 15 * time.Second, MaxRetries: 8, host: u.Host, now: time.Now}
+	return
+}
+
+func (t *UDPTracker) Announce(ctx context.Context, req AnnounceRequest) (resp *AnnounceResponse, err error) {
+	conn, err := t.dial(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	packet := make([]byte, 98)
+	binary.BigEndian.PutUint32(packet[8:], udpActionAnnounce)
+	copy(packet[16:36], req.InfoHash)
+	copy(packet[36:56], req.PeerID)
+	binary.BigEndian.PutUint64(packet[56:], uint64(req.Downloaded))
+	binary.BigEndian.PutUint64(packet[64:], uint64(req.Left))
+	binary.BigEndian.PutUint64(packet[72:], uint64(req.Uploaded))
+	binary.BigEndian.PutUint32(packet[80:], uint32(req.Event))
+	binary.BigEndian.PutUint32(packet[88:], req.Key)
+	numWant := int32(-1)
+	if req.NumWant > 0 {
+		numWant = int32(req.NumWant)
+	}
+	binary.BigEndian.PutUint32(packet[92:], uint32(numWant))
+	binary.BigEndian.PutUint16(packet[96:], uint16(req.Port))
+
+	reply, err := t.roundTrip(ctx, conn, packet, udpActionAnnounce)
+	if err != nil {
+		return
+	}
+	if len(reply) < 20 {
+		err = errors.New("Short UDP announce response")
+		return
+	}
+
+	ipLen := net.IPv4len
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		ipLen = net.IPv6len
+	}
+	resp = &AnnounceResponse{
+		Interval:   time.Duration(binary.BigEndian.Uint32(reply[8:])) * time.Second,
+		Incomplete: int(binary.BigEndian.Uint32(reply[12:])),
+		Complete:   int(binary.BigEndian.Uint32(reply[16:])),
+	}
+	if resp.Peers, err = parseCompactPeers(reply[20:], ipLen); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Scrape fetches counts for up to 74 infohashes per request, the most that
+// fit in a single UDP response.
+func (t *UDPTracker) Scrape(ctx context.Context, infoHashes [][]byte) (results map[string]ScrapeResult, err error) {
+	conn, err := t.dial(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	results = make(map[string]ScrapeResult, len(infoHashes))
+	for begin := 0; begin < len(infoHashes); begin += udpMaxScrapeHashes {
+		end := begin + udpMaxScrapeHashes
+		if end > len(infoHashes) {
+			end = len(infoHashes)
+		}
+		batch := infoHashes[begin:end]
+
+		packet := make([]byte, 16, 16+20*len(batch))
+		binary.BigEndian.PutUint32(packet[8:], udpActionScrape)
+		for _, h := range batch {
+			hash := make([]byte, 20)
+			copy(hash, h)
+			packet = append(packet, hash...)
+		}
+
+		var reply []byte
+		if reply, err = t.roundTrip(ctx, conn, packet, udpActionScrape); err != nil {
+			return nil, err
+		}
+		if len(reply) < 8+12*len(batch) {
+			return nil, errors.New("Short UDP scrape response")
+		}
+		for i, h := range batch {
+			entry := reply[8+12*i:]
+			results[string(h)] = ScrapeResult{
+				Complete:   int(binary.BigEndian.Uint32(entry[0:])),
+				Downloaded: int(binary.BigEndian.Uint32(entry[4:])),
+				Incomplete: int(binary.BigEndian.Uint32(entry[8:])),
+			}
+		}
+	}
+	return
+}
+
+func (t *UDPTracker) dial(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "udp", t.host)
+}
+
+// connect returns a cached connection ID while it is younger than a minute
+// and otherwise obtains a new one from the tracker.
+func (t *UDPTracker) connect(ctx context.Context, conn net.Conn) (connectionID uint64, err error) {
+	t.mu.Lock()
+	if t.now().Sub(t.connectedAt) < udpConnectionIDLifetime {
+		connectionID = t.connectionID
+		t.mu.Unlock()
+		return
+	}
+	t.mu.Unlock()
+
+	packet := make([]byte, 16)
+	binary.BigEndian.PutUint64(packet[0:], udpProtocolID)
+	binary.BigEndian.PutUint32(packet[8:], udpActionConnect)
+	reply, err := t.roundTrip(ctx, conn, packet, udpActionConnect)
+	if err != nil {
+		return
+	}
+	if len(reply) < 16 {
+		err = errors.New("Short UDP connect response")
+		return
+	}
+	connectionID = binary.BigEndian.Uint64(reply[8:])
+
+	t.mu.Lock()
+	t.connectionID, t.connectedAt = connectionID, t.now()
+	t.mu.Unlock()
+	return
+}
+
+// roundTrip stamps packet with a fresh transaction ID, sends it and waits for
+// the matching reply, retransmitting on the BEP 15 schedule. Requests other
+// than connect are stamped with a connection ID before every transmission,
+// connecting again whenever the last one has expired.
+func (t *UDPTracker) roundTrip(ctx context.Context, conn net.Conn, packet []byte, action uint32) (reply []byte, err error) {
+	transactionID := rand.Uint32()
+	binary.BigEndian.PutUint32(packet[12:], transactionID)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	buf := make([]byte, 65536)
+	for n := 0; n <= t.MaxRetries; n++ {
+		if action != udpActionConnect {
+			var connectionID uint64
+			if connectionID, err = t.connect(ctx, conn); err != nil {
+				return
+			}
+			binary.BigEndian.PutUint64(packet[0:], connectionID)
+		}
+		if _, err = conn.Write(packet); err != nil {
+			break
+		}
+		// A cancel that came before the new deadline was set would be
+		// overwritten by it, so check once it is in place.
+		conn.SetReadDeadline(time.Now().Add(t.Timeout << uint(n)))
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			return
+		}
+		for {
+			var size int
+			if size, err = conn.Read(buf); err != nil {
+				break
+			}
+			if size < 8 || binary.BigEndian.Uint32(buf[4:]) != transactionID {
+				continue
+			}
+			switch binary.BigEndian.Uint32(buf[0:]) {
+			case action:
+				reply = append([]byte(nil), buf[:size]...)
+				return
+			case udpActionError:
+				// The error may be about the connection ID, so get a new one
+				// next time.
+				if action != udpActionConnect {
+					t.mu.Lock()
+					t.connectedAt = time.Time{}
+					t.mu.Unlock()
+				}
+				err = &TrackerError{string(buf[8:size])}
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			return
+		}
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			break
+		}
+	}
+	if err == nil {
+		err = errors.New("UDP tracker did not respond")
+	}
+	return
+}
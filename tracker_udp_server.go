@@ -0,0 +1,217 @@
+package btgo
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	udpConnectionIDEpoch = time.Minute
+	rateLimiterSweep     = 1024
+)
+
+// UDPTrackerServer answers BEP 15 requests using the swarms, intervals and
+// allow-list of a TrackerServer, so one swarm is shared by HTTP and UDP peers.
+// Private torfiles are refused since UDP announces carry no passkey.
+// Connection IDs are an HMAC of the client address and the current minute,
+// which lets them be checked without keeping any per-client state.
+type UDPTrackerServer struct {
+	RateLimit float64 // requests per second per IP; zero disables limiting
+	RateBurst int
+
+	tracker *TrackerServer
+	secret  []byte
+	now     func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+	seen    int
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewUDPTrackerServer(tracker *TrackerServer) *UDPTrackerServer {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return &UDPTrackerServer{
+		RateLimit: 20,
+		RateBurst: 40,
+		tracker:   tracker,
+		secret:    secret,
+		now:       time.Now,
+		buckets:   make(map[string]*rateBucket),
+	}
+}
+
+// Serve answers requests on conn until it is closed.
+func (s *UDPTrackerServer) Serve(conn net.PacketConn) error {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok || n < 16 || !s.allow(udpAddr.IP) {
+			continue
+		}
+		if reply := s.handle(buf[:n], udpAddr); reply != nil {
+			conn.WriteTo(reply, addr)
+		}
+	}
+}
+
+func (s *UDPTrackerServer) handle(packet []byte, addr *net.UDPAddr) []byte {
+	connectionID := binary.BigEndian.Uint64(packet[0:])
+	action := binary.BigEndian.Uint32(packet[8:])
+	transactionID := packet[12:16]
+
+	if action == udpActionConnect {
+		if connectionID != udpProtocolID {
+			return nil
+		}
+		reply := udpReplyHeader(udpActionConnect, transactionID)
+		return binary.BigEndian.AppendUint64(reply, s.connectionID(addr.IP, s.now()))
+	}
+	if !s.validConnectionID(connectionID, addr.IP) {
+		return udpErrorReply(transactionID, "invalid connection id")
+	}
+
+	switch action {
+	case udpActionAnnounce:
+		return s.handleAnnounce(packet, addr, transactionID)
+	case udpActionScrape:
+		return s.handleScrape(packet, transactionID)
+	}
+	return udpErrorReply(transactionID, "unknown action")
+}
+
+func (s *UDPTrackerServer) handleAnnounce(packet []byte, addr *net.UDPAddr, transactionID []byte) []byte {
+	if len(packet) < 98 {
+		return udpErrorReply(transactionID, "short announce")
+	}
+	infoHash := append([]byte(nil), packet[16:36]...)
+	if !s.tracker.isAllowed(infoHash) {
+		return udpErrorReply(transactionID, "unregistered torrent")
+	}
+	if s.tracker.isPrivate(infoHash) {
+		return udpErrorReply(transactionID, "passkey required")
+	}
+	peerID := append([]byte(nil), packet[36:56]...)
+	left := int64(binary.BigEndian.Uint64(packet[64:]))
+	event := AnnounceEvent(binary.BigEndian.Uint32(packet[80:]))
+	numWant := int(int32(binary.BigEndian.Uint32(packet[92:])))
+	port := int(binary.BigEndian.Uint16(packet[96:]))
+	if left < 0 || event > EventStopped {
+		return udpErrorReply(transactionID, "invalid announce")
+	}
+	if numWant < 0 {
+		numWant = defaultServerNumWant
+	}
+	if numWant > maxServerNumWant {
+		numWant = maxServerNumWant
+	}
+
+	peers, counts, err := s.tracker.announce(infoHash, PeerAddr{addr.IP, port, peerID}, left, event, numWant)
+	if err != nil {
+		return udpErrorReply(transactionID, "internal error")
+	}
+	reply := udpReplyHeader(udpActionAnnounce, transactionID)
+	reply = binary.BigEndian.AppendUint32(reply, uint32(s.tracker.Interval/time.Second))
+	reply = binary.BigEndian.AppendUint32(reply, uint32(counts.Incomplete))
+	reply = binary.BigEndian.AppendUint32(reply, uint32(counts.Complete))
+	v4, v6 := compactPeers(peers)
+	if addr.IP.To4() != nil {
+		return append(reply, v4...)
+	}
+	return append(reply, v6...)
+}
+
+func (s *UDPTrackerServer) handleScrape(packet []byte, transactionID []byte) []byte {
+	hashes := (len(packet) - 16) / 20
+	if hashes == 0 || hashes > udpMaxScrapeHashes {
+		return udpErrorReply(transactionID, "invalid scrape")
+	}
+	reply := udpReplyHeader(udpActionScrape, transactionID)
+	for i := 0; i < hashes; i++ {
+		infoHash := packet[16+20*i : 36+20*i]
+		var counts ScrapeResult
+		if s.tracker.isAllowed(infoHash) && !s.tracker.isPrivate(infoHash) {
+			var err error
+			if counts, err = s.tracker.Store.Scrape(infoHash); err != nil {
+				return udpErrorReply(transactionID, "internal error")
+			}
+		}
+		reply = binary.BigEndian.AppendUint32(reply, uint32(counts.Complete))
+		reply = binary.BigEndian.AppendUint32(reply, uint32(counts.Downloaded))
+		reply = binary.BigEndian.AppendUint32(reply, uint32(counts.Incomplete))
+	}
+	return reply
+}
+
+func (s *UDPTrackerServer) connectionID(ip net.IP, at time.Time) uint64 {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(ip.To16())
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(at.Unix()/int64(udpConnectionIDEpoch/time.Second))))
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// validConnectionID accepts IDs issued in the current or previous epoch, so
+// an ID lives between one and two minutes.
+func (s *UDPTrackerServer) validConnectionID(connectionID uint64, ip net.IP) bool {
+	now := s.now()
+	return connectionID == s.connectionID(ip, now) || connectionID == s.connectionID(ip, now.Add(-udpConnectionIDEpoch))
+}
+
+// allow applies a token bucket per source IP.
+func (s *UDPTrackerServer) allow(ip net.IP) bool {
+	if s.RateLimit <= 0 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.seen++
+	if s.seen%rateLimiterSweep == 0 {
+		for k, b := range s.buckets {
+			if now.Sub(b.last).Seconds()*s.RateLimit > float64(s.RateBurst) {
+				delete(s.buckets, k)
+			}
+		}
+	}
+
+	key := string(ip.To16())
+	b := s.buckets[key]
+	if b == nil {
+		b = &rateBucket{float64(s.RateBurst), now}
+		s.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * s.RateLimit
+	if b.tokens > float64(s.RateBurst) {
+		b.tokens = float64(s.RateBurst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func udpReplyHeader(action uint32, transactionID []byte) []byte {
+	reply := binary.BigEndian.AppendUint32(make([]byte, 0, 64), action)
+	return append(reply, transactionID...)
+}
+
+func udpErrorReply(transactionID []byte, message string) []byte {
+	return append(udpReplyHeader(udpActionError, transactionID), message...)
+}
@@ -0,0 +1,132 @@
+package btgo
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func startUDPTrackerServer(t *testing.T, s *UDPTrackerServer, addr string) (net.PacketConn, string) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Skipf("Unable to listen on %s: %s", addr, err)
+	}
+	go s.Serve(conn)
+	return conn, "udp://" + conn.LocalAddr().String() + "/announce"
+}
+
+func TestUDPTrackerServer(t *testing.T) {
+	ts := NewTrackerServer()
+	httpServer := httptest.NewServer(ts)
+	defer httpServer.Close()
+	conn, announce := startUDPTrackerServer(t, NewUDPTrackerServer(ts), "127.0.0.1:0")
+	defer conn.Close()
+	ctx := context.Background()
+
+	infoHash := bytes.Repeat([]byte{9}, 20)
+	_, err := NewHTTPTracker(httpServer.URL+"/announce").Announce(ctx, AnnounceRequest{InfoHash: infoHash, PeerID: bytes.Repeat([]byte{'h'}, 20), Port: 2001, Event: EventStarted, NumWant: -1})
+	if err != nil {
+		t.Fatalf("HTTP announce failed: %s", err)
+	}
+
+	tracker, _ := NewUDPTracker(announce)
+	resp, err := tracker.Announce(ctx, AnnounceRequest{InfoHash: infoHash, PeerID: bytes.Repeat([]byte{'u'}, 20), Port: 2002, Left: 10, Event: EventStarted, NumWant: -1})
+	if err != nil {
+		t.Fatalf("UDP announce failed: %s", err)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "127.0.0.1:2001" || resp.Complete != 1 || resp.Incomplete != 1 || resp.Interval != ts.Interval {
+		t.Errorf("Wrong UDP announce response: %+v", resp)
+	}
+
+	results, err := tracker.Scrape(ctx, [][]byte{infoHash, bytes.Repeat([]byte{8}, 20)})
+	if err != nil {
+		t.Fatalf("UDP scrape failed: %s", err)
+	}
+	if r := results[string(infoHash)]; r.Complete != 1 || r.Incomplete != 1 {
+		t.Errorf("Wrong UDP scrape result: %+v", r)
+	}
+
+	ts.Allow(loadTestTorfile(t, "test/ubuntu.torrent"))
+	_, err = tracker.Announce(ctx, AnnounceRequest{InfoHash: infoHash, NumWant: -1})
+	if terr, ok := err.(*TrackerError); !ok || terr.Reason != "unregistered torrent" {
+		t.Errorf("Expected allow-list to apply to UDP, got %v", err)
+	}
+
+	client, _ := net.Dial("udp", conn.LocalAddr().String())
+	defer client.Close()
+	packet := make([]byte, 98)
+	binary.BigEndian.PutUint64(packet, 12345)
+	binary.BigEndian.PutUint32(packet[8:], udpActionAnnounce)
+	client.Write(packet)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	reply := make([]byte, 100)
+	n, err := client.Read(reply)
+	if err != nil || binary.BigEndian.Uint32(reply) != udpActionError || string(reply[8:n]) != "invalid connection id" {
+		t.Errorf("Expected forged connection ID to be rejected: %q %v", reply[:n], err)
+	}
+}
+
+func TestUDPTrackerServerIPv6(t *testing.T) {
+	ts := NewTrackerServer()
+	conn, announce := startUDPTrackerServer(t, NewUDPTrackerServer(ts), "[::1]:0")
+	defer conn.Close()
+
+	infoHash := bytes.Repeat([]byte{6}, 20)
+	ts.Store.Announce(infoHash, PeerAddr{IP: net.ParseIP("2001:db8::5"), Port: 3000}, 0, EventStarted, 0)
+	ts.Store.Announce(infoHash, PeerAddr{IP: net.ParseIP("10.0.0.5"), Port: 3001}, 0, EventStarted, 0)
+
+	tracker, _ := NewUDPTracker(announce)
+	resp, err := tracker.Announce(context.Background(), AnnounceRequest{InfoHash: infoHash, PeerID: bytes.Repeat([]byte{'v'}, 20), Port: 3002, Left: 1, NumWant: -1})
+	if err != nil {
+		t.Fatalf("UDP announce failed: %s", err)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "[2001:db8::5]:3000" {
+		t.Errorf("Wrong IPv6 peers: %v", resp.Peers)
+	}
+}
+
+func TestUDPTrackerServerConnectionIDs(t *testing.T) {
+	s := NewUDPTrackerServer(NewTrackerServer())
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	ip := net.ParseIP("192.0.2.1")
+
+	id := s.connectionID(ip, now)
+	if !s.validConnectionID(id, ip) || s.validConnectionID(id, net.ParseIP("192.0.2.2")) {
+		t.Error("Connection ID should only be valid for the address it was issued to")
+	}
+	now = now.Add(udpConnectionIDEpoch)
+	if !s.validConnectionID(id, ip) {
+		t.Error("Connection ID expired too early")
+	}
+	now = now.Add(udpConnectionIDEpoch)
+	if s.validConnectionID(id, ip) {
+		t.Error("Connection ID did not expire")
+	}
+}
+
+func TestUDPTrackerServerRateLimit(t *testing.T) {
+	s := NewUDPTrackerServer(NewTrackerServer())
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	s.RateLimit, s.RateBurst = 2, 3
+	ip := net.ParseIP("192.0.2.1")
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if s.allow(ip) {
+			allowed++
+		}
+	}
+	if allowed != 3 || !s.allow(net.ParseIP("192.0.2.2")) {
+		t.Errorf("Wrong burst: %d", allowed)
+	}
+	now = now.Add(time.Second)
+	if !s.allow(ip) || !s.allow(ip) || s.allow(ip) {
+		t.Error("Tokens were not refilled at the configured rate")
+	}
+}
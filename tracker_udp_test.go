@@ -0,0 +1,251 @@
+package btgo
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type udpStandIn struct {
+	conn          *net.UDPConn
+	mu            sync.Mutex
+	drop          int
+	dropAnnounces int
+	connects      int
+	requests      [][]byte
+}
+
+func newUDPStandIn(t *testing.T, network, addr string, drop int) *udpStandIn {
+	laddr, _ := net.ResolveUDPAddr(network, addr)
+	conn, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		t.Skipf("Unable to listen on %s: %s", addr, err)
+	}
+	s := &udpStandIn{conn: conn, drop: drop}
+	go s.serve()
+	return s
+}
+
+func (s *udpStandIn) url() string {
+	return "udp://" + s.conn.LocalAddr().String() + "/announce"
+}
+
+func (s *udpStandIn) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		packet := append([]byte(nil), buf[:n]...)
+		action := binary.BigEndian.Uint32(packet[8:])
+		s.mu.Lock()
+		if s.drop > 0 {
+			s.drop--
+			s.mu.Unlock()
+			continue
+		}
+		if action == udpActionAnnounce && s.dropAnnounces > 0 {
+			s.dropAnnounces--
+			s.mu.Unlock()
+			continue
+		}
+		s.requests = append(s.requests, packet)
+		s.mu.Unlock()
+
+		reply := make([]byte, 8)
+		binary.BigEndian.PutUint32(reply[0:], action)
+		copy(reply[4:8], packet[12:16])
+		switch {
+		case action == udpActionConnect && binary.BigEndian.Uint64(packet) == udpProtocolID:
+			s.mu.Lock()
+			s.connects++
+			s.mu.Unlock()
+			reply = append(reply, 0, 0, 0, 0, 0, 0, 0xab, 0xcd)
+		case binary.BigEndian.Uint64(packet) != 0xabcd:
+			binary.BigEndian.PutUint32(reply[0:], udpActionError)
+			reply = append(reply, "bad connection id"...)
+		case action == udpActionAnnounce:
+			if bytes.Equal(packet[16:36], []byte("fail-fail-fail-fail!")) {
+				binary.BigEndian.PutUint32(reply[0:], udpActionError)
+				reply = append(reply, "unregistered torrent"...)
+				break
+			}
+			reply = append(reply, 0, 0, 0x07, 0x08, 0, 0, 0, 3, 0, 0, 0, 9)
+			v4, v6 := compactPeers([]PeerAddr{{IP: net.ParseIP("10.1.2.3"), Port: 6881}, {IP: net.ParseIP("2001:db8::7"), Port: 6882}})
+			if addr.IP.To4() == nil {
+				reply = append(reply, v6...)
+			} else {
+				reply = append(reply, v4...)
+			}
+		case action == udpActionScrape:
+			for i := 16; i < len(packet); i += 20 {
+				entry := make([]byte, 12)
+				binary.BigEndian.PutUint32(entry[0:], uint32(packet[i]))
+				binary.BigEndian.PutUint32(entry[4:], 100)
+				binary.BigEndian.PutUint32(entry[8:], uint32(packet[i+1]))
+				reply = append(reply, entry...)
+			}
+		}
+		s.conn.WriteToUDP(reply, addr)
+	}
+}
+
+func TestUDPTrackerAnnounce(t *testing.T) {
+	s := newUDPStandIn(t, "udp4", "127.0.0.1:0", 1)
+	defer s.conn.Close()
+
+	tracker, err := NewUDPTracker(s.url())
+	if err != nil {
+		t.Fatalf("Failed to create tracker: %s", err)
+	}
+	tracker.Timeout = 20 * time.Millisecond
+
+	req := AnnounceRequest{
+		InfoHash: bytes.Repeat([]byte{1}, 20), PeerID: bytes.Repeat([]byte{2}, 20), Port: 6881,
+		Uploaded: 1, Downloaded: 2, Left: 3, Event: EventStarted, NumWant: -1, Key: 42,
+	}
+	resp, err := tracker.Announce(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Announce failed: %s", err)
+	}
+	if resp.Interval != 1800*time.Second || resp.Incomplete != 3 || resp.Complete != 9 {
+		t.Errorf("Wrong announce response: %+v", resp)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "10.1.2.3:6881" {
+		t.Errorf("Wrong peers: %v", resp.Peers)
+	}
+
+	s.mu.Lock()
+	announce := s.requests[len(s.requests)-1]
+	s.mu.Unlock()
+	if len(announce) != 98 || binary.BigEndian.Uint64(announce[56:]) != 2 || binary.BigEndian.Uint64(announce[64:]) != 3 || binary.BigEndian.Uint64(announce[72:]) != 1 {
+		t.Errorf("Wrong counters in announce packet: %x", announce)
+	}
+	if binary.BigEndian.Uint32(announce[80:]) != 2 || int32(binary.BigEndian.Uint32(announce[92:])) != -1 || binary.BigEndian.Uint16(announce[96:]) != 6881 {
+		t.Errorf("Wrong event, numwant or port in announce packet: %x", announce)
+	}
+
+	if _, err := tracker.Announce(context.Background(), req); err != nil {
+		t.Fatalf("Second announce failed: %s", err)
+	}
+	s.mu.Lock()
+	connects := s.connects
+	s.mu.Unlock()
+	if connects != 1 {
+		t.Errorf("Expected connection ID to be cached, connected %d times", connects)
+	}
+
+	req.InfoHash = []byte("fail-fail-fail-fail!")
+	_, err = tracker.Announce(context.Background(), req)
+	if terr, ok := err.(*TrackerError); !ok || terr.Reason != "unregistered torrent" {
+		t.Errorf("Expected tracker error, got %v", err)
+	}
+	req.InfoHash = bytes.Repeat([]byte{1}, 20)
+	if _, err := tracker.Announce(context.Background(), req); err != nil {
+		t.Fatalf("Announce after error failed: %s", err)
+	}
+	s.mu.Lock()
+	connects = s.connects
+	s.mu.Unlock()
+	if connects != 2 {
+		t.Errorf("Expected error reply to drop the connection ID, connected %d times", connects)
+	}
+}
+
+func TestUDPTrackerIPv6(t *testing.T) {
+	s := newUDPStandIn(t, "udp6", "[::1]:0", 0)
+	defer s.conn.Close()
+
+	tracker, _ := NewUDPTracker(s.url())
+	resp, err := tracker.Announce(context.Background(), AnnounceRequest{InfoHash: make([]byte, 20), NumWant: -1})
+	if err != nil {
+		t.Fatalf("Announce failed: %s", err)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "[2001:db8::7]:6882" {
+		t.Errorf("Wrong IPv6 peers: %v", resp.Peers)
+	}
+}
+
+func TestUDPTrackerScrape(t *testing.T) {
+	s := newUDPStandIn(t, "udp4", "127.0.0.1:0", 0)
+	defer s.conn.Close()
+
+	var hashes [][]byte
+	for i := 0; i < 100; i++ {
+		hashes = append(hashes, append([]byte{byte(i), byte(i * 2)}, make([]byte, 18)...))
+	}
+	tracker, _ := NewUDPTracker(s.url())
+	results, err := tracker.Scrape(context.Background(), hashes)
+	if err != nil {
+		t.Fatalf("Scrape failed: %s", err)
+	}
+	s.mu.Lock()
+	requests := len(s.requests)
+	s.mu.Unlock()
+	if len(results) != 100 || requests != 3 {
+		t.Errorf("Wrong number of results or requests: %d, %d", len(results), requests)
+	}
+	if r := results[string(hashes[80])]; r.Complete != 80 || r.Downloaded != 100 || r.Incomplete != 160 {
+		t.Errorf("Wrong scrape result: %+v", r)
+	}
+}
+
+func TestUDPTrackerReconnectsBeforeRetry(t *testing.T) {
+	s := newUDPStandIn(t, "udp4", "127.0.0.1:0", 0)
+	defer s.conn.Close()
+	s.mu.Lock()
+	s.dropAnnounces = 1
+	s.mu.Unlock()
+
+	tracker, _ := NewUDPTracker(s.url())
+	tracker.Timeout = 20 * time.Millisecond
+	// Every reading of the clock is a connection ID lifetime later, so the
+	// retransmitted announce needs a new one.
+	now := time.Now()
+	tracker.now = func() time.Time {
+		now = now.Add(udpConnectionIDLifetime)
+		return now
+	}
+	if _, err := tracker.Announce(context.Background(), AnnounceRequest{NumWant: -1}); err != nil {
+		t.Fatalf("Announce failed: %s", err)
+	}
+	s.mu.Lock()
+	connects := s.connects
+	s.mu.Unlock()
+	if connects != 2 {
+		t.Errorf("Expected a reconnect before the retransmission, connected %d times", connects)
+	}
+}
+
+func TestUDPTrackerTimeout(t *testing.T) {
+	s := newUDPStandIn(t, "udp4", "127.0.0.1:0", 1000)
+	defer s.conn.Close()
+
+	tracker, _ := NewUDPTracker(s.url())
+	tracker.Timeout, tracker.MaxRetries = 5*time.Millisecond, 2
+	start := time.Now()
+	if _, err := tracker.Announce(context.Background(), AnnounceRequest{}); err == nil {
+		t.Fatal("Expected unresponsive tracker to fail")
+	}
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Errorf("Gave up before retransmit schedule finished: %s", elapsed)
+	}
+	s.mu.Lock()
+	dropped := 1000 - s.drop
+	s.mu.Unlock()
+	if dropped != 3 {
+		t.Errorf("Expected 3 transmissions, got %d", dropped)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tracker.Timeout, tracker.MaxRetries = time.Hour, 8
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err := tracker.Announce(ctx, AnnounceRequest{}); err != context.Canceled {
+		t.Errorf("Expected cancellation, got %v", err)
+	}
+}
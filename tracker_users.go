@@ -0,0 +1,132 @@
+package btgo
+
+import (
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+type UserStats struct {
+	Uploaded   int64
+	Downloaded int64
+}
+
+// userSession remembers the counters last reported by one client of a user
+// for one swarm, so each announce is credited only with the difference.
+// Sessions not announced to within two intervals are forgotten along with
+// expired peers.
+type userSession struct {
+	uploaded   int64
+	downloaded int64
+	lastSeen   time.Time
+}
+
+func (s *TrackerServer) AddUser(passkey string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.users == nil {
+		s.users = make(map[string]*UserStats)
+		s.sessions = make(map[string]*userSession)
+	}
+	if s.users[passkey] == nil {
+		s.users[passkey] = &UserStats{}
+	}
+}
+
+func (s *TrackerServer) RemoveUser(passkey string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users, passkey)
+	for key := range s.sessions {
+		if strings.HasPrefix(key, passkey+"\x00") {
+			delete(s.sessions, key)
+		}
+	}
+}
+
+// UserStats reports the totals credited to a user across all announces.
+func (s *TrackerServer) UserStats(passkey string) (stats UserStats, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if u := s.users[passkey]; u != nil {
+		stats, ok = *u, true
+	}
+	return
+}
+
+func (s *TrackerServer) knownUser(passkey string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.users[passkey] != nil
+}
+
+// authorize checks the passkey of an announce. Unknown passkeys are always
+// rejected, and private torrents require a known one.
+func (s *TrackerServer) authorize(r *http.Request, infoHash []byte) (passkey string, failure map[string]interface{}) {
+	passkey = s.requestPasskey(r)
+	switch {
+	case passkey != "" && !s.knownUser(passkey):
+		failure = trackerFailure("unknown passkey")
+	case passkey == "" && s.isPrivate(infoHash):
+		failure = trackerFailure("passkey required")
+	}
+	return
+}
+
+// account credits a user with the traffic reported since the previous
+// announce of the same client. A started event or counters lower than last
+// time mean the client restarted, so the reported values are credited whole.
+func (s *TrackerServer) account(passkey string, infoHash []byte, peerID []byte, uploaded int64, downloaded int64, event AnnounceEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user := s.users[passkey]
+	if user == nil {
+		return
+	}
+
+	key := passkey + "\x00" + string(infoHash) + string(peerID)
+	session := s.sessions[key]
+	if session == nil || event == EventStarted {
+		session = &userSession{}
+		s.sessions[key] = session
+	}
+	user.Uploaded += counterDelta(session.uploaded, uploaded)
+	user.Downloaded += counterDelta(session.downloaded, downloaded)
+	session.uploaded, session.downloaded = uploaded, downloaded
+	session.lastSeen = s.now()
+	if event == EventStopped {
+		delete(s.sessions, key)
+	}
+}
+
+// expireSessions forgets the sessions of clients that stopped announcing.
+// Callers must hold s.mu.
+func (s *TrackerServer) expireSessions(now time.Time) {
+	for key, session := range s.sessions {
+		if now.Sub(session.lastSeen) > 2*s.Interval {
+			delete(s.sessions, key)
+		}
+	}
+}
+
+func counterDelta(previous, current int64) int64 {
+	if current < 0 {
+		return 0
+	}
+	if current < previous {
+		return current
+	}
+	return current - previous
+}
+
+func (s *TrackerServer) requestPasskey(r *http.Request) string {
+	if passkey := r.URL.Query().Get("passkey"); passkey != "" || !s.PasskeyInPath {
+		return passkey
+	}
+	dir := path.Dir(r.URL.Path)
+	if dir == "/" || dir == "." {
+		return ""
+	}
+	return path.Base(dir)
+}